@@ -2,79 +2,437 @@ package backup
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 )
 
-func CreateArchive(folders []string, outputPath string) error {
+// metaDir holds entries the tool writes into archives for its own use
+const metaDir = ".cloudflare-backuper/"
+
+// deletedEntry lists the paths removed since the previous backup in an incremental archive
+const deletedEntry = metaDir + "deleted.json"
+
+// changedEntry ends an archive whose files changed between hashing and
+// copying. It lists them as ManifestFiles with the hash of what was
+// archived, which replaces the hash in the manifest.
+const changedEntry = metaDir + "changed.json"
+
+type ArchiveOptions struct {
+	// Previous is the index of the last backup in an incremental chain. When
+	// set, only files that changed since then are archived and removed
+	// files are recorded so a restore can replay the deletion.
+	Previous *Index
+	// EncryptionKey, when set, encrypts the compressed archive before it
+	// is written
+	EncryptionKey *Key
+	// Compression defaults to gzip. A CompressionLevel of 0 selects the
+	// format's default level.
+	Compression      Compression
+	CompressionLevel int
+}
+
+type ArchiveResult struct {
+	// Index describes every path that was backed up, changed or not
+	Index *Index
+	// Manifest lists the entries written to this archive
+	Manifest *Manifest
+	Files    int
+	Deleted  int
+	// Size and Checksum describe the archive as written, after compression
+	// and encryption. Checksum is the hex encoded SHA-256.
+	Size     int64
+	Checksum string
+}
+
+// Entry is a path found while scanning the backup folders
+type Entry struct {
+	Path string
+	Info os.FileInfo
+	Link string
+}
+
+func CreateArchive(folders []Folder, outputPath string, opts ArchiveOptions) (*ArchiveResult, error) {
 
 	outFile, err := os.Create(outputPath)
 	if err != nil {
-		return fmt.Errorf("failed to create archive file: %w", err)
+		return nil, fmt.Errorf("failed to create archive file: %w", err)
 	}
 	defer outFile.Close()
 
-	gzipWriter := gzip.NewWriter(outFile)
-	defer gzipWriter.Close()
+	result, err := WriteArchive(outFile, folders, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := outFile.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize archive: %w", err)
+	}
+	return result, nil
+}
 
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+// WriteArchive streams the archive of folders into w
+func WriteArchive(w io.Writer, folders []Folder, opts ArchiveOptions) (*ArchiveResult, error) {
+	counter := &hashingWriter{w: w, hash: sha256.New()}
 
-	for _, folder := range folders {
-		if err := addToArchive(tarWriter, folder); err != nil {
-			return fmt.Errorf("failed to add %s to archive: %w", folder, err)
+	var output io.Writer = counter
+	var encryptWriter io.WriteCloser
+	if opts.EncryptionKey != nil {
+		var err error
+		if encryptWriter, err = NewEncryptWriter(counter, opts.EncryptionKey); err != nil {
+			return nil, err
 		}
+		output = encryptWriter
 	}
 
-	return nil
+	compressWriter, err := newCompressWriter(output, opts.Compression, opts.CompressionLevel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start compression: %w", err)
+	}
+	tarWriter := tar.NewWriter(compressWriter)
+
+	entries, err := ScanFolders(folders)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := writeEntries(tarWriter, entries, opts.Previous)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize archive: %w", err)
+	}
+	if err := compressWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize archive: %w", err)
+	}
+	if encryptWriter != nil {
+		if err := encryptWriter.Close(); err != nil {
+			return nil, fmt.Errorf("failed to finalize archive: %w", err)
+		}
+	}
+
+	result.Size = counter.size
+	result.Checksum = hex.EncodeToString(counter.hash.Sum(nil))
+	return result, nil
+}
+
+// hashingWriter counts and hashes everything written through it
+type hashingWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func (h *hashingWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// ScanFolders walks every folder and returns the entries to back up
+func ScanFolders(folders []Folder) ([]Entry, error) {
+	var entries []Entry
+	for _, folder := range folders {
+		folderEntries, err := scanFolder(folder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add %s to archive: %w", folder.Path, err)
+		}
+		entries = append(entries, folderEntries...)
+	}
+	return entries, nil
 }
 
-func addToArchive(tarWriter *tar.Writer, sourcePath string) error {
+func scanFolder(folder Folder) ([]Entry, error) {
 
-	_, err := os.Stat(sourcePath)
+	_, err := os.Stat(folder.Path)
 	if err != nil {
-		return fmt.Errorf("failed to stat %s: %w", sourcePath, err)
+		return nil, fmt.Errorf("failed to stat %s: %w", folder.Path, err)
 	}
 
-	return filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+	filter := newFolderFilter(folder)
+
+	var entries []Entry
+	err = filepath.Walk(folder.Path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		header, err := tar.FileInfoHeader(info, "")
+		rel, err := filepath.Rel(folder.Path, path)
 		if err != nil {
-			return fmt.Errorf("failed to create tar header: %w", err)
+			return err
 		}
+		rel = filepath.ToSlash(rel)
 
-		header.Name = path
+		if rel != "." && filter.excluded(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		if err := tarWriter.WriteHeader(header); err != nil {
-			return fmt.Errorf("failed to write tar header: %w", err)
+		switch {
+		case info.Mode()&os.ModeSocket != 0:
+			log.Printf("Skipping socket %s", path)
+			return nil
+		case info.IsDir():
+			if isCacheDir(path) {
+				log.Printf("Skipping cache directory %s", path)
+				return filepath.SkipDir
+			}
+			if err := filter.loadIgnoreFile(path, rel); err != nil {
+				return fmt.Errorf("failed to read %s in %s: %w", IgnoreFilename, path, err)
+			}
+		case rel != "." && !filter.included(rel, false):
+			return nil
+		}
+
+		entry := Entry{Path: path, Info: info}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if entry.Link, err = os.Readlink(path); err != nil {
+				return fmt.Errorf("failed to read symlink %s: %w", path, err)
+			}
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// writeEntries writes the manifest, the deletions of an incremental
+// backup and then every new or changed entry. Files are hashed before
+// anything is written, because the manifest comes first. Files that change
+// after they were hashed are listed in a trailing changedEntry with the
+// hash of what was archived.
+func writeEntries(tarWriter *tar.Writer, entries []Entry, previous *Index) (*ArchiveResult, error) {
+	result := &ArchiveResult{
+		Index:    NewIndex(),
+		Manifest: &Manifest{Version: manifestVersion, Created: time.Now(), Incremental: previous != nil},
+	}
+
+	if previous != nil {
+		seen := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			seen[entry.Path] = true
+		}
+		for path := range previous.Files {
+			if !seen[path] {
+				result.Manifest.Deleted = append(result.Manifest.Deleted, path)
+			}
+		}
+		sort.Strings(result.Manifest.Deleted)
+		result.Deleted = len(result.Manifest.Deleted)
+	}
+
+	var changed []Entry
+	for _, entry := range entries {
+		state := FileState{
+			Size:    entry.Info.Size(),
+			ModTime: entry.Info.ModTime(),
+			Mode:    entry.Info.Mode(),
+			Link:    entry.Link,
 		}
 
-		if !info.IsDir() {
-			file, err := os.Open(path)
+		if previous != nil {
+			unchanged, err := reuseState(entry, &state, previous)
 			if err != nil {
-				return fmt.Errorf("failed to open file %s: %w", path, err)
+				return nil, err
+			}
+			if unchanged {
+				result.Index.Files[entry.Path] = state
+				continue
+			}
+		}
+
+		if state.Mode.IsRegular() && state.Hash == "" {
+			var err error
+			if state.Hash, err = hashFile(entry.Path, state.Size); err != nil {
+				return nil, err
 			}
+		}
+
+		result.Index.Files[entry.Path] = state
+		result.Manifest.Files = append(result.Manifest.Files, ManifestFile{
+			Path:    entry.Path,
+			Size:    state.Size,
+			Mode:    state.Mode,
+			ModTime: state.ModTime,
+			Link:    state.Link,
+			Hash:    state.Hash,
+		})
+		changed = append(changed, entry)
+	}
 
-			_, copyErr := io.Copy(tarWriter, file)
-			file.Close() // Close immediately after copying, not deferred
+	if err := writeJSONEntry(tarWriter, manifestEntry, result.Manifest); err != nil {
+		return nil, err
+	}
+	if len(result.Manifest.Deleted) > 0 {
+		if err := writeJSONEntry(tarWriter, deletedEntry, result.Manifest.Deleted); err != nil {
+			return nil, err
+		}
+	}
+
+	var modified []ManifestFile
+	for i, entry := range changed {
+		header, err := tar.FileInfoHeader(entry.Info, entry.Link)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tar header: %w", err)
+		}
 
-			if copyErr != nil {
-				return fmt.Errorf("failed to write file content: %w", copyErr)
+		header.Name = entry.Path
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return nil, fmt.Errorf("failed to write tar header: %w", err)
+		}
+
+		if entry.Info.Mode().IsRegular() {
+			hash, err := copyFile(tarWriter, entry)
+			if err != nil {
+				return nil, err
+			}
+			if file := &result.Manifest.Files[i]; hash != file.Hash {
+				// The embedded manifest is already written; the changed
+				// entry and the sidecar record what was archived, and the
+				// next backup picks up the new content
+				log.Printf("Warning: %s changed while it was being archived", entry.Path)
+				file.Hash = hash
+				modified = append(modified, *file)
+				state := result.Index.Files[entry.Path]
+				state.Hash = ""
+				result.Index.Files[entry.Path] = state
 			}
 		}
 
-		return nil
-	})
+		result.Files++
+	}
+
+	if len(modified) > 0 {
+		if err := writeJSONEntry(tarWriter, changedEntry, modified); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// reuseState reports whether an entry is unchanged since the previous
+// backup. Regular files whose size matches but whose modification time
+// moved are hashed, so touching a file does not archive it again.
+func reuseState(entry Entry, state *FileState, previous *Index) (bool, error) {
+	old, ok := previous.Files[entry.Path]
+	if !ok || old.Mode != state.Mode {
+		return false, nil
+	}
+
+	switch {
+	case state.Mode.IsDir():
+		// Directories are always written so that modes and empty directories survive a restore
+		return false, nil
+	case state.Mode&os.ModeSymlink != 0:
+		return old.Link == state.Link, nil
+	case !state.Mode.IsRegular():
+		return false, nil
+	}
+
+	if old.Size != state.Size || old.Hash == "" {
+		return false, nil
+	}
+	if old.ModTime.Equal(state.ModTime) {
+		state.Hash = old.Hash
+		return true, nil
+	}
+
+	hash, err := hashFile(entry.Path, state.Size)
+	if err != nil {
+		return false, err
+	}
+	if hash != old.Hash {
+		return false, nil
+	}
+	state.Hash = hash
+	return true, nil
+}
+
+// copyFile streams exactly the size a file had when it was scanned into
+// the archive, as its tar header promises, padding it with zeros if it
+// shrank since, and returns the SHA-256 of what was written
+func copyFile(w io.Writer, entry Entry) (string, error) {
+	file, err := os.Open(entry.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %w", entry.Path, err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	output := io.MultiWriter(w, hasher)
+	size := entry.Info.Size()
+	n, err := io.CopyN(output, file, size)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to write file content: %w", err)
+	}
+	if n < size {
+		if _, err := io.CopyN(output, zeroReader{}, size-n); err != nil {
+			return "", fmt.Errorf("failed to write file content: %w", err)
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func GenerateBackupFilename(prefix string) string {
-	timestamp := time.Now().Format("20060102-150405")
-	return fmt.Sprintf("%s-%s.tar.gz", prefix, timestamp)
+// zeroReader reads endless zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// hashFile returns the SHA-256 of the first size bytes of a file, padded
+// with zeros if it is shorter, which is what copyFile archives
+func hashFile(path string, size int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	n, err := io.CopyN(hasher, file, size)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+	io.CopyN(hasher, zeroReader{}, size-n)
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func writeJSONEntry(tarWriter *tar.Writer, name string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header: %w", err)
+	}
+	if _, err := io.Copy(tarWriter, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
 }
@@ -0,0 +1,200 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// checksumExtension is the sidecar holding the hex encoded SHA-256 an
+	// archive had when it was cached
+	checksumExtension = ".sha256"
+	// partialExtension marks archives still being written into the cache
+	partialExtension = ".partial"
+)
+
+// ErrNotCached is returned, wrapped, when the cache holds no usable copy
+// of an archive
+var ErrNotCached = errors.New("archive not cached")
+
+// Cache keeps copies of the latest archives on local disk, so restoring a
+// recent backup does not need a download. It has its own retention: the
+// newest maxArchives archives are kept, as long as together they take no
+// more than maxSize bytes. Zero is no limit.
+type Cache struct {
+	dir         string
+	maxArchives int
+	maxSize     int64
+}
+
+func NewCache(dir string, maxArchives int, maxSize int64) *Cache {
+	return &Cache{dir: dir, maxArchives: maxArchives, maxSize: maxSize}
+}
+
+// Create returns a file in the cache directory to write the archive called
+// name into while it is uploaded. Add it once it is complete, or remove it.
+func (c *Cache) Create(name string) (*os.File, error) {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return os.Create(filepath.Join(c.dir, name+partialExtension))
+}
+
+// Add moves the archive at path into the cache as name, records its
+// checksum and deletes the archives beyond the cache's limits. It returns
+// whether the archive was kept, which it is not when it alone is larger
+// than the cache.
+func (c *Cache) Add(name, path, checksum string) (bool, error) {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return false, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	archivePath := filepath.Join(c.dir, name)
+	if err := moveFile(path, archivePath); err != nil {
+		return false, fmt.Errorf("failed to add %s to the cache: %w", name, err)
+	}
+	if err := os.WriteFile(archivePath+checksumExtension, []byte(checksum+"\n"), 0600); err != nil {
+		os.Remove(archivePath)
+		return false, fmt.Errorf("failed to record checksum of %s: %w", name, err)
+	}
+
+	if err := c.prune(); err != nil {
+		return false, err
+	}
+	_, err := os.Stat(archivePath)
+	return err == nil, nil
+}
+
+// moveFile renames from to to, copying it when they are on different
+// file systems
+func moveFile(from, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(to+partialExtension, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(target, source); err != nil {
+		target.Close()
+		os.Remove(target.Name())
+		return err
+	}
+	if err := target.Close(); err != nil {
+		os.Remove(target.Name())
+		return err
+	}
+	if err := os.Rename(target.Name(), to); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
+
+// Open returns the cached copy of the archive called name if its contents
+// still have the given hex encoded SHA-256 and size. An empty checksum is
+// the one recorded when the archive was cached, and a negative size is
+// not checked. The error wraps ErrNotCached when there is no copy, or it
+// no longer matches.
+func (c *Cache) Open(name, checksum string, size int64) (*os.File, error) {
+	archivePath := filepath.Join(c.dir, name)
+	file, err := os.Open(archivePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotCached, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	recorded, err := os.ReadFile(archivePath + checksumExtension)
+	if err != nil && checksum == "" {
+		file.Close()
+		return nil, fmt.Errorf("%w: no checksum recorded for %s", ErrNotCached, name)
+	}
+	if checksum == "" {
+		checksum = strings.TrimSpace(string(recorded))
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if size >= 0 && info.Size() != size {
+		file.Close()
+		return nil, fmt.Errorf("%w: cached %s is %d bytes, the stored one %d", ErrNotCached, name, info.Size(), size)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read cached %s: %w", name, err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != checksum {
+		file.Close()
+		return nil, fmt.Errorf("%w: cached %s has sha256 %s, expected %s", ErrNotCached, name, actual, checksum)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// prune deletes the oldest archives until the cache is within its limits
+func (c *Cache) prune() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	var archives []fs.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), checksumExtension) || strings.HasSuffix(entry.Name(), partialExtension) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		archives = append(archives, info)
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].ModTime().After(archives[j].ModTime())
+	})
+
+	// Once an archive does not fit, every older one goes too, so the cache
+	// holds the newest archives without gaps. An archive larger than the
+	// whole cache is only dropped itself.
+	var kept int
+	var total int64
+	full := false
+	for _, archive := range archives {
+		tooLarge := c.maxSize > 0 && archive.Size() > c.maxSize
+		full = full || (c.maxArchives > 0 && kept >= c.maxArchives) || (!tooLarge && c.maxSize > 0 && total+archive.Size() > c.maxSize)
+		if !full && !tooLarge {
+			kept++
+			total += archive.Size()
+			continue
+		}
+		archivePath := filepath.Join(c.dir, archive.Name())
+		if err := os.Remove(archivePath); err != nil {
+			return fmt.Errorf("failed to delete cached %s: %w", archive.Name(), err)
+		}
+		os.Remove(archivePath + checksumExtension)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// addToCache writes an archive of size bytes and adds it to cache, dated
+// age ago
+func addToCache(t *testing.T, cache *Cache, name string, size int, age time.Duration) string {
+	t.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(len(name) + i)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(-age)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	if _, err := cache.Add(name, path, checksum); err != nil {
+		t.Fatal(err)
+	}
+	return checksum
+}
+
+func TestCacheOpen(t *testing.T) {
+	cache := NewCache(t.TempDir(), 3, 0)
+	checksum := addToCache(t, cache, "job-20240101-000000.tar.gz", 100, 0)
+
+	file, err := cache.Open("job-20240101-000000.tar.gz", checksum, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(file)
+	file.Close()
+	if len(data) != 100 {
+		t.Errorf("Expected the whole archive from the start, got %d bytes", len(data))
+	}
+
+	// Without the stored checksum the recorded one is used
+	if file, err := cache.Open("job-20240101-000000.tar.gz", "", -1); err != nil {
+		t.Errorf("Expected the recorded checksum to match: %v", err)
+	} else {
+		file.Close()
+	}
+
+	for name, open := range map[string]func() (*os.File, error){
+		"missing":        func() (*os.File, error) { return cache.Open("job-20240102-000000.tar.gz", "", -1) },
+		"other checksum": func() (*os.File, error) { return cache.Open("job-20240101-000000.tar.gz", "abc", -1) },
+		"other size":     func() (*os.File, error) { return cache.Open("job-20240101-000000.tar.gz", checksum, 99) },
+	} {
+		if _, err := open(); !errors.Is(err, ErrNotCached) {
+			t.Errorf("%s: expected ErrNotCached, got %v", name, err)
+		}
+	}
+
+	// A copy damaged on disk no longer matches
+	if err := os.WriteFile(filepath.Join(cache.dir, "job-20240101-000000.tar.gz"), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Open("job-20240101-000000.tar.gz", "", 100); !errors.Is(err, ErrNotCached) {
+		t.Errorf("Expected a damaged copy to be rejected, got %v", err)
+	}
+}
+
+func TestCacheRetention(t *testing.T) {
+	cached := func(cache *Cache) []string {
+		var names []string
+		for _, name := range []string{"a.tar.gz", "b.tar.gz", "c.tar.gz", "d.tar.gz"} {
+			if _, err := os.Stat(filepath.Join(cache.dir, name)); err == nil {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+
+	byCount := NewCache(t.TempDir(), 2, 0)
+	addToCache(t, byCount, "a.tar.gz", 10, 3*time.Hour)
+	addToCache(t, byCount, "b.tar.gz", 10, 2*time.Hour)
+	addToCache(t, byCount, "c.tar.gz", 10, time.Hour)
+	if names := cached(byCount); len(names) != 2 || names[0] != "b.tar.gz" {
+		t.Errorf("Expected the 2 newest archives, got %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(byCount.dir, "a.tar.gz"+checksumExtension)); err == nil {
+		t.Error("Expected the checksum of a deleted archive to be deleted")
+	}
+
+	bySize := NewCache(t.TempDir(), 0, 25)
+	addToCache(t, bySize, "a.tar.gz", 6, 4*time.Hour)
+	addToCache(t, bySize, "b.tar.gz", 10, 3*time.Hour)
+	addToCache(t, bySize, "c.tar.gz", 10, 2*time.Hour)
+	if names := cached(bySize); len(names) != 2 || names[0] != "b.tar.gz" {
+		t.Errorf("Expected the newest archives within 25 bytes without gaps, got %v", names)
+	}
+
+	// An archive larger than the whole cache is not kept, and does not
+	// push out the others
+	if kept, err := bySize.Add("d.tar.gz", writeTemp(t, 30), "checksum"); err != nil || kept {
+		t.Errorf("Expected the archive not to be kept, got %v, %v", kept, err)
+	}
+	if names := cached(bySize); len(names) != 2 {
+		t.Errorf("Expected the cached archives to stay, got %v", names)
+	}
+}
+
+func writeTemp(t *testing.T, size int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// FilterBackups returns the archives that belong to prefix, oldest first
+func FilterBackups(names []string, prefix string) []string {
+	type entry struct {
+		name string
+		time time.Time
+	}
+
+	var entries []entry
+	for _, name := range names {
+		if parsed, ok := ParseBackupName(name); ok && parsed.Prefix == prefix {
+			entries = append(entries, entry{name: name, time: parsed.Time})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+
+	backups := make([]string, len(entries))
+	for i, e := range entries {
+		backups[i] = e.name
+	}
+	return backups
+}
+
+// RestoreChain returns the archives that must be extracted, in order, to
+// restore target: the closest full backup at or before it followed by every
+// incremental backup up to and including target. names must be sorted
+// oldest first, as returned by FilterBackups.
+func RestoreChain(names []string, target string) ([]string, error) {
+	targetIndex := -1
+	for i, name := range names {
+		if name == target {
+			targetIndex = i
+			break
+		}
+	}
+	if targetIndex < 0 {
+		return nil, fmt.Errorf("backup %s not found", target)
+	}
+
+	for i := targetIndex; i >= 0; i-- {
+		parsed, _ := ParseBackupName(names[i])
+		if !parsed.Incremental {
+			return names[i : targetIndex+1], nil
+		}
+	}
+	return nil, fmt.Errorf("no full backup found before %s", target)
+}
+
+// ExpiredBackups selects the archives to delete so that only the newest
+// retentionLimit backups remain. Full backups that a kept incremental
+// backup depends on are never selected. names must be sorted oldest first.
+func ExpiredBackups(names []string, retentionLimit int) []string {
+	if retentionLimit <= 0 || len(names) <= retentionLimit {
+		return nil
+	}
+
+	keepFrom := len(names) - retentionLimit
+	for keepFrom > 0 {
+		parsed, _ := ParseBackupName(names[keepFrom])
+		if !parsed.Incremental {
+			break
+		}
+		keepFrom--
+	}
+
+	return names[:keepFrom]
+}
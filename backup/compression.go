@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is the format the tar stream of an archive is compressed with
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+	CompressionXz   Compression = "xz"
+	CompressionNone Compression = "none"
+)
+
+// compressions lists every format with its archive extension and the
+// range of levels it accepts. Level 0 always selects the default.
+var compressions = []struct {
+	compression Compression
+	extension   string
+	minLevel    int
+	maxLevel    int
+}{
+	{CompressionGzip, ".tar.gz", gzip.BestSpeed, gzip.BestCompression},
+	{CompressionZstd, ".tar.zst", 1, 22},
+	{CompressionXz, ".tar.xz", 1, 9},
+	{CompressionNone, ".tar", 0, 0},
+}
+
+// Magic numbers used to recognise compressed streams when restoring
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// xzDictCaps are the dictionary sizes of the xz presets 1-9
+var xzDictCaps = []int{1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+func ParseCompression(name string, level int) (Compression, error) {
+	for _, c := range compressions {
+		if string(c.compression) != name {
+			continue
+		}
+		if level != 0 && (level < c.minLevel || level > c.maxLevel) {
+			return "", fmt.Errorf("%s compression level must be between %d and %d", name, c.minLevel, c.maxLevel)
+		}
+		return c.compression, nil
+	}
+	return "", fmt.Errorf("unknown compression %q", name)
+}
+
+// Extension returns the archive extension, such as ".tar.zst". The zero
+// value is gzip, which archives used before the format was configurable.
+func (c Compression) Extension() string {
+	for _, known := range compressions {
+		if known.compression == c {
+			return known.extension
+		}
+	}
+	return ".tar.gz"
+}
+
+// newCompressWriter compresses everything written to it into w. Closing it
+// flushes the stream but does not close w.
+func newCompressWriter(w io.Writer, compression Compression, level int) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionZstd:
+		zstdLevel := zstd.SpeedDefault
+		if level != 0 {
+			zstdLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel))
+	case CompressionXz:
+		config := xz.WriterConfig{}
+		if level != 0 {
+			config.DictCap = xzDictCaps[level-1]
+		}
+		return config.NewWriter(w)
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	}
+}
+
+// newDecompressReader returns the tar stream inside r. The format is
+// recognised by its magic number, so archives of any compression, and of
+// none, can be read regardless of the current configuration.
+func newDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read archive header: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		return gzipReader, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		zstdReader, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zstd stream: %w", err)
+		}
+		return zstdReader.IOReadCloser(), nil
+	case bytes.HasPrefix(header, xzMagic):
+		xzReader, err := xz.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open xz stream: %w", err)
+		}
+		return io.NopCloser(xzReader), nil
+	default:
+		return io.NopCloser(buffered), nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCompressionRoundTrip verifies that every format restores without
+// being told which one was used
+func TestCompressionRoundTrip(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "data")
+	writeTestFile(t, filepath.Join(source, "a.txt"), "alpha")
+
+	for _, c := range compressions {
+		t.Run(string(c.compression), func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), "test"+c.extension)
+			opts := ArchiveOptions{Compression: c.compression, CompressionLevel: c.maxLevel}
+			if _, err := CreateArchive([]Folder{{Path: source}}, archivePath, opts); err != nil {
+				t.Fatalf("CreateArchive failed: %v", err)
+			}
+
+			target := t.TempDir()
+			extractTestArchive(t, archivePath, RestoreOptions{TargetDir: target})
+			if got := readTestFile(t, filepath.Join(target, source, "a.txt")); got != "alpha" {
+				t.Errorf("Expected a.txt to contain alpha, got %q", got)
+			}
+		})
+	}
+}
+
+func TestCompressionFormats(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "data")
+	writeTestFile(t, filepath.Join(source, "a.txt"), "alpha")
+
+	magics := map[Compression][]byte{
+		CompressionGzip: gzipMagic,
+		CompressionZstd: zstdMagic,
+		CompressionXz:   xzMagic,
+	}
+	for compression, magic := range magics {
+		var buf bytes.Buffer
+		if _, err := WriteArchive(&buf, []Folder{{Path: source}}, ArchiveOptions{Compression: compression}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), magic) {
+			t.Errorf("%s archive does not start with its magic number", compression)
+		}
+	}
+
+	if _, err := ParseCompression("zstd", 23); err == nil {
+		t.Error("Expected zstd level 23 to be rejected")
+	}
+	if _, err := ParseCompression("brotli", 0); err == nil {
+		t.Error("Expected an unknown compression to be rejected")
+	}
+}
+
+func TestBackupNameExtensions(t *testing.T) {
+	timestamp := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+	tests := map[string]BackupName{
+		"db-20240102-030405.tar.gz":          {Prefix: "db", Time: timestamp, Compression: CompressionGzip},
+		"db-20240102-030405.incr.tar.zst":    {Prefix: "db", Time: timestamp, Compression: CompressionZstd, Incremental: true},
+		"db-20240102-030405.tar.xz.enc":      {Prefix: "db", Time: timestamp, Compression: CompressionXz, Encrypted: true},
+		"my-db-20240102-030405.incr.tar.enc": {Prefix: "my-db", Time: timestamp, Compression: CompressionNone, Incremental: true, Encrypted: true},
+	}
+	for filename, want := range tests {
+		got, ok := ParseBackupName(filename)
+		if !ok || got != want {
+			t.Errorf("ParseBackupName(%q) = %+v, %v; want %+v", filename, got, ok, want)
+		}
+		if got.Filename() != filename {
+			t.Errorf("Filename() = %q, want %q", got.Filename(), filename)
+		}
+	}
+
+	for _, filename := range []string{"db-index.json.gz", "db-20240102-030405.zip", "db-20240102-030405.tar.bz2"} {
+		if _, ok := ParseBackupName(filename); ok {
+			t.Errorf("ParseBackupName(%q) should not match", filename)
+		}
+	}
+}
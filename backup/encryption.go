@@ -0,0 +1,310 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted streams start with a header followed by AES-256-GCM sealed
+// segments of segmentSize plaintext bytes. Every stream uses its own key
+// derived from the master key and a random salt. Segment nonces hold a
+// counter and a final-segment flag, so reordered, truncated or extended
+// streams fail authentication instead of decrypting partially.
+//
+//	magic (8) | key ID (8) | salt (32) | segment... | final segment
+const (
+	encryptionMagic = "CFBKENC1"
+	keyIDSize       = 8
+	saltSize        = 32
+	headerSize      = len(encryptionMagic) + keyIDSize + saltSize
+	segmentSize     = 64 << 10
+	tagSize         = 16
+)
+
+var ErrNoKey = errors.New("backup is encrypted but no encryption key is configured")
+
+// ErrNotEncrypted is returned for a backup that should be encrypted but has
+// no encryption header, such as a plaintext archive swapped into the bucket
+var ErrNotEncrypted = errors.New("backup should be encrypted but is not")
+
+// Key is a 256-bit master key used to encrypt backups
+type Key struct {
+	secret [32]byte
+	id     [keyIDSize]byte
+}
+
+// ParseKey accepts a key as 32 raw bytes, 64 hex characters or base64
+func ParseKey(data []byte) (*Key, error) {
+	var secret []byte
+	text := strings.TrimSpace(string(data))
+
+	switch {
+	case len(data) == 32:
+		secret = data
+	case len(text) == 64:
+		decoded, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex encryption key: %w", err)
+		}
+		secret = decoded
+	default:
+		decoded, err := base64.StdEncoding.DecodeString(text)
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("encryption key must be 32 bytes, given raw, as hex or as base64")
+		}
+		secret = decoded
+	}
+
+	key := &Key{}
+	copy(key.secret[:], secret)
+	idSum := sha256.Sum256(append([]byte("cloudflare-backuper key id\x00"), key.secret[:]...))
+	copy(key.id[:], idSum[:])
+	return key, nil
+}
+
+// LoadKey reads a key given inline or from a key file. Exactly one of them must be set.
+func LoadKey(inline, keyFile string) (*Key, error) {
+	switch {
+	case inline != "" && keyFile != "":
+		return nil, fmt.Errorf("only one of an inline key and a key file may be set")
+	case inline != "":
+		return ParseKey([]byte(inline))
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+		}
+		return ParseKey(data)
+	default:
+		return nil, fmt.Errorf("no encryption key configured")
+	}
+}
+
+// ID returns a short fingerprint that identifies the key without revealing it
+func (k *Key) ID() string {
+	return hex.EncodeToString(k.id[:])
+}
+
+// Derive returns a 32-byte subkey for the given purpose
+func (k *Key) Derive(purpose string) []byte {
+	derived, err := hkdf.Key(sha256.New, k.secret[:], nil, purpose, 32)
+	if err != nil {
+		panic(err) // only fails for oversized output lengths
+	}
+	return derived
+}
+
+func (k *Key) streamCipher(salt []byte) (cipher.AEAD, error) {
+	streamKey, err := hkdf.Key(sha256.New, k.secret[:], salt, "cloudflare-backuper stream", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(streamKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+// NewEncryptWriter returns a writer that encrypts everything written to it
+// into w. Close must be called to write the final segment.
+func NewEncryptWriter(w io.Writer, key *Key) (io.WriteCloser, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	aead, err := key.streamCipher(salt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize cipher: %w", err)
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, key.id[:]...)
+	header = append(header, salt...)
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write encryption header: %w", err)
+	}
+
+	return &encryptWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, segmentSize+tagSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encryption stream")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data arrives, because the
+		// last segment has to be sealed with the final flag
+		if len(e.buf) == segmentSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := min(segmentSize-len(e.buf), len(p))
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	sealed := e.aead.Seal(e.buf[:0], segmentNonce(e.counter, final), e.buf, nil)
+	if _, err := e.w.Write(sealed); err != nil {
+		return fmt.Errorf("failed to write encrypted segment: %w", err)
+	}
+	e.counter++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	segment []byte
+	plain   []byte
+	counter uint64
+	done    bool
+}
+
+// OpenDecrypted returns a reader over the plaintext of r. Streams without
+// the encryption header are passed through unchanged, so callers can read
+// encrypted and unencrypted backups alike. key may be nil when no key is
+// configured, in which case encrypted streams fail with ErrNoKey.
+func OpenDecrypted(r io.Reader, key *Key) (io.Reader, error) {
+	return openDecrypted(r, key, false)
+}
+
+// OpenEncrypted is OpenDecrypted for streams known to be encrypted, such
+// as archives whose name or metadata says so. A stream without the
+// encryption header fails with ErrNotEncrypted instead of being read as
+// plaintext.
+func OpenEncrypted(r io.Reader, key *Key) (io.Reader, error) {
+	return openDecrypted(r, key, true)
+}
+
+func openDecrypted(r io.Reader, key *Key, required bool) (io.Reader, error) {
+	buffered := bufio.NewReaderSize(r, segmentSize+tagSize)
+	magic, _ := buffered.Peek(len(encryptionMagic))
+	if string(magic) != encryptionMagic {
+		if required {
+			return nil, ErrNotEncrypted
+		}
+		return buffered, nil
+	}
+	if key == nil {
+		return nil, ErrNoKey
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(buffered, header); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	keyID := header[len(encryptionMagic) : len(encryptionMagic)+keyIDSize]
+	if !bytes.Equal(keyID, key.id[:]) {
+		return nil, fmt.Errorf("backup was encrypted with key %s but the configured key is %s", hex.EncodeToString(keyID), key.ID())
+	}
+
+	aead, err := key.streamCipher(header[len(encryptionMagic)+keyIDSize:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize cipher: %w", err)
+	}
+
+	return &decryptReader{
+		r:       buffered,
+		aead:    aead,
+		segment: make([]byte, segmentSize+tagSize),
+	}, nil
+}
+
+// IsEncrypted reports whether data starts with the encryption header
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptionMagic))
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.segment)
+	final := false
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		final = true
+	case err != nil:
+		return err
+	default:
+		if _, peekErr := d.r.Peek(1); peekErr == io.EOF {
+			final = true
+		}
+	}
+	if n < tagSize {
+		return fmt.Errorf("encrypted stream is truncated")
+	}
+
+	plain, err := d.aead.Open(d.segment[:0], segmentNonce(d.counter, final), d.segment[:n], nil)
+	if err != nil {
+		return fmt.Errorf("encrypted stream is corrupted or truncated: %w", err)
+	}
+	d.counter++
+	d.plain = plain
+	d.done = final
+	return nil
+}
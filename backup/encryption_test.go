@@ -0,0 +1,199 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T) *Key {
+	t.Helper()
+	key, err := ParseKey([]byte(strings.Repeat("ab", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encryptBytes(t *testing.T, key *Key, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer, err := NewEncryptWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptBytes(key *Key, sealed []byte) ([]byte, error) {
+	reader, err := OpenDecrypted(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// TestEncryptionRoundTrip verifies streams of various sizes decrypt to the original
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 7} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		got, err := decryptBytes(key, encryptBytes(t, key, plain))
+		if err != nil {
+			t.Fatalf("size %d: decrypt failed: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+// TestEncryptionDetectsTampering verifies that modified, truncated or
+// unkeyed streams are rejected
+func TestEncryptionDetectsTampering(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 2*segmentSize+10)
+	sealed := encryptBytes(t, key, plain)
+
+	flipped := bytes.Clone(sealed)
+	flipped[headerSize+10] ^= 1
+	if _, err := decryptBytes(key, flipped); err == nil {
+		t.Error("Expected a modified stream to fail")
+	}
+
+	// Dropping the final segment leaves a stream that ends on a full, non-final segment
+	truncated := sealed[:headerSize+2*(segmentSize+tagSize)]
+	if _, err := decryptBytes(key, truncated); err == nil {
+		t.Error("Expected a truncated stream to fail")
+	}
+
+	if _, err := decryptBytes(nil, sealed); !errors.Is(err, ErrNoKey) {
+		t.Errorf("Expected ErrNoKey without a key, got %v", err)
+	}
+
+	otherKey, _ := ParseKey(bytes.Repeat([]byte{7}, 32))
+	if _, err := decryptBytes(otherKey, sealed); err == nil {
+		t.Error("Expected decryption with the wrong key to fail")
+	}
+}
+
+// TestEncryptedArchiveRestore verifies that encrypted archives are never
+// written in plaintext and restore transparently
+func TestEncryptedArchiveRestore(t *testing.T) {
+	key := testKey(t)
+	source := filepath.Join(t.TempDir(), "data")
+	writeTestFile(t, filepath.Join(source, "secret.txt"), "top secret")
+
+	archivePath := filepath.Join(t.TempDir(), "test.tar.gz.enc")
+	if _, err := CreateArchive([]Folder{{Path: source}}, archivePath, ArchiveOptions{EncryptionKey: key}); err != nil {
+		t.Fatalf("CreateArchive failed: %v", err)
+	}
+	data, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(data) {
+		t.Fatal("Expected the archive to be encrypted")
+	}
+
+	target := t.TempDir()
+	extractTestArchive(t, archivePath, RestoreOptions{
+		TargetDir:     target,
+		Mappings:      []PathMapping{{From: cleanEntryName(source), To: "/"}},
+		DecryptionKey: key,
+	})
+	if got := readTestFile(t, filepath.Join(target, "secret.txt")); got != "top secret" {
+		t.Errorf("Expected decrypted content, got %q", got)
+	}
+}
+
+// TestEncryptedBackupRefusesPlaintext verifies that a plaintext archive
+// stored where an encrypted one is expected is not restored
+func TestEncryptedBackupRefusesPlaintext(t *testing.T) {
+	key := testKey(t)
+	source := filepath.Join(t.TempDir(), "data")
+	writeTestFile(t, filepath.Join(source, "planted.txt"), "planted")
+
+	var plain bytes.Buffer
+	if _, err := WriteArchive(&plain, []Folder{{Path: source}}, ArchiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	name := BackupName{Prefix: "backup", Encrypted: true}.Filename()
+	for _, tc := range []struct {
+		name     string
+		metadata map[string]string
+	}{
+		{name, nil},
+		{"backup-20240101-000000.tar.gz", map[string]string{"encryption": EncryptionScheme}},
+	} {
+		if !ExpectEncrypted(tc.name, tc.metadata) {
+			t.Fatalf("%s: expected the backup to be expected encrypted", tc.name)
+		}
+		restorer, err := NewRestorer(RestoreOptions{TargetDir: t.TempDir(), DecryptionKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := restorer.Extract(bytes.NewReader(plain.Bytes()), true); !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("%s: expected ErrNotEncrypted, got %v", tc.name, err)
+		}
+		if _, err := VerifyArchive(bytes.NewReader(plain.Bytes()), VerifyOptions{DecryptionKey: key, Encrypted: true}); !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("%s: expected verify to fail with ErrNotEncrypted, got %v", tc.name, err)
+		}
+	}
+
+	if ExpectEncrypted("backup-20240101-000000.tar.gz", map[string]string{"encryption": "none"}) {
+		t.Error("Expected an unencrypted backup not to require encryption")
+	}
+	if _, err := OpenDecrypted(bytes.NewReader(plain.Bytes()), key); err != nil {
+		t.Errorf("Expected unencrypted backups to still be readable, got %v", err)
+	}
+}
+
+// TestRequireEncryptionRefusesPlaintext verifies that a plaintext archive
+// under a normal name and without metadata is not restored when encryption
+// is required
+func TestRequireEncryptionRefusesPlaintext(t *testing.T) {
+	key := testKey(t)
+	source := filepath.Join(t.TempDir(), "data")
+	writeTestFile(t, filepath.Join(source, "planted.txt"), "planted")
+
+	var plain bytes.Buffer
+	if _, err := WriteArchive(&plain, []Folder{{Path: source}}, ArchiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	name := BackupName{Prefix: "backup"}.Filename()
+	if ExpectEncrypted(name, nil) {
+		t.Fatalf("%s: expected the name alone not to require encryption", name)
+	}
+
+	target := t.TempDir()
+	restorer, err := NewRestorer(RestoreOptions{TargetDir: target, DecryptionKey: key, RequireEncryption: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restorer.Extract(bytes.NewReader(plain.Bytes()), ExpectEncrypted(name, nil)); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Expected ErrNotEncrypted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, source, "planted.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be restored, got %v", err)
+	}
+
+	// Allowing unencrypted archives restores it, as for legacy backups
+	if _, err := ExtractArchive(bytes.NewReader(plain.Bytes()), RestoreOptions{TargetDir: target, DecryptionKey: key}); err != nil {
+		t.Errorf("Expected the archive to be restored without RequireEncryption, got %v", err)
+	}
+}
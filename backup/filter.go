@@ -0,0 +1,225 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// IgnoreFilename lists patterns to exclude, relative to its directory, using gitignore syntax
+	IgnoreFilename = ".backupignore"
+
+	cacheDirTagFilename  = "CACHEDIR.TAG"
+	cacheDirTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// Folder is a directory to back up with its own exclude and include patterns
+type Folder struct {
+	Path string
+	// Exclude patterns skip matching paths. Matching directories are never walked.
+	Exclude []string
+	// Include patterns, when given, restrict the backup to files that match
+	// one of them or lie in a directory that does
+	Include []string
+}
+
+// FolderPaths returns the paths of the folders
+func FolderPaths(folders []Folder) []string {
+	paths := make([]string, len(folders))
+	for i, folder := range folders {
+		paths[i] = folder.Path
+	}
+	return paths
+}
+
+// pattern is a compiled glob with gitignore semantics: * and ? stay within
+// a path segment, ** matches any number of segments, a trailing slash only
+// matches directories, a leading ! negates, and a pattern without a slash
+// matches the base name at any depth.
+type pattern struct {
+	segments []string
+	anchored bool
+	dirOnly  bool
+	negate   bool
+}
+
+func parsePattern(line string) (pattern, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern{}, false
+	}
+
+	var p pattern
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return pattern{}, false
+	}
+
+	p.anchored = strings.Contains(line, "/")
+	p.segments = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	return p, true
+}
+
+func parsePatterns(lines []string) []pattern {
+	var patterns []pattern
+	for _, line := range lines {
+		if p, ok := parsePattern(line); ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// match reports whether a slash separated path relative to the pattern's base matches
+func (p pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if !p.anchored {
+		return matchSegments(p.segments, []string{path.Base(rel)})
+	}
+	return matchSegments(p.segments, strings.Split(rel, "/"))
+}
+
+func matchSegments(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			// Collapse repeated ** and try every possible split
+			for len(patterns) > 0 && patterns[0] == "**" {
+				patterns = patterns[1:]
+			}
+			if len(patterns) == 0 {
+				return true
+			}
+			for i := range names {
+				if matchSegments(patterns, names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(patterns[0], names[0]); !matched {
+			return false
+		}
+		patterns = patterns[1:]
+		names = names[1:]
+	}
+	return len(names) == 0
+}
+
+// matchesAny reports whether rel matches the patterns, with later patterns
+// overriding earlier ones as in a gitignore file
+func matchesAny(patterns []pattern, rel string, isDir bool) bool {
+	matched := false
+	for _, p := range patterns {
+		if p.match(rel, isDir) {
+			matched = !p.negate
+		}
+	}
+	return matched
+}
+
+// matchesOrWithin reports whether rel or one of its parent directories matches the patterns
+func matchesOrWithin(patterns []pattern, rel string, isDir bool) bool {
+	for ; rel != "." && rel != "" && rel != "/"; rel, isDir = path.Dir(rel), true {
+		if matchesAny(patterns, rel, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// folderFilter decides which paths below a folder are backed up
+type folderFilter struct {
+	exclude []pattern
+	include []pattern
+	// ignores holds the rules of every .backupignore file seen so far, keyed
+	// by the directory it was found in, relative to the folder
+	ignores map[string][]pattern
+}
+
+func newFolderFilter(folder Folder) *folderFilter {
+	return &folderFilter{
+		exclude: parsePatterns(folder.Exclude),
+		include: parsePatterns(folder.Include),
+		ignores: make(map[string][]pattern),
+	}
+}
+
+func (f *folderFilter) excluded(rel string, isDir bool) bool {
+	if matchesAny(f.exclude, rel, isDir) {
+		return true
+	}
+
+	// Rules in deeper .backupignore files override those closer to the root
+	ignored := false
+	dirs := strings.Split(rel, "/")
+	for depth := 0; depth < len(dirs); depth++ {
+		base := "."
+		if depth > 0 {
+			base = strings.Join(dirs[:depth], "/")
+		}
+		sub := strings.Join(dirs[depth:], "/")
+		for _, p := range f.ignores[base] {
+			if p.match(sub, isDir) {
+				ignored = !p.negate
+			}
+		}
+	}
+	return ignored
+}
+
+func (f *folderFilter) included(rel string, isDir bool) bool {
+	return len(f.include) == 0 || matchesOrWithin(f.include, rel, isDir)
+}
+
+func (f *folderFilter) loadIgnoreFile(dir, rel string) error {
+	data, err := os.ReadFile(filepath.Join(dir, IgnoreFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	f.ignores[rel] = parsePatterns(lines)
+	return nil
+}
+
+// isCacheDir reports whether dir is marked as a cache by a CACHEDIR.TAG file
+// (https://bford.info/cachedir/)
+func isCacheDir(dir string) bool {
+	file, err := os.Open(filepath.Join(dir, cacheDirTagFilename))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	signature := make([]byte, len(cacheDirTagSignature))
+	if _, err := io.ReadFull(file, signature); err != nil {
+		return false
+	}
+	return string(signature) == cacheDirTagSignature
+}
@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// TestPatternMatch verifies glob matching with gitignore semantics
+func TestPatternMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"*.log", "app.log", false, true},
+		{"*.log", "deep/nested/app.log", false, true},
+		{"*.log", "app.log.1", false, false},
+		{"node_modules/", "web/node_modules", true, true},
+		{"node_modules/", "web/node_modules", false, false},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"src/*.go", "src/main.go", false, true},
+		{"src/*.go", "src/pkg/main.go", false, false},
+		{"src/**/*.go", "src/main.go", false, true},
+		{"src/**/*.go", "src/pkg/deep/main.go", false, true},
+		{"**/cache", "a/b/cache", true, true},
+		{"logs/**", "logs/2024/app.log", false, true},
+	}
+
+	for _, c := range cases {
+		p, ok := parsePattern(c.pattern)
+		if !ok {
+			t.Fatalf("parsePattern(%q) failed", c.pattern)
+		}
+		if got := p.match(c.path, c.isDir); got != c.want {
+			t.Errorf("%q matching %q (dir=%v) = %v, want %v", c.pattern, c.path, c.isDir, got, c.want)
+		}
+	}
+}
+
+// TestScanFolderFilters verifies exclude and include patterns, .backupignore
+// files and CACHEDIR.TAG markers
+func TestScanFolderFilters(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "keep.txt"), "keep")
+	writeTestFile(t, filepath.Join(root, "debug.log"), "log")
+	writeTestFile(t, filepath.Join(root, "web", "node_modules", "lib.js"), "lib")
+	writeTestFile(t, filepath.Join(root, "web", "app.js"), "app")
+	writeTestFile(t, filepath.Join(root, "web", IgnoreFilename), "*.tmp\n!important.tmp\n")
+	writeTestFile(t, filepath.Join(root, "web", "scratch.tmp"), "tmp")
+	writeTestFile(t, filepath.Join(root, "web", "important.tmp"), "tmp")
+	writeTestFile(t, filepath.Join(root, "cache", cacheDirTagFilename), cacheDirTagSignature+"\n")
+	writeTestFile(t, filepath.Join(root, "cache", "blob"), "blob")
+
+	scan := func(folder Folder) []string {
+		entries, err := scanFolder(folder)
+		if err != nil {
+			t.Fatalf("scanFolder failed: %v", err)
+		}
+		var paths []string
+		for _, entry := range entries {
+			rel, _ := filepath.Rel(root, entry.Path)
+			if !entry.Info.IsDir() {
+				paths = append(paths, filepath.ToSlash(rel))
+			}
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	got := scan(Folder{Path: root, Exclude: []string{"*.log", "node_modules/"}})
+	want := []string{"keep.txt", "web/" + IgnoreFilename, "web/app.js", "web/important.tmp"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Unexpected files with excludes:\n got %v\nwant %v", got, want)
+	}
+
+	got = scan(Folder{Path: root, Include: []string{"web/**/*.js"}})
+	want = []string{"web/app.js", "web/node_modules/lib.js"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Unexpected files with includes:\n got %v\nwant %v", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const indexVersion = 1
+
+// Index records the state of every archived path after a backup run. The
+// next incremental run compares against it to find new, changed and
+// deleted files.
+type Index struct {
+	Version      int                  `json:"version"`
+	LastBackup   string               `json:"last_backup"`
+	Incrementals int                  `json:"incrementals"`
+	Files        map[string]FileState `json:"files"`
+}
+
+type FileState struct {
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	Link    string      `json:"link,omitempty"`
+	Hash    string      `json:"sha256,omitempty"`
+}
+
+func NewIndex() *Index {
+	return &Index{
+		Version: indexVersion,
+		Files:   make(map[string]FileState),
+	}
+}
+
+// IndexFilename returns the object name the index is stored under for a name prefix
+func IndexFilename(prefix string) string {
+	return prefix + "-index.json.gz"
+}
+
+// ReadIndex parses an index, decrypting it with key if it is encrypted
+func ReadIndex(r io.Reader, key *Key) (*Index, error) {
+	r, err := OpenDecrypted(r, key)
+	if err != nil {
+		return nil, err
+	}
+
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer gzipReader.Close()
+
+	index := NewIndex()
+	if err := json.NewDecoder(gzipReader).Decode(index); err != nil {
+		return nil, fmt.Errorf("failed to parse index: %w", err)
+	}
+	if index.Version != indexVersion {
+		return nil, fmt.Errorf("unsupported index version %d", index.Version)
+	}
+	return index, nil
+}
+
+// Write serialises the index, encrypting it with key unless key is nil
+func (idx *Index) Write(w io.Writer, key *Key) error {
+	var encryptWriter io.WriteCloser
+	if key != nil {
+		var err error
+		if encryptWriter, err = NewEncryptWriter(w, key); err != nil {
+			return err
+		}
+		w = encryptWriter
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	if err := json.NewEncoder(gzipWriter).Encode(idx); err != nil {
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+	if encryptWriter != nil {
+		return encryptWriter.Close()
+	}
+	return nil
+}
+
+func LoadIndex(path string, key *Key) (*Index, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadIndex(file, key)
+}
+
+// Save writes the index atomically so a crash never leaves a partial index behind
+func (idx *Index) Save(path string, key *Key) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create index directory: %w", err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".index-*")
+	if err != nil {
+		return fmt.Errorf("failed to create index file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+
+	writeErr := idx.Write(tmpFile, key)
+	closeErr := tmpFile.Close()
+	if writeErr != nil || closeErr != nil {
+		os.Remove(tmpPath)
+		if writeErr != nil {
+			return writeErr
+		}
+		return fmt.Errorf("failed to write index: %w", closeErr)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	return nil
+}
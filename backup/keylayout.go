@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// keyMarker stands in for the template fields that are unknown when only
+// the fixed start of a key is wanted
+const keyMarker = "\x00"
+
+// hostMarker stands in for the host when a key is matched with the template
+const hostMarker = "\x01"
+
+// KeyLayout places archives in a bucket under keys rendered from a
+// template, such as {{.Host}}/{{.Job}}/{{.Year}}/{{.Month}}/{{.Name}}. The
+// fields of an archive's key are taken from its name and the host, so
+// every key can be derived again from the name alone.
+type KeyLayout struct {
+	template *template.Template
+	host     string
+}
+
+// keyFields are the values a key template can use
+type keyFields struct {
+	Host  string
+	Job   string
+	Year  string
+	Month string
+	Day   string
+	Name  string
+}
+
+// NewKeyLayout parses a key template for the archives of host. The
+// template must end with {{.Name}} as its last path element.
+func NewKeyLayout(text, host string) (*KeyLayout, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key template: %w", err)
+	}
+	layout := &KeyLayout{template: tmpl, host: host}
+
+	name := NewBackupName("job").Filename()
+	key, err := layout.render(layout.archiveFields(name))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key template: %w", err)
+	}
+	if key != name && !strings.HasSuffix(key, "/"+name) {
+		return nil, fmt.Errorf("key template %q must end with {{.Name}}", text)
+	}
+	if strings.HasPrefix(key, "/") || path.Clean(key) != key || slices.Contains(strings.Split(key, "/"), "..") {
+		return nil, fmt.Errorf("key template %q must render a relative path without empty, . or .. elements", text)
+	}
+	return layout, nil
+}
+
+func (l *KeyLayout) render(fields keyFields) (string, error) {
+	var key strings.Builder
+	if err := l.template.Execute(&key, fields); err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
+
+// archiveFields returns the fields of the archive called name. Sidecar
+// manifests share the fields of their archive, so they are stored next to
+// it.
+func (l *KeyLayout) archiveFields(name string) keyFields {
+	parsed, _ := ParseBackupName(strings.TrimSuffix(name, ManifestFilename("")))
+	local := parsed.Time.Local()
+	return keyFields{
+		Host:  l.host,
+		Job:   parsed.Prefix,
+		Year:  local.Format("2006"),
+		Month: local.Format("01"),
+		Day:   local.Format("02"),
+		Name:  name,
+	}
+}
+
+// fixed renders the template with the date and the name unknown, and
+// returns the part of the key before the first unknown field
+func (l *KeyLayout) fixed(fields keyFields) string {
+	fields.Year, fields.Month, fields.Day, fields.Name = keyMarker, keyMarker, keyMarker, keyMarker
+	key, err := l.render(fields)
+	if err != nil {
+		return ""
+	}
+	key, _, _ = strings.Cut(key, keyMarker)
+	return key
+}
+
+// Key returns the key the object called name is stored under. Archives
+// and their manifests are placed by the template. An index, which has no
+// date, goes where the template's date fields would start for its job.
+// Other objects go under the fixed start of every key of the host.
+func (l *KeyLayout) Key(name string) string {
+	if _, ok := ParseBackupName(strings.TrimSuffix(name, ManifestFilename(""))); ok {
+		key, err := l.render(l.archiveFields(name))
+		if err == nil {
+			return key
+		}
+	}
+	if job, ok := strings.CutSuffix(name, IndexFilename("")); ok && job != "" {
+		return l.fixed(keyFields{Host: l.host, Job: job}) + name
+	}
+	return l.Prefix() + name
+}
+
+// Host returns the host an archive or manifest stored under key belongs
+// to, whatever host the layout was made for. It reports false when the
+// template has no {{.Host}} or key was not rendered from it.
+func (l *KeyLayout) Host(key string) (string, bool) {
+	pattern, err := l.render(keyFields{
+		Host:  hostMarker,
+		Job:   keyMarker,
+		Year:  keyMarker,
+		Month: keyMarker,
+		Day:   keyMarker,
+		Name:  keyMarker,
+	})
+	if err != nil {
+		return "", false
+	}
+	patterns, elements := strings.Split(pattern, "/"), strings.Split(key, "/")
+	if len(patterns) != len(elements) {
+		return "", false
+	}
+	for i, pattern := range patterns {
+		before, after, ok := strings.Cut(pattern, hostMarker)
+		if !ok {
+			continue
+		}
+		// The host is only known when the rest of its element is fixed
+		if strings.Contains(before+after, keyMarker) || strings.Contains(after, hostMarker) {
+			return "", false
+		}
+		host, ok := strings.CutPrefix(elements[i], before)
+		if !ok {
+			return "", false
+		}
+		host, ok = strings.CutSuffix(host, after)
+		return host, ok && host != ""
+	}
+	return "", false
+}
+
+// Prefix returns the start every key of the host has in common, which is
+// where listings begin
+func (l *KeyLayout) Prefix() string {
+	return l.fixed(keyFields{Host: l.host, Job: keyMarker})
+}
@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyLayout(t *testing.T) {
+	layout, err := NewKeyLayout("{{.Host}}/{{.Job}}/{{.Year}}/{{.Month}}/{{.Name}}", "web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := BackupName{Prefix: "db", Time: time.Date(2024, 3, 9, 4, 5, 6, 0, time.Local)}.Filename()
+	tests := map[string]string{
+		name:                        "web1/db/2024/03/" + name,
+		ManifestFilename(name):      "web1/db/2024/03/" + ManifestFilename(name),
+		IndexFilename("db"):         "web1/db/" + IndexFilename("db"),
+		"snapshots/notes.txt":       "web1/snapshots/notes.txt",
+		"db-not-a-backup.tar.gz.md": "web1/db-not-a-backup.tar.gz.md",
+	}
+	for name, want := range tests {
+		if key := layout.Key(name); key != want {
+			t.Errorf("Key(%q) = %q, want %q", name, key, want)
+		}
+	}
+	if prefix := layout.Prefix(); prefix != "web1/" {
+		t.Errorf("Expected the prefix web1/, got %q", prefix)
+	}
+	for key, want := range map[string]string{
+		"web2/db/2024/03/" + name:                   "web2",
+		"web2/db/2024/03/" + ManifestFilename(name): "web2",
+		"web2/db/" + IndexFilename("db"):            "",
+		name:                                        "",
+	} {
+		if host, ok := layout.Host(key); host != want || ok != (want != "") {
+			t.Errorf("Host(%q) = %q, %v, want %q", key, host, ok, want)
+		}
+	}
+
+	root, err := NewKeyLayout("{{.Name}}", "web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := root.Key(name); key != name || root.Prefix() != "" {
+		t.Errorf("Expected names to be keys, got %q under %q", key, root.Prefix())
+	}
+	if host, ok := root.Host(name); ok {
+		t.Errorf("Expected no host without {{.Host}}, got %q", host)
+	}
+
+	named, err := NewKeyLayout("hosts/host-{{.Host}}/{{.Name}}", "web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host, ok := named.Host("hosts/host-web2/" + name); host != "web2" || !ok {
+		t.Errorf("Expected the host inside a path element, got %q, %v", host, ok)
+	}
+}
+
+func TestKeyLayoutRejectsBadTemplates(t *testing.T) {
+	for _, text := range []string{
+		"{{.Host}}/{{.Name",
+		"{{.Host}}/{{.Year}}",
+		"{{.Host}}/{{.Name}}/{{.Year}}",
+		"{{.Host}}{{.Name}}",
+		"/{{.Host}}/{{.Name}}",
+		"{{.Host}}//{{.Name}}",
+		"../{{.Name}}",
+		"{{.Region}}/{{.Name}}",
+	} {
+		if _, err := NewKeyLayout(text, "web1"); err == nil {
+			t.Errorf("Expected %q to be rejected", text)
+		}
+	}
+}
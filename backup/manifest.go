@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const manifestVersion = 1
+
+// manifestEntry is the first entry of every archive
+const manifestEntry = metaDir + "manifest.json"
+
+// Manifest lists the entries an archive contains. It is the first entry
+// of the archive and is also uploaded next to it, so the contents of a
+// backup can be listed, compared and verified without downloading it.
+type Manifest struct {
+	Version     int            `json:"version"`
+	Created     time.Time      `json:"created"`
+	Incremental bool           `json:"incremental,omitempty"`
+	Files       []ManifestFile `json:"files"`
+	// Deleted lists the paths an incremental archive records as removed
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+type ManifestFile struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Link    string      `json:"link,omitempty"`
+	Hash    string      `json:"sha256,omitempty"`
+}
+
+// ManifestFilename returns the object name of the manifest uploaded next to an archive
+func ManifestFilename(archive string) string {
+	return archive + ".manifest.json.gz"
+}
+
+// TotalSize returns the combined size of the regular files in the manifest
+func (m *Manifest) TotalSize() int64 {
+	var total int64
+	for _, file := range m.Files {
+		if file.Mode.IsRegular() {
+			total += file.Size
+		}
+	}
+	return total
+}
+
+// RegularFiles counts the regular files in the manifest
+func (m *Manifest) RegularFiles() int {
+	count := 0
+	for _, file := range m.Files {
+		if file.Mode.IsRegular() {
+			count++
+		}
+	}
+	return count
+}
+
+// ReadManifest parses a sidecar manifest, decrypting it with key if it is encrypted
+func ReadManifest(r io.Reader, key *Key) (*Manifest, error) {
+	r, err := OpenDecrypted(r, key)
+	if err != nil {
+		return nil, err
+	}
+
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer gzipReader.Close()
+
+	return decodeManifest(gzipReader)
+}
+
+func decodeManifest(r io.Reader) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", manifest.Version)
+	}
+	return &manifest, nil
+}
+
+// Write serialises the manifest as a sidecar object, encrypting it with
+// key unless key is nil
+func (m *Manifest) Write(w io.Writer, key *Key) error {
+	var encryptWriter io.WriteCloser
+	if key != nil {
+		var err error
+		if encryptWriter, err = NewEncryptWriter(w, key); err != nil {
+			return err
+		}
+		w = encryptWriter
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	if err := json.NewEncoder(gzipWriter).Encode(m); err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if encryptWriter != nil {
+		return encryptWriter.Close()
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestArchiveManifest verifies that the manifest is the first entry and
+// describes every archived file
+func TestArchiveManifest(t *testing.T) {
+	source, archivePath := createTestArchive(t)
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	header, err := tarReader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Name != manifestEntry {
+		t.Fatalf("Expected the manifest as first entry, got %s", header.Name)
+	}
+	manifest, err := decodeManifest(tarReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]ManifestFile)
+	for _, f := range manifest.Files {
+		files[f.Path] = f
+	}
+	// The root, a.txt, sub, sub/b.log and link
+	if len(files) != 5 {
+		t.Fatalf("Expected 5 manifest entries, got %d", len(files))
+	}
+	sum := sha256.Sum256([]byte("alpha"))
+	if got := files[filepath.Join(source, "a.txt")]; got.Hash != hex.EncodeToString(sum[:]) || got.Size != 5 {
+		t.Errorf("Unexpected manifest entry for a.txt: %+v", got)
+	}
+	if got := files[filepath.Join(source, "link")]; got.Link != "a.txt" || got.Hash != "" {
+		t.Errorf("Unexpected manifest entry for link: %+v", got)
+	}
+	if manifest.TotalSize() != 10 {
+		t.Errorf("Expected a total size of 10, got %d", manifest.TotalSize())
+	}
+}
+
+func TestIncrementalManifest(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "data")
+	writeTestFile(t, filepath.Join(source, "keep.txt"), "keep")
+	writeTestFile(t, filepath.Join(source, "remove.txt"), "gone")
+
+	var buf bytes.Buffer
+	full, err := WriteArchive(&buf, []Folder{{Path: source}}, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove(filepath.Join(source, "remove.txt"))
+	writeTestFile(t, filepath.Join(source, "added.txt"), "added")
+
+	incr, err := WriteArchive(&buf, []Folder{{Path: source}}, ArchiveOptions{Previous: full.Index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := incr.Manifest
+	if !manifest.Incremental || len(manifest.Deleted) != 1 || manifest.Deleted[0] != filepath.Join(source, "remove.txt") {
+		t.Errorf("Unexpected deletions in manifest: %+v", manifest.Deleted)
+	}
+	// The root directory and added.txt; keep.txt is unchanged
+	if len(manifest.Files) != 2 {
+		t.Errorf("Expected 2 changed entries in manifest, got %+v", manifest.Files)
+	}
+}
+
+// TestArchiveFilesChanged verifies that files that grow or shrink after
+// they were hashed still produce an archive that verifies
+func TestArchiveFilesChanged(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "data")
+	grows, shrinks := filepath.Join(source, "grows.log"), filepath.Join(source, "shrinks.log")
+	writeTestFile(t, grows, "first line\n")
+	writeTestFile(t, shrinks, "first line\n")
+
+	entries, err := ScanFolders([]Folder{{Path: source}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files are hashed before the manifest is written, and changed
+	// right after it
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&hookWriter{w: &buf, hook: func() {
+		writeTestFile(t, grows, "first line\nsecond line\n")
+		writeTestFile(t, shrinks, "first")
+	}})
+	result, err := writeEntries(tarWriter, entries, nil)
+	if err != nil {
+		t.Fatalf("Expected changed files to be archived, got %v", err)
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := VerifyArchive(bytes.NewReader(buf.Bytes()), VerifyOptions{})
+	if err != nil || !report.HasManifest || len(report.Problems()) != 0 {
+		t.Errorf("Expected the archive to match its manifest, got %+v, %v", report, err)
+	}
+	// The first 11 bytes of grows.log did not change; its new size alone
+	// makes the next backup archive it again
+	if state := result.Index.Files[grows]; state.Hash == "" || state.Size != 11 {
+		t.Errorf("Expected the scanned size and hash of grows.log in the index, got %+v", state)
+	}
+	if state := result.Index.Files[shrinks]; state.Hash != "" || state.Size != 11 {
+		t.Errorf("Expected the scanned size and no hash of shrinks.log in the index, got %+v", state)
+	}
+
+	contents := make(map[string]string)
+	var names []string
+	tarReader := tar.NewReader(&buf)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tarReader)
+		contents[header.Name] = string(data)
+		names = append(names, header.Name)
+	}
+	if contents[grows] != "first line\n" || contents[shrinks] != "first\x00\x00\x00\x00\x00\x00" {
+		t.Errorf("Expected the scanned sizes to be copied, got %q and %q", contents[grows], contents[shrinks])
+	}
+	if names[0] != manifestEntry || names[len(names)-1] != changedEntry {
+		t.Errorf("Expected the manifest first and the changed files last, got %v", names)
+	}
+	for _, file := range result.Manifest.Files {
+		if data, ok := contents[file.Path]; ok && file.Hash != "" {
+			if sum := sha256.Sum256([]byte(data)); file.Hash != hex.EncodeToString(sum[:]) {
+				t.Errorf("%s: expected the sidecar to hold the hash of what was archived", file.Path)
+			}
+		}
+	}
+}
+
+// hookWriter calls hook after its first write
+type hookWriter struct {
+	w    io.Writer
+	hook func()
+}
+
+func (h *hookWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	if h.hook != nil {
+		h.hook()
+		h.hook = nil
+	}
+	return n, err
+}
+
+func TestManifestSidecarRoundTrip(t *testing.T) {
+	manifest := &Manifest{
+		Version: manifestVersion,
+		Files:   []ManifestFile{{Path: "/data/a.txt", Size: 5, Mode: 0644, Hash: "abc"}},
+	}
+
+	for _, key := range []*Key{nil, testKey(t)} {
+		var buf bytes.Buffer
+		if err := manifest.Write(&buf, key); err != nil {
+			t.Fatal(err)
+		}
+		if IsEncrypted(buf.Bytes()) != (key != nil) {
+			t.Errorf("Expected the sidecar to be encrypted only with a key")
+		}
+		read, err := ReadManifest(&buf, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(read.Files) != 1 || read.Files[0] != manifest.Files[0] {
+			t.Errorf("Manifest did not survive the round trip: %+v", read.Files)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"strconv"
+	"strings"
+)
+
+// EncryptionScheme names the encryption of encrypted backups in their metadata
+const EncryptionScheme = "aes-256-gcm"
+
+// maxFoldersMetadata keeps the folder list well inside the 2 KiB S3
+// allows for all user metadata of an object
+const maxFoldersMetadata = 1024
+
+// Metadata describes where a backup came from. It is attached to the
+// uploaded archive, so the origin of a backup can be seen without
+// downloading it.
+type Metadata struct {
+	Host    string
+	Job     string
+	Folders []string
+	// Files and UncompressedSize are -1 when unknown, as for archives that
+	// were streamed, whose contents are only known once the upload ends
+	Files            int
+	UncompressedSize int64
+	// Checksum is the hex encoded SHA-256 of the archive, if known
+	Checksum    string
+	Version     string
+	Compression Compression
+	// Encryption is EncryptionScheme or "none"
+	Encryption string
+}
+
+// Map returns the metadata as object metadata, leaving out unknown values
+func (m Metadata) Map() map[string]string {
+	values := map[string]string{
+		"host":        m.Host,
+		"job":         m.Job,
+		"folders":     truncateList(m.Folders, maxFoldersMetadata),
+		"version":     m.Version,
+		"compression": string(m.Compression),
+		"encryption":  m.Encryption,
+		"sha256":      m.Checksum,
+	}
+	if m.Files >= 0 {
+		values["files"] = strconv.Itoa(m.Files)
+	}
+	if m.UncompressedSize >= 0 {
+		values["uncompressed-size"] = strconv.FormatInt(m.UncompressedSize, 10)
+	}
+	for key, value := range values {
+		if value == "" {
+			delete(values, key)
+		}
+	}
+	return values
+}
+
+// ParseMetadata reads the metadata of an object. It returns false when
+// the object carries none, such as backups taken before it was recorded
+// or those on backends without object metadata.
+func ParseMetadata(values map[string]string) (Metadata, bool) {
+	m := Metadata{
+		Host:             values["host"],
+		Job:              values["job"],
+		Checksum:         values["sha256"],
+		Version:          values["version"],
+		Compression:      Compression(values["compression"]),
+		Encryption:       values["encryption"],
+		Files:            -1,
+		UncompressedSize: -1,
+	}
+	if folders := values["folders"]; folders != "" {
+		m.Folders = strings.Split(folders, ",")
+	}
+	if files, err := strconv.Atoi(values["files"]); err == nil {
+		m.Files = files
+	}
+	if size, err := strconv.ParseInt(values["uncompressed-size"], 10, 64); err == nil {
+		m.UncompressedSize = size
+	}
+	return m, m.Host != "" || m.Job != "" || m.Version != ""
+}
+
+// ExpectEncrypted reports whether a stored backup must be encrypted,
+// because its name ends in .enc or its object metadata names the
+// encryption scheme. metadata may be nil.
+func ExpectEncrypted(name string, metadata map[string]string) bool {
+	parsed, _ := ParseBackupName(name)
+	return parsed.Encrypted || metadata["encryption"] == EncryptionScheme
+}
+
+// truncateList joins items with commas, dropping the ones that do not fit
+// in limit bytes
+func truncateList(items []string, limit int) string {
+	var joined strings.Builder
+	for i, item := range items {
+		if joined.Len()+len(item)+1 > limit {
+			if i > 0 {
+				joined.WriteByte(',')
+			}
+			joined.WriteString("...")
+			break
+		}
+		if i > 0 {
+			joined.WriteByte(',')
+		}
+		joined.WriteString(item)
+	}
+	return joined.String()
+}
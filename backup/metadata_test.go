@@ -0,0 +1,56 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	metadata := Metadata{
+		Host:             "web1",
+		Job:              "db",
+		Folders:          []string{"/var/lib/mysql", "/etc/mysql"},
+		Files:            12,
+		UncompressedSize: 4096,
+		Checksum:         "abc123",
+		Version:          "1.2.0",
+		Compression:      CompressionZstd,
+		Encryption:       EncryptionScheme,
+	}
+
+	parsed, ok := ParseMetadata(metadata.Map())
+	if !ok {
+		t.Fatal("Expected metadata to be found")
+	}
+	if parsed.Host != "web1" || parsed.Job != "db" || len(parsed.Folders) != 2 || parsed.Files != 12 ||
+		parsed.UncompressedSize != 4096 || parsed.Checksum != "abc123" || parsed.Compression != CompressionZstd ||
+		parsed.Encryption != EncryptionScheme || parsed.Version != "1.2.0" {
+		t.Errorf("Metadata did not survive the round trip: %+v", parsed)
+	}
+}
+
+func TestMetadataLeavesOutUnknownValues(t *testing.T) {
+	values := Metadata{Host: "web1", Files: -1, UncompressedSize: -1}.Map()
+	if len(values) != 1 || values["host"] != "web1" {
+		t.Errorf("Expected only the host, got %v", values)
+	}
+
+	parsed, _ := ParseMetadata(values)
+	if parsed.Files != -1 || parsed.UncompressedSize != -1 {
+		t.Errorf("Expected unknown counts, got %+v", parsed)
+	}
+	if _, ok := ParseMetadata(nil); ok {
+		t.Error("Expected no metadata to be found in an empty map")
+	}
+}
+
+func TestMetadataTruncatesFolders(t *testing.T) {
+	var folders []string
+	for i := 0; i < 200; i++ {
+		folders = append(folders, "/srv/some/rather/long/folder")
+	}
+	value := Metadata{Folders: folders}.Map()["folders"]
+	if len(value) > maxFoldersMetadata+4 || !strings.HasSuffix(value, ",...") {
+		t.Errorf("Folder list was not truncated: %d bytes", len(value))
+	}
+}
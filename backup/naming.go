@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"strings"
+	"time"
+)
+
+// Archive names have the form <prefix>-<timestamp>[.incr].tar[.gz|.zst|.xz][.enc]
+const (
+	timestampLayout      = "20060102-150405"
+	incrementalExtension = ".incr"
+	encryptedExtension   = ".enc"
+)
+
+// BackupName is the information encoded in an archive name
+type BackupName struct {
+	Prefix      string
+	Time        time.Time
+	Incremental bool
+	Encrypted   bool
+	// Compression selects the archive extension; the zero value is gzip
+	Compression Compression
+}
+
+// NewBackupName returns the name for a backup taken now
+func NewBackupName(prefix string) BackupName {
+	return BackupName{
+		Prefix: prefix,
+		Time:   time.Now(),
+	}
+}
+
+func (n BackupName) Filename() string {
+	var name strings.Builder
+	name.WriteString(n.Prefix)
+	name.WriteString("-")
+	name.WriteString(n.Time.Format(timestampLayout))
+	if n.Incremental {
+		name.WriteString(incrementalExtension)
+	}
+	name.WriteString(n.Compression.Extension())
+	if n.Encrypted {
+		name.WriteString(encryptedExtension)
+	}
+	return name.String()
+}
+
+// ParseBackupName splits an archive name into its parts
+func ParseBackupName(name string) (BackupName, bool) {
+	var parsed BackupName
+	name, parsed.Encrypted = strings.CutSuffix(name, encryptedExtension)
+
+	var base string
+	for _, c := range compressions {
+		if trimmed, ok := strings.CutSuffix(name, c.extension); ok {
+			base, parsed.Compression = trimmed, c.compression
+			break
+		}
+	}
+	if parsed.Compression == "" {
+		return BackupName{}, false
+	}
+	base, parsed.Incremental = strings.CutSuffix(base, incrementalExtension)
+
+	if len(base) < len(timestampLayout)+2 || base[len(base)-len(timestampLayout)-1] != '-' {
+		return BackupName{}, false
+	}
+	timestamp, err := time.ParseInLocation(timestampLayout, base[len(base)-len(timestampLayout):], time.Local)
+	if err != nil {
+		return BackupName{}, false
+	}
+	parsed.Time = timestamp
+	parsed.Prefix = base[:len(base)-len(timestampLayout)-1]
+	return parsed, true
+}
@@ -0,0 +1,405 @@
+package backup
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OverwritePolicy decides what happens when a restored file already exists
+type OverwritePolicy string
+
+const (
+	OverwriteAlways OverwritePolicy = "always"
+	OverwriteNever  OverwritePolicy = "never"
+	OverwriteNewer  OverwritePolicy = "newer"
+)
+
+func ParseOverwritePolicy(value string) (OverwritePolicy, error) {
+	switch policy := OverwritePolicy(value); policy {
+	case OverwriteAlways, OverwriteNever, OverwriteNewer:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overwrite policy %q (expected always, never or newer)", value)
+	}
+}
+
+// PathMapping rewrites archived paths starting with From to start with To
+type PathMapping struct {
+	From string
+	To   string
+}
+
+func ParsePathMapping(value string) (PathMapping, error) {
+	from, to, ok := strings.Cut(value, "=")
+	if !ok || from == "" || to == "" {
+		return PathMapping{}, fmt.Errorf("invalid path mapping %q (expected /old/path=/new/path)", value)
+	}
+	return PathMapping{From: cleanEntryName(from), To: cleanEntryName(to)}, nil
+}
+
+type RestoreOptions struct {
+	TargetDir string
+	Mappings  []PathMapping
+	Include   []string
+	Overwrite OverwritePolicy
+	DryRun    bool
+	// DecryptionKey decrypts encrypted backups. Unencrypted backups are read as is.
+	DecryptionKey *Key
+	// RequireEncryption refuses every archive without encryption, whatever
+	// its name and metadata say, as when encryption is enabled
+	RequireEncryption bool
+}
+
+type RestoreStats struct {
+	Restored int
+	Skipped  int
+	Deleted  int
+	Bytes    int64
+}
+
+// ExtractArchive restores a single tar stream, compressed with gzip, zstd
+// or xz or not at all, into opts.TargetDir. The compression is detected
+// from the stream.
+func ExtractArchive(r io.Reader, opts RestoreOptions) (*RestoreStats, error) {
+	restorer, err := NewRestorer(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := restorer.Extract(r, false); err != nil {
+		return restorer.Finish(), err
+	}
+	return restorer.Finish(), nil
+}
+
+// Restorer extracts one or more archives into the same target. Extracting
+// a full backup followed by its incremental backups, in order, replays the
+// chain: later archives replace files written by earlier ones and recorded
+// deletions remove them again.
+type Restorer struct {
+	opts      RestoreOptions
+	include   []pattern
+	targetDir string
+	stats     RestoreStats
+	dirTimes  map[string]time.Time
+	// restored tracks paths written by this restore. Deletions from
+	// incremental archives only ever apply to these, never to files that
+	// were already present in the target.
+	restored map[string]bool
+}
+
+func NewRestorer(opts RestoreOptions) (*Restorer, error) {
+	if opts.TargetDir == "" {
+		return nil, fmt.Errorf("restore target directory is required")
+	}
+	if opts.Overwrite == "" {
+		opts.Overwrite = OverwriteNever
+	}
+
+	targetDir, err := filepath.Abs(opts.TargetDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve target directory: %w", err)
+	}
+	if !opts.DryRun {
+		if err := os.MkdirAll(targetDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create target directory: %w", err)
+		}
+	}
+
+	return &Restorer{
+		opts:      opts,
+		include:   parsePatterns(opts.Include),
+		targetDir: targetDir,
+		dirTimes:  make(map[string]time.Time),
+		restored:  make(map[string]bool),
+	}, nil
+}
+
+// Extract restores a compressed tar stream, decrypting it first if needed.
+// When encrypted is set, as ExpectEncrypted decides, or encryption is
+// required, a stream that is not encrypted is refused instead of being
+// restored as plaintext.
+func (r *Restorer) Extract(reader io.Reader, encrypted bool) error {
+	open := OpenDecrypted
+	if encrypted || r.opts.RequireEncryption {
+		open = OpenEncrypted
+	}
+	reader, err := open(reader, r.opts.DecryptionKey)
+	if err != nil {
+		return err
+	}
+
+	tarStream, err := newDecompressReader(reader)
+	if err != nil {
+		return err
+	}
+	defer tarStream.Close()
+
+	return r.ExtractTar(tar.NewReader(tarStream))
+}
+
+// ExtractTar restores an uncompressed tar stream
+func (r *Restorer) ExtractTar(tarReader *tar.Reader) error {
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		if header.Name == deletedEntry {
+			if err := r.applyDeletions(tarReader); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(header.Name, metaDir) {
+			continue
+		}
+
+		dest, ok := r.destination(header.Name, header.Typeflag == tar.TypeDir)
+		if !ok || (dest == r.targetDir && header.Typeflag != tar.TypeDir) {
+			continue
+		}
+
+		restored, err := restoreEntry(tarReader, header, dest, r.targetDir, r.opts, r.restored[dest])
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", header.Name, err)
+		}
+		if !restored {
+			r.stats.Skipped++
+			continue
+		}
+		r.restored[dest] = true
+		if header.Typeflag == tar.TypeDir {
+			r.dirTimes[dest] = header.ModTime
+		} else {
+			r.stats.Bytes += header.Size
+		}
+		r.stats.Restored++
+	}
+}
+
+// Finish applies directory modification times and returns the totals.
+// Directory times are applied last because restoring their contents changes them.
+func (r *Restorer) Finish() *RestoreStats {
+	if !r.opts.DryRun {
+		for dir, modTime := range r.dirTimes {
+			if err := os.Chtimes(dir, modTime, modTime); err != nil {
+				log.Printf("Failed to set modification time on %s: %v", dir, err)
+			}
+		}
+	}
+	stats := r.stats
+	return &stats
+}
+
+// destination maps an archived name to its path below the target, or
+// reports false when the include filters exclude it. Include patterns use
+// the same syntax as exclude patterns and match the remapped path or any
+// directory containing it.
+func (r *Restorer) destination(name string, isDir bool) (string, bool) {
+	mapped := applyMappings(cleanEntryName(name), r.opts.Mappings)
+	if len(r.include) > 0 && !matchesOrWithin(r.include, strings.TrimPrefix(mapped, "/"), isDir) {
+		return "", false
+	}
+	return filepath.Join(r.targetDir, filepath.FromSlash(strings.TrimPrefix(mapped, "/"))), true
+}
+
+func (r *Restorer) applyDeletions(reader io.Reader) error {
+	var deleted []string
+	if err := json.NewDecoder(reader).Decode(&deleted); err != nil {
+		return fmt.Errorf("failed to read deleted paths: %w", err)
+	}
+
+	// Reverse order removes files before the directories that contain them
+	sort.Sort(sort.Reverse(sort.StringSlice(deleted)))
+	for _, name := range deleted {
+		dest, ok := r.destination(name, false)
+		if !ok || !r.restored[dest] {
+			continue
+		}
+		delete(r.restored, dest)
+		delete(r.dirTimes, dest)
+		r.stats.Deleted++
+
+		if r.opts.DryRun {
+			log.Printf("[dry-run] delete %s", dest)
+			continue
+		}
+		if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete %s: %v", dest, err)
+		}
+	}
+	return nil
+}
+
+func restoreEntry(tarReader *tar.Reader, header *tar.Header, dest, targetDir string, opts RestoreOptions, replace bool) (bool, error) {
+	switch header.Typeflag {
+	case tar.TypeDir, tar.TypeReg, tar.TypeSymlink:
+	default:
+		log.Printf("Skipping unsupported entry type for %s", header.Name)
+		return false, nil
+	}
+
+	if err := checkParentWithin(dest, targetDir); err != nil {
+		return false, err
+	}
+
+	if header.Typeflag != tar.TypeDir && !replace {
+		if existing, err := os.Lstat(dest); err == nil {
+			if !shouldOverwrite(opts.Overwrite, existing, header) {
+				if opts.DryRun {
+					log.Printf("[dry-run] skip existing %s", dest)
+				}
+				return false, nil
+			}
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	if opts.DryRun {
+		log.Printf("[dry-run] restore %s -> %s", header.Name, dest)
+		return true, nil
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return false, err
+		}
+		return true, os.Chmod(dest, header.FileInfo().Mode().Perm())
+
+	case tar.TypeSymlink:
+		if header.Linkname == "" {
+			log.Printf("Skipping symlink without target: %s", header.Name)
+			return false, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return false, err
+		}
+		if err := removeExisting(dest); err != nil {
+			return false, err
+		}
+		return true, os.Symlink(header.Linkname, dest)
+
+	default:
+		return true, writeFile(tarReader, header, dest)
+	}
+}
+
+// writeFile writes to a temporary file next to dest and renames it into
+// place, so an interrupted restore never leaves a truncated file behind
+func writeFile(r io.Reader, header *tar.Header, dest string) error {
+	dir := filepath.Dir(dest)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, ".restore-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	_, copyErr := io.Copy(tmpFile, r)
+	closeErr := tmpFile.Close()
+	if copyErr != nil || closeErr != nil {
+		os.Remove(tmpPath)
+		if copyErr != nil {
+			return copyErr
+		}
+		return closeErr
+	}
+
+	if err := os.Chmod(tmpPath, header.FileInfo().Mode().Perm()); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chtimes(tmpPath, header.ModTime, header.ModTime); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := removeExisting(dest); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, dest)
+}
+
+func removeExisting(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func shouldOverwrite(policy OverwritePolicy, existing os.FileInfo, header *tar.Header) bool {
+	switch policy {
+	case OverwriteAlways:
+		return true
+	case OverwriteNewer:
+		return header.ModTime.After(existing.ModTime())
+	default:
+		return false
+	}
+}
+
+// checkParentWithin refuses to write through symlinks that lead outside the target directory
+func checkParentWithin(dest, targetDir string) error {
+	if dest == targetDir {
+		return nil
+	}
+	for parent := filepath.Dir(dest); parent != targetDir; {
+		resolved, err := filepath.EvalSymlinks(parent)
+		if err == nil {
+			resolvedTarget, err := filepath.EvalSymlinks(targetDir)
+			if err != nil {
+				resolvedTarget = targetDir
+			}
+			rel, err := filepath.Rel(resolvedTarget, resolved)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("refusing to write outside of %s", targetDir)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		next := filepath.Dir(parent)
+		if next == parent {
+			break
+		}
+		parent = next
+	}
+	return nil
+}
+
+// cleanEntryName normalises an archived path to a rooted slash separated
+// form so traversal sequences can never escape the restore target
+func cleanEntryName(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+func applyMappings(name string, mappings []PathMapping) string {
+	for _, mapping := range mappings {
+		if name == mapping.From {
+			return mapping.To
+		}
+		if rest, ok := strings.CutPrefix(name, strings.TrimSuffix(mapping.From, "/")+"/"); ok {
+			return path.Join(mapping.To, rest)
+		}
+	}
+	return name
+}
@@ -0,0 +1,233 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// createTestArchive archives a small tree and returns the source root and archive path
+func createTestArchive(t *testing.T) (string, string) {
+	t.Helper()
+	source := filepath.Join(t.TempDir(), "data")
+	writeTestFile(t, filepath.Join(source, "a.txt"), "alpha")
+	writeTestFile(t, filepath.Join(source, "sub", "b.log"), "bravo")
+	if err := os.Symlink("a.txt", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "test.tar.gz")
+	if _, err := CreateArchive([]Folder{{Path: source}}, archivePath, ArchiveOptions{}); err != nil {
+		t.Fatalf("CreateArchive failed: %v", err)
+	}
+	return source, archivePath
+}
+
+func extractTestArchive(t *testing.T, archivePath string, opts RestoreOptions) *RestoreStats {
+	t.Helper()
+	file, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	stats, err := ExtractArchive(file, opts)
+	if err != nil {
+		t.Fatalf("ExtractArchive failed: %v", err)
+	}
+	return stats
+}
+
+// TestRestoreRoundTrip verifies that an archive restores with path remapping
+func TestRestoreRoundTrip(t *testing.T) {
+	source, archivePath := createTestArchive(t)
+	target := t.TempDir()
+
+	extractTestArchive(t, archivePath, RestoreOptions{
+		TargetDir: target,
+		Mappings:  []PathMapping{{From: cleanEntryName(source), To: "/restored"}},
+	})
+
+	if got := readTestFile(t, filepath.Join(target, "restored", "a.txt")); got != "alpha" {
+		t.Errorf("Expected a.txt to contain alpha, got %q", got)
+	}
+	if got := readTestFile(t, filepath.Join(target, "restored", "sub", "b.log")); got != "bravo" {
+		t.Errorf("Expected sub/b.log to contain bravo, got %q", got)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "restored", "link")); err != nil || link != "a.txt" {
+		t.Errorf("Expected symlink to a.txt, got %q (%v)", link, err)
+	}
+}
+
+// TestRestoreIncludeAndOverwrite verifies glob filters and overwrite policies
+func TestRestoreIncludeAndOverwrite(t *testing.T) {
+	source, archivePath := createTestArchive(t)
+	target := t.TempDir()
+	mappings := []PathMapping{{From: cleanEntryName(source), To: "/"}}
+
+	stats := extractTestArchive(t, archivePath, RestoreOptions{
+		TargetDir: target,
+		Mappings:  mappings,
+		Include:   []string{"*.log"},
+	})
+	if stats.Restored != 1 {
+		t.Errorf("Expected 1 restored entry, got %d", stats.Restored)
+	}
+	if _, err := os.Stat(filepath.Join(target, "a.txt")); !os.IsNotExist(err) {
+		t.Error("Expected a.txt to be filtered out")
+	}
+
+	existing := filepath.Join(target, "sub", "b.log")
+	writeTestFile(t, existing, "local")
+	extractTestArchive(t, archivePath, RestoreOptions{TargetDir: target, Mappings: mappings, Overwrite: OverwriteNever})
+	if got := readTestFile(t, existing); got != "local" {
+		t.Errorf("Expected existing file to be kept, got %q", got)
+	}
+
+	extractTestArchive(t, archivePath, RestoreOptions{TargetDir: target, Mappings: mappings, Overwrite: OverwriteAlways})
+	if got := readTestFile(t, existing); got != "bravo" {
+		t.Errorf("Expected existing file to be overwritten, got %q", got)
+	}
+}
+
+// TestRestoreDryRun verifies that a dry run writes nothing
+func TestRestoreDryRun(t *testing.T) {
+	_, archivePath := createTestArchive(t)
+	target := filepath.Join(t.TempDir(), "out")
+
+	stats := extractTestArchive(t, archivePath, RestoreOptions{TargetDir: target, DryRun: true})
+	if stats.Restored == 0 {
+		t.Error("Expected dry run to report entries")
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Error("Expected dry run not to create the target directory")
+	}
+}
+
+// TestCleanEntryName verifies that archived paths cannot escape the target
+func TestCleanEntryName(t *testing.T) {
+	cases := map[string]string{
+		"../../etc/passwd": "/etc/passwd",
+		"/data/./a.txt":    "/data/a.txt",
+		"data/sub/":        "/data/sub",
+	}
+	for input, want := range cases {
+		if got := cleanEntryName(input); got != want {
+			t.Errorf("cleanEntryName(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestIncrementalChainRestore verifies that replaying a full and an
+// incremental backup yields the later state, including deletions
+func TestIncrementalChainRestore(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "data")
+	writeTestFile(t, filepath.Join(source, "keep.txt"), "keep")
+	writeTestFile(t, filepath.Join(source, "change.txt"), "old")
+	writeTestFile(t, filepath.Join(source, "remove.txt"), "gone")
+
+	archiveDir := t.TempDir()
+	fullPath := filepath.Join(archiveDir, "full.tar.gz")
+	full, err := CreateArchive([]Folder{{Path: source}}, fullPath, ArchiveOptions{})
+	if err != nil {
+		t.Fatalf("CreateArchive failed: %v", err)
+	}
+
+	writeTestFile(t, filepath.Join(source, "change.txt"), "new content")
+	writeTestFile(t, filepath.Join(source, "added.txt"), "added")
+	if err := os.Remove(filepath.Join(source, "remove.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	incrPath := filepath.Join(archiveDir, "incr.tar.gz")
+	incr, err := CreateArchive([]Folder{{Path: source}}, incrPath, ArchiveOptions{Previous: full.Index})
+	if err != nil {
+		t.Fatalf("CreateArchive failed: %v", err)
+	}
+	// The root directory, change.txt and added.txt
+	if incr.Files != 3 || incr.Deleted != 1 {
+		t.Errorf("Expected 3 files and 1 deletion in incremental, got %d and %d", incr.Files, incr.Deleted)
+	}
+
+	target := t.TempDir()
+	restorer, err := NewRestorer(RestoreOptions{
+		TargetDir: target,
+		Mappings:  []PathMapping{{From: cleanEntryName(source), To: "/"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, archive := range []string{fullPath, incrPath} {
+		file, err := os.Open(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := restorer.Extract(file, false); err != nil {
+			t.Fatalf("Extract failed: %v", err)
+		}
+		file.Close()
+	}
+	restorer.Finish()
+
+	if got := readTestFile(t, filepath.Join(target, "change.txt")); got != "new content" {
+		t.Errorf("Expected change.txt to be updated, got %q", got)
+	}
+	if got := readTestFile(t, filepath.Join(target, "keep.txt")); got != "keep" {
+		t.Errorf("Expected keep.txt from the full backup, got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(target, "added.txt")); err != nil {
+		t.Errorf("Expected added.txt to be restored: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "remove.txt")); !os.IsNotExist(err) {
+		t.Error("Expected remove.txt to be deleted by the incremental backup")
+	}
+}
+
+// TestBackupChains verifies chain resolution and chain-aware retention
+func TestBackupChains(t *testing.T) {
+	names := FilterBackups([]string{
+		"db-20240105-000000.incr.tar.gz",
+		"db-20240101-000000.tar.gz",
+		"db-20240102-000000.incr.tar.gz",
+		"db-20240103-000000.tar.gz",
+		"db-20240104-000000.incr.tar.gz",
+		"db-index.json.gz",
+		"db-other-20240101-000000.tar.gz",
+	}, "db")
+	if len(names) != 5 || names[0] != "db-20240101-000000.tar.gz" {
+		t.Fatalf("Unexpected filtered backups: %v", names)
+	}
+
+	chain, err := RestoreChain(names, "db-20240105-000000.incr.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 3 || chain[0] != "db-20240103-000000.tar.gz" {
+		t.Errorf("Unexpected restore chain: %v", chain)
+	}
+
+	// Keeping the newest incremental must keep the full backup it depends on
+	expired := ExpiredBackups(names, 1)
+	if len(expired) != 2 || expired[1] != "db-20240102-000000.incr.tar.gz" {
+		t.Errorf("Unexpected expired backups: %v", expired)
+	}
+}
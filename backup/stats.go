@@ -0,0 +1,217 @@
+package backup
+
+import (
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// projectionPeriod is how far ahead storage is projected
+const projectionPeriod = 30 * 24 * time.Hour
+
+// StoredObject is one object of a destination. Host is empty when it is
+// not known, as for objects without metadata.
+type StoredObject struct {
+	Key  string
+	Size int64
+	Host string
+}
+
+// Usage is the space a group of objects takes
+type Usage struct {
+	Objects int   `json:"objects"`
+	Size    int64 `json:"size"`
+}
+
+func (u *Usage) add(size int64) {
+	u.Objects++
+	u.Size += size
+}
+
+// JobStats describes the backups one job took on one host
+type JobStats struct {
+	Host string `json:"host"`
+	Job  string `json:"job"`
+	// Usage covers the archives together with their manifests
+	Usage
+	Backups int       `json:"backups"`
+	Latest  time.Time `json:"latest"`
+	// AverageSize, Growth and BackupsPerDay are taken from the archives
+	// of the trend. Growth is how many bytes each backup adds to the next,
+	// fitted by least squares.
+	AverageSize   int64   `json:"average_size"`
+	Growth        int64   `json:"growth"`
+	GrowthPercent float64 `json:"growth_percent"`
+	BackupsPerDay float64 `json:"backups_per_day"`
+	// ProjectedSize is the space the archives will take in 30 days, if
+	// backups keep their pace and growth and the retention limit holds
+	ProjectedSize int64 `json:"projected_size"`
+}
+
+// Stats summarises the objects of a destination
+type Stats struct {
+	Total Usage `json:"total"`
+	// Prefixes groups objects by the folder their key is in, with a
+	// trailing slash, or "" for the root
+	Prefixes map[string]Usage `json:"prefixes"`
+	Hosts    map[string]Usage `json:"hosts"`
+	Jobs     []JobStats       `json:"jobs"`
+	// ProjectedSize is the total size in 30 days. Objects that are not
+	// archives, such as manifests and indexes, are expected to stay as
+	// they are.
+	ProjectedSize int64 `json:"projected_size"`
+}
+
+// archive is a backup of a job, by the time its name records
+type archive struct {
+	time time.Time
+	size int64
+}
+
+// NewStats summarises objects. The growth of each job is measured over
+// its newest trend backups, and projected with retentionLimit, where zero
+// or less keeps every backup.
+func NewStats(objects []StoredObject, trend, retentionLimit int) Stats {
+	type jobKey struct{ host, job string }
+
+	stats := Stats{
+		Prefixes: make(map[string]Usage),
+		Hosts:    make(map[string]Usage),
+	}
+	jobs := make(map[jobKey]*JobStats)
+	archives := make(map[jobKey][]archive)
+	// Manifests have no metadata of their own; they share their archive's host
+	hosts := make(map[string]string)
+	for _, object := range objects {
+		if _, ok := ParseBackupName(path.Base(object.Key)); ok {
+			hosts[object.Key] = object.Host
+		}
+	}
+
+	for _, object := range objects {
+		stats.Total.add(object.Size)
+		addUsage(stats.Prefixes, keyPrefix(object.Key), object.Size)
+
+		name := path.Base(object.Key)
+		archiveKey, isManifest := strings.CutSuffix(object.Key, ManifestFilename(""))
+		host := object.Host
+		if isManifest {
+			host = hosts[archiveKey]
+			name = path.Base(archiveKey)
+		}
+		addUsage(stats.Hosts, host, object.Size)
+
+		parsed, ok := ParseBackupName(name)
+		if !ok {
+			continue
+		}
+		key := jobKey{host: host, job: parsed.Prefix}
+		job := jobs[key]
+		if job == nil {
+			job = &JobStats{Host: host, Job: parsed.Prefix}
+			jobs[key] = job
+		}
+		job.add(object.Size)
+		if !isManifest {
+			archives[key] = append(archives[key], archive{time: parsed.Time, size: object.Size})
+		}
+	}
+
+	for key, job := range jobs {
+		job.measure(archives[key], trend, retentionLimit)
+		stats.Jobs = append(stats.Jobs, *job)
+	}
+	sort.Slice(stats.Jobs, func(i, j int) bool {
+		if stats.Jobs[i].Host != stats.Jobs[j].Host {
+			return stats.Jobs[i].Host < stats.Jobs[j].Host
+		}
+		return stats.Jobs[i].Job < stats.Jobs[j].Job
+	})
+
+	stats.ProjectedSize = stats.Total.Size
+	for key, job := range jobs {
+		for _, archive := range archives[key] {
+			stats.ProjectedSize -= archive.size
+		}
+		stats.ProjectedSize += job.ProjectedSize
+	}
+	return stats
+}
+
+// measure fills in the trend and projection of a job from its archives
+func (j *JobStats) measure(archives []archive, trend, retentionLimit int) {
+	sort.SliceStable(archives, func(i, k int) bool {
+		return archives[i].time.Before(archives[k].time)
+	})
+	j.Backups = len(archives)
+	if len(archives) == 0 {
+		return
+	}
+	j.Latest = archives[len(archives)-1].time
+
+	recent := archives
+	if trend > 0 && len(recent) > trend {
+		recent = recent[len(recent)-trend:]
+	}
+	n := float64(len(recent))
+	var sum, weighted float64
+	for i, archive := range recent {
+		sum += float64(archive.size)
+		weighted += float64(i) * float64(archive.size)
+	}
+	mean := sum / n
+	j.AverageSize = int64(math.Round(mean))
+
+	// Least squares fit of size against the index of the backup
+	var slope float64
+	if len(recent) > 1 {
+		centre := (n - 1) / 2
+		variance := n * (n*n - 1) / 12
+		slope = (weighted - centre*sum) / variance
+		j.Growth = int64(math.Round(slope))
+		if mean > 0 {
+			j.GrowthPercent = slope / mean * 100
+		}
+		span := recent[len(recent)-1].time.Sub(recent[0].time)
+		if span > 0 {
+			j.BackupsPerDay = (n - 1) / span.Hours() * 24
+		}
+	}
+
+	// The newest sizes a month from now: the current archives followed by
+	// those still to be taken, of which the retention limit keeps the last
+	sizes := make([]float64, len(archives))
+	for i, archive := range archives {
+		sizes[i] = float64(archive.size)
+	}
+	ahead := int(j.BackupsPerDay * projectionPeriod.Hours() / 24)
+	last := mean + slope*(n-1)/2
+	for i := 1; i <= ahead; i++ {
+		sizes = append(sizes, max(last+slope*float64(i), 0))
+	}
+	if retentionLimit > 0 && len(sizes) > retentionLimit {
+		sizes = sizes[len(sizes)-retentionLimit:]
+	}
+	var projected float64
+	for _, size := range sizes {
+		projected += size
+	}
+	j.ProjectedSize = int64(math.Round(projected))
+}
+
+// keyPrefix returns the folder key is in, with a trailing slash
+func keyPrefix(key string) string {
+	dir := path.Dir(key)
+	if dir == "." {
+		return ""
+	}
+	return dir + "/"
+}
+
+func addUsage(usage map[string]Usage, key string, size int64) {
+	u := usage[key]
+	u.add(size)
+	usage[key] = u
+}
@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	var objects []StoredObject
+	for i := 0; i < 10; i++ {
+		name := BackupName{Prefix: "db", Time: start.AddDate(0, 0, i)}.Filename()
+		objects = append(objects,
+			StoredObject{Key: "web1/db/" + name, Size: int64(100 + 10*i), Host: "web1"},
+			StoredObject{Key: "web1/db/" + ManifestFilename(name), Size: 5},
+		)
+	}
+	objects = append(objects,
+		StoredObject{Key: "web1/db/" + IndexFilename("db"), Size: 7},
+		StoredObject{Key: BackupName{Prefix: "db", Time: start}.Filename(), Size: 1000},
+	)
+
+	stats := NewStats(objects, 5, 10)
+	if stats.Total != (Usage{Objects: 22, Size: 1450 + 50 + 7 + 1000}) {
+		t.Errorf("Unexpected total %+v", stats.Total)
+	}
+	if stats.Prefixes["web1/db/"] != (Usage{Objects: 21, Size: 1507}) || stats.Prefixes[""] != (Usage{Objects: 1, Size: 1000}) {
+		t.Errorf("Unexpected prefixes %+v", stats.Prefixes)
+	}
+	if stats.Hosts["web1"] != (Usage{Objects: 20, Size: 1500}) || stats.Hosts[""] != (Usage{Objects: 2, Size: 1007}) {
+		t.Errorf("Expected manifests to count for the host of their archive, got %+v", stats.Hosts)
+	}
+
+	if len(stats.Jobs) != 2 {
+		t.Fatalf("Expected a job per host, got %+v", stats.Jobs)
+	}
+	// Jobs without a host sort first
+	other, db := stats.Jobs[0], stats.Jobs[1]
+	if other.Host != "" || other.Backups != 1 || other.Growth != 0 || other.ProjectedSize != 1000 {
+		t.Errorf("Unexpected stats for a single backup %+v", other)
+	}
+	if db.Host != "web1" || db.Job != "db" || db.Backups != 10 || db.Usage != (Usage{Objects: 20, Size: 1500}) {
+		t.Errorf("Unexpected usage %+v", db)
+	}
+	if !db.Latest.Equal(start.AddDate(0, 0, 9)) {
+		t.Errorf("Expected the latest backup to be the last day, got %v", db.Latest)
+	}
+	if db.AverageSize != 170 || db.Growth != 10 || db.BackupsPerDay != 1 {
+		t.Errorf("Expected the trend of the last 5 backups, got %+v", db)
+	}
+	// 30 more daily backups of 200 to 490 bytes, of which the last 10 are kept
+	if db.ProjectedSize != 4450 {
+		t.Errorf("Expected a projected size of 4450, got %d", db.ProjectedSize)
+	}
+	if stats.ProjectedSize != 50+7+1000+4450 {
+		t.Errorf("Unexpected total projection %d", stats.ProjectedSize)
+	}
+}
+
+func TestStatsWithoutRetentionLimit(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	var objects []StoredObject
+	for i := 0; i < 3; i++ {
+		name := BackupName{Prefix: "db", Time: start.Add(time.Duration(i) * 24 * time.Hour)}.Filename()
+		objects = append(objects, StoredObject{Key: name, Size: 100})
+	}
+
+	job := NewStats(objects, 10, 0).Jobs[0]
+	if job.Growth != 0 || job.ProjectedSize != 33*100 {
+		t.Errorf("Expected every backup of the month to be kept, got %+v", job)
+	}
+}
@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type VerifyOptions struct {
+	DecryptionKey *Key
+	// Manifest is checked against when the archive has no embedded
+	// manifest, for example the sidecar of an archive whose first entry
+	// was lost. The embedded manifest always takes precedence.
+	Manifest *Manifest
+	// Encrypted refuses archives without encryption, for those that
+	// ExpectEncrypted says must have it or when encryption is enabled
+	Encrypted bool
+}
+
+// VerifyReport is the outcome of reading an archive end to end
+type VerifyReport struct {
+	Entries int
+	// Bytes is the size of the file contents read from the archive
+	Bytes int64
+	// HasManifest is false when there was no manifest to compare with, in
+	// which case only the integrity of the stream itself was checked
+	HasManifest bool
+	// Corrupted lists entries whose content or metadata differ from the manifest
+	Corrupted []string
+	// Missing lists manifest entries that are not in the archive
+	Missing []string
+	// Unexpected lists archive entries that are not in the manifest
+	Unexpected []string
+}
+
+// Problems describes everything that is wrong with the archive, one line per entry
+func (r *VerifyReport) Problems() []string {
+	var problems []string
+	for _, path := range r.Corrupted {
+		problems = append(problems, "corrupted: "+path)
+	}
+	for _, path := range r.Missing {
+		problems = append(problems, "missing: "+path)
+	}
+	for _, path := range r.Unexpected {
+		problems = append(problems, "not in manifest: "+path)
+	}
+	return problems
+}
+
+// VerifyArchive reads an archive to the end, which also checks the
+// encryption tags and the compression checksums, and compares every entry
+// with the manifest. It returns an error when the stream itself is damaged;
+// entries that do not match the manifest are listed in the report.
+func VerifyArchive(r io.Reader, opts VerifyOptions) (*VerifyReport, error) {
+	open := OpenDecrypted
+	if opts.Encrypted {
+		open = OpenEncrypted
+	}
+	reader, err := open(r, opts.DecryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	tarStream, err := newDecompressReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	defer tarStream.Close()
+
+	// Files that changed while they were archived are listed in the last
+	// entry, so entries are compared once the whole archive has been read
+	type archived struct {
+		typeflag byte
+		size     int64
+		hash     string
+		link     string
+	}
+	report := &VerifyReport{}
+	manifest := opts.Manifest
+	var modified []ManifestFile
+	var entries []string
+	found := make(map[string]archived)
+
+	tarReader := tar.NewReader(tarStream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("archive is damaged after %d entries: %w", report.Entries, err)
+		}
+
+		if header.Name == manifestEntry {
+			if manifest, err = decodeManifest(tarReader); err != nil {
+				return report, err
+			}
+			report.Entries++
+			continue
+		}
+		if header.Name == changedEntry {
+			if err := json.NewDecoder(tarReader).Decode(&modified); err != nil {
+				return report, fmt.Errorf("failed to parse %s: %w", changedEntry, err)
+			}
+			report.Entries++
+			continue
+		}
+
+		hasher := sha256.New()
+		n, err := io.Copy(hasher, tarReader)
+		if err != nil {
+			return report, fmt.Errorf("archive is damaged in %s: %w", header.Name, err)
+		}
+		report.Entries++
+		report.Bytes += n
+
+		if strings.HasPrefix(header.Name, metaDir) {
+			continue
+		}
+		entries = append(entries, header.Name)
+		found[header.Name] = archived{
+			typeflag: header.Typeflag,
+			size:     n,
+			hash:     hex.EncodeToString(hasher.Sum(nil)),
+			link:     header.Linkname,
+		}
+	}
+
+	// The tar stream ends before the compression and encryption trailers,
+	// which hold the last checksums
+	if _, err := io.Copy(io.Discard, tarStream); err != nil {
+		return report, fmt.Errorf("archive is damaged at the end: %w", err)
+	}
+
+	expected := manifestFiles(manifest)
+	report.HasManifest = expected != nil
+	if expected == nil {
+		return report, nil
+	}
+	for _, file := range modified {
+		expected[file.Path] = file
+	}
+	for _, name := range entries {
+		file, ok := expected[name]
+		if !ok {
+			report.Unexpected = append(report.Unexpected, name)
+			continue
+		}
+		entry := found[name]
+		switch {
+		case file.Mode.IsRegular():
+			if entry.typeflag != tar.TypeReg || entry.size != file.Size || entry.hash != file.Hash {
+				report.Corrupted = append(report.Corrupted, name)
+			}
+		case entry.link != file.Link:
+			report.Corrupted = append(report.Corrupted, name)
+		}
+	}
+	for path := range expected {
+		if _, ok := found[path]; !ok {
+			report.Missing = append(report.Missing, path)
+		}
+	}
+	sort.Strings(report.Missing)
+	return report, nil
+}
+
+func manifestFiles(manifest *Manifest) map[string]ManifestFile {
+	if manifest == nil {
+		return nil
+	}
+	files := make(map[string]ManifestFile, len(manifest.Files))
+	for _, file := range manifest.Files {
+		files[file.Path] = file
+	}
+	return files
+}
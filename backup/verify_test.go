@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// TestVerifyArchive verifies that an intact archive passes and that
+// tampering with a file, or with the compressed stream, is detected
+func TestVerifyArchive(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "data")
+	writeTestFile(t, filepath.Join(source, "a.txt"), "alpha")
+	writeTestFile(t, filepath.Join(source, "b.txt"), "bravo")
+
+	for _, compression := range []Compression{CompressionGzip, CompressionNone} {
+		var buf bytes.Buffer
+		if _, err := WriteArchive(&buf, []Folder{{Path: source}}, ArchiveOptions{Compression: compression}); err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := VerifyArchive(bytes.NewReader(buf.Bytes()), VerifyOptions{})
+		if err != nil {
+			t.Fatalf("VerifyArchive failed: %v", err)
+		}
+		if !report.HasManifest || len(report.Problems()) != 0 || report.Bytes != 10 {
+			t.Errorf("Expected an intact %s archive, got %+v", compression, report)
+		}
+	}
+
+	// Uncompressed archives can be edited in place, which only the manifest can catch
+	var buf bytes.Buffer
+	if _, err := WriteArchive(&buf, []Folder{{Path: source}}, ArchiveOptions{Compression: CompressionNone}); err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(buf.Bytes(), []byte("bravo"), []byte("BRAVO"), 1)
+	report, err := VerifyArchive(bytes.NewReader(tampered), VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupted) != 1 || report.Corrupted[0] != filepath.Join(source, "b.txt") {
+		t.Errorf("Expected b.txt to be reported as corrupted, got %+v", report)
+	}
+
+	// Damage inside a gzip stream fails the checksum of the stream itself
+	buf.Reset()
+	if _, err := WriteArchive(&buf, []Folder{{Path: source}}, ArchiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	damaged := bytes.Clone(buf.Bytes())
+	damaged[len(damaged)/2] ^= 0xff
+	if _, err := VerifyArchive(bytes.NewReader(damaged), VerifyOptions{}); err == nil {
+		t.Error("Expected a damaged gzip stream to fail verification")
+	}
+}
+
+// TestVerifyAgainstSidecar verifies that archives without an embedded
+// manifest are checked against the one passed in
+func TestVerifyAgainstSidecar(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "data")
+	writeTestFile(t, filepath.Join(source, "a.txt"), "alpha")
+
+	var buf bytes.Buffer
+	result, err := WriteArchive(&buf, []Folder{{Path: source}}, ArchiveOptions{Compression: CompressionNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stripped := dropManifest(t, buf.Bytes())
+
+	manifest := *result.Manifest
+	manifest.Files = append(manifest.Files, ManifestFile{Path: filepath.Join(source, "lost.txt"), Mode: 0644})
+	report, err := VerifyArchive(bytes.NewReader(stripped), VerifyOptions{Manifest: &manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.HasManifest || len(report.Missing) != 1 || len(report.Corrupted) != 0 {
+		t.Errorf("Expected only lost.txt to be missing, got %+v", report)
+	}
+
+	report, err = VerifyArchive(bytes.NewReader(stripped), VerifyOptions{})
+	if err != nil || report.HasManifest {
+		t.Errorf("Expected a stream-only check without a manifest, got %+v, %v", report, err)
+	}
+}
+
+// dropManifest rewrites an uncompressed archive without its manifest
+func dropManifest(t *testing.T, archive []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	tarReader := tar.NewReader(bytes.NewReader(archive))
+	tarWriter := tar.NewWriter(&out)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Name == manifestEntry {
+			continue
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(tarWriter, tarReader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/backup"
+	"github.com/IndrajeethY/CloudFlareBackuper/config"
+	"github.com/IndrajeethY/CloudFlareBackuper/notification"
+	"github.com/IndrajeethY/CloudFlareBackuper/scheduler"
+	"github.com/IndrajeethY/CloudFlareBackuper/storage"
+)
+
+// commands maps subcommand names to their entry points. Running the binary
+// without a subcommand starts the backup service.
+var commands = map[string]func(args []string) error{
+	"list":    runList,
+	"prune":   runPrune,
+	"restore": runRestore,
+	"share":   runShare,
+	"stats":   runStats,
+	"verify":  runVerify,
+}
+
+// stringList is a flag.Value that collects repeated flags
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// newBandwidth returns the configured rate limits, or nil when transfers
+// are never limited. All destinations share it.
+func newBandwidth(cfg *config.Config) *storage.Bandwidth {
+	if !cfg.Bandwidth.Limited() {
+		return nil
+	}
+	return &storage.Bandwidth{
+		Upload: storage.NewThrottle(func(now time.Time) int64 {
+			return int64(cfg.Bandwidth.Limits(now).MaxUploadRate)
+		}),
+		Download: storage.NewThrottle(func(now time.Time) int64 {
+			return int64(cfg.Bandwidth.Limits(now).MaxDownloadRate)
+		}),
+	}
+}
+
+// newKeyLayout returns the layout archives of host are stored in, or nil
+// when they are stored at the root under their name. An empty host is
+// this host.
+func newKeyLayout(cfg *config.Config, host string) (storage.KeyLayout, error) {
+	if cfg.Backup.KeyTemplate == "" {
+		return nil, nil
+	}
+	if host == "" {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("failed to get hostname for backup.key_template: %w", err)
+		}
+	}
+	layout, err := backup.NewKeyLayout(cfg.Backup.KeyTemplate, host)
+	if err != nil {
+		return nil, fmt.Errorf("backup.key_template: %w", err)
+	}
+	return layout, nil
+}
+
+// newBackend opens a destination, with its key prefix and the key layout
+// applied. A write-only destination refuses to delete.
+func newBackend(cfg *config.Config, destination config.DestinationConfig, bandwidth *storage.Bandwidth, layout storage.KeyLayout) (storage.Backend, error) {
+	upload := storage.UploadOptions{
+		PartSize:    int64(cfg.Upload.PartSize),
+		Concurrency: cfg.Upload.Concurrency,
+		PartRetries: cfg.Upload.PartRetries,
+		StateDir:    cfg.Upload.StateDir,
+	}
+	retry := storage.RetryPolicy{
+		Attempts:  cfg.Retry.Attempts,
+		BaseDelay: cfg.Retry.BaseDelay,
+		MaxDelay:  cfg.Retry.MaxDelay,
+	}
+
+	var backend storage.Backend
+	var err error
+	switch destination.Type {
+	case config.DestinationLocal:
+		backend, err = storage.NewLocalBackend(destination.Path)
+	case config.DestinationSFTP:
+		sftp := destination.SFTP
+		backend, err = storage.NewSFTPBackend(storage.SFTPOptions{
+			Addr:           sftp.Host,
+			User:           sftp.User,
+			Password:       sftp.Password,
+			KeyFile:        sftp.KeyFile,
+			KeyPassphrase:  sftp.KeyPassphrase,
+			KnownHostsFile: sftp.KnownHosts,
+			Dir:            destination.Path,
+			Bandwidth:      bandwidth,
+		})
+		if err == nil {
+			// The SFTP client has no retries of its own
+			backend = storage.WithRetry(backend, retry)
+		}
+	case config.DestinationWebDAV:
+		webdav := destination.WebDAV
+		backend, err = storage.NewWebDAVBackend(storage.WebDAVOptions{
+			URL:                webdav.URL,
+			User:               webdav.User,
+			Password:           webdav.Password,
+			BearerToken:        webdav.BearerToken,
+			ChunkedUploadURL:   webdav.ChunkedUploadURL,
+			PartSize:           upload.PartSize,
+			CABundle:           webdav.CABundle,
+			InsecureSkipVerify: webdav.InsecureSkipVerify,
+			Bandwidth:          bandwidth,
+		})
+		if err == nil {
+			// Like SFTP, WebDAV requests are not retried by the client
+			backend = storage.WithRetry(backend, retry)
+		}
+	case config.DestinationS3:
+		s3 := destination.S3
+		backend, err = storage.NewS3Client(storage.S3Options{
+			Endpoint:           s3.Endpoint,
+			Region:             s3.Region,
+			Bucket:             s3.Bucket,
+			AccessKeyID:        s3.AccessKeyID,
+			SecretAccessKey:    s3.SecretKey,
+			PathStyle:          s3.PathStyle,
+			CABundle:           s3.CABundle,
+			InsecureSkipVerify: s3.InsecureSkipVerify,
+			PublicURL:          s3.PublicURL,
+			Upload:             upload,
+			Bandwidth:          bandwidth,
+			Retry:              retry,
+			ObjectLock: storage.ObjectLock{
+				Mode:      strings.ToUpper(destination.ObjectLock.Mode),
+				RetainFor: destination.ObjectLock.RetainFor,
+			},
+		})
+	default:
+		opts := storage.R2Options(
+			destination.CloudFlare.AccountID,
+			destination.CloudFlare.AccessKeyID,
+			destination.CloudFlare.SecretKey,
+			destination.CloudFlare.Bucket,
+			destination.CloudFlare.URI,
+			upload,
+		)
+		opts.Bandwidth = bandwidth
+		opts.Retry = retry
+		backend, err = storage.NewS3Client(opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open destination %s: %w", destination.Name, err)
+	}
+	backend = storage.WithKeyLayout(storage.WithPrefix(backend, destination.Prefix), layout)
+	if destination.WriteOnly {
+		backend = storage.WithWriteOnly(backend)
+	}
+	return backend, nil
+}
+
+// newDestinations opens every configured destination for the scheduler
+func newDestinations(cfg *config.Config) ([]scheduler.Destination, error) {
+	return openDestinations(cfg, cfg.Destinations, "")
+}
+
+// openDestinations opens destinations for the scheduler, to store the
+// backups of host. An empty host is this host.
+func openDestinations(cfg *config.Config, configs []config.DestinationConfig, host string) ([]scheduler.Destination, error) {
+	bandwidth := newBandwidth(cfg)
+	layout, err := newKeyLayout(cfg, host)
+	if err != nil {
+		return nil, err
+	}
+	destinations := make([]scheduler.Destination, len(configs))
+	for i, destination := range configs {
+		backend, err := newBackend(cfg, destination, bandwidth, layout)
+		if err != nil {
+			return nil, err
+		}
+		destinations[i] = scheduler.Destination{
+			Name:           destination.Name,
+			Backend:        backend,
+			RetentionLimit: destination.RetentionLimit,
+			BestEffort:     destination.Policy == config.PolicyBestEffort,
+			PresignExpiry:  destination.PresignExpiry,
+			WriteOnly:      destination.WriteOnly,
+			ObjectLocked:   destination.ObjectLock.RetainFor > 0,
+		}
+	}
+	return destinations, nil
+}
+
+// openDestination opens the destination called name, or the primary
+// destination when name is empty, to read the backups of host. An empty
+// host is this host.
+func openDestination(cfg *config.Config, name, host string) (storage.Backend, error) {
+	destination, err := findDestination(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := newKeyLayout(cfg, host)
+	if err != nil {
+		return nil, err
+	}
+	return newBackend(cfg, destination, newBandwidth(cfg), layout)
+}
+
+// findDestination returns the destination called name, or the primary
+// destination when name is empty
+func findDestination(cfg *config.Config, name string) (config.DestinationConfig, error) {
+	if name == "" {
+		return cfg.Destinations[0], nil
+	}
+	for _, destination := range cfg.Destinations {
+		if destination.Name == name {
+			return destination, nil
+		}
+	}
+	return config.DestinationConfig{}, fmt.Errorf("no destination named %q", name)
+}
+
+// newNotifier combines every configured notification method
+func newNotifier(cfg *config.Config) (notification.Notifier, error) {
+	var notifiers []notification.Notifier
+
+	if cfg.Discord.WebhookURL != "" {
+		notifiers = append(notifiers, notification.NewDiscordNotifier(cfg.Discord.WebhookURL))
+		log.Println("Discord notifier initialized")
+	}
+
+	if cfg.Telegram.BotToken != "" && cfg.Telegram.ChatID != "" {
+		notifiers = append(notifiers, notification.NewTelegramNotifier(cfg.Telegram.BotToken, cfg.Telegram.ChatID))
+		log.Println("Telegram notifier initialized")
+	}
+
+	if len(notifiers) == 0 {
+		return nil, fmt.Errorf("no notification methods configured")
+	}
+	return notification.NewMultiNotifier(notifiers...), nil
+}
+
+// decryptionKey loads the configured encryption key, if any. It is used
+// even when encryption is disabled so backups taken while it was enabled
+// can still be restored.
+func decryptionKey(cfg *config.Config) (*backup.Key, error) {
+	if cfg.Encryption.Key == "" && cfg.Encryption.KeyFile == "" {
+		return nil, nil
+	}
+
+	key, err := backup.LoadKey(cfg.Encryption.Key, cfg.Encryption.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// listBackups returns the archives that belong to prefix, oldest first
+func listBackups(ctx context.Context, backend storage.Backend, prefix string) ([]string, error) {
+	files, err := backend.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Name
+	}
+	return backup.FilterBackups(names, prefix), nil
+}
+
+// latestBackup returns the most recent archive for prefix
+func latestBackup(ctx context.Context, backend storage.Backend, prefix string) (string, error) {
+	backups, err := listBackups(ctx, backend, prefix)
+	if err != nil {
+		return "", err
+	}
+	if len(backups) == 0 {
+		return "", fmt.Errorf("no backups found with prefix %q", prefix)
+	}
+	return backups[len(backups)-1], nil
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BandwidthLimits caps the transfer rates to and from destinations. A zero
+// rate is unlimited.
+type BandwidthLimits struct {
+	MaxUploadRate   ByteRate `yaml:"max_upload_rate"`
+	MaxDownloadRate ByteRate `yaml:"max_download_rate"`
+}
+
+// BandwidthConfig limits the bandwidth of every destination together.
+// Profiles replace the limits during certain hours, such as business hours.
+type BandwidthConfig struct {
+	BandwidthLimits `yaml:",inline"`
+	Profiles        []BandwidthProfile `yaml:"profiles"`
+}
+
+// BandwidthProfile applies its limits from Start until End, local time
+type BandwidthProfile struct {
+	// Start and End are "15:04" times. A profile that ends before it starts
+	// runs past midnight.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// Days are the weekdays the profile starts on, such as "mon" or
+	// "friday". It defaults to every day.
+	Days            []string `yaml:"days"`
+	BandwidthLimits `yaml:",inline"`
+
+	start, end time.Duration
+	days       map[time.Weekday]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// Limits returns the limits in effect at now: those of the first profile
+// that covers it, or the default ones
+func (b BandwidthConfig) Limits(now time.Time) BandwidthLimits {
+	for _, profile := range b.Profiles {
+		if profile.covers(now) {
+			return profile.BandwidthLimits
+		}
+	}
+	return b.BandwidthLimits
+}
+
+// Limited reports whether any transfer can ever be throttled
+func (b BandwidthConfig) Limited() bool {
+	if b.BandwidthLimits != (BandwidthLimits{}) {
+		return true
+	}
+	for _, profile := range b.Profiles {
+		if profile.BandwidthLimits != (BandwidthLimits{}) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p BandwidthProfile) covers(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	elapsed := now.Sub(midnight)
+	day := now.Weekday()
+
+	if p.start < p.end {
+		return elapsed >= p.start && elapsed < p.end && p.on(day)
+	}
+	// Past midnight the profile belongs to the day it started on
+	if elapsed >= p.start {
+		return p.on(day)
+	}
+	return elapsed < p.end && p.on((day+6)%7)
+}
+
+func (p BandwidthProfile) on(day time.Weekday) bool {
+	return len(p.days) == 0 || p.days[day]
+}
+
+func (b *BandwidthConfig) validate() error {
+	for i := range b.Profiles {
+		if err := b.Profiles[i].validate(fmt.Sprintf("bandwidth.profiles[%d]", i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *BandwidthProfile) validate(field string) error {
+	var err error
+	if p.start, err = parseClock(p.Start); err != nil {
+		return fmt.Errorf("%s.start: %w", field, err)
+	}
+	if p.end, err = parseClock(p.End); err != nil {
+		return fmt.Errorf("%s.end: %w", field, err)
+	}
+	if p.start == p.end {
+		return fmt.Errorf("%s must not start and end at the same time", field)
+	}
+
+	p.days = make(map[time.Weekday]bool)
+	for _, name := range p.Days {
+		day, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("%s.days: unknown day %q", field, name)
+		}
+		p.days[day] = true
+	}
+	return nil
+}
+
+// parseClock returns how long after midnight a "15:04" time is
+func parseClock(value string) (time.Duration, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthProfiles(t *testing.T) {
+	cfg, err := parseConfig(t, `
+bandwidth:
+  max_upload_rate: 20MiB/s
+  profiles:
+    - start: "08:00"
+      end: "18:00"
+      days: [mon, tue, wed, thu, fri]
+      max_upload_rate: 2MiB/s
+      max_download_rate: 10MiB/s
+    - start: "22:00"
+      end: "06:00"
+      max_upload_rate: unlimited
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Bandwidth.Limited() {
+		t.Error("Expected the bandwidth to be limited")
+	}
+
+	// 2024-01-01 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name string
+		now  time.Time
+		want BandwidthLimits
+	}{
+		{"monday morning", at(1, 9, 30), BandwidthLimits{MaxUploadRate: 2 << 20, MaxDownloadRate: 10 << 20}},
+		{"end of business hours", at(1, 18, 0), BandwidthLimits{MaxUploadRate: 20 << 20}},
+		{"saturday morning", at(6, 9, 30), BandwidthLimits{MaxUploadRate: 20 << 20}},
+		{"before midnight", at(1, 23, 0), BandwidthLimits{}},
+		{"after midnight", at(2, 5, 59), BandwidthLimits{}},
+		{"early morning", at(2, 6, 0), BandwidthLimits{MaxUploadRate: 20 << 20}},
+	}
+	for _, test := range tests {
+		if got := cfg.Bandwidth.Limits(test.now); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBandwidthProfilePastMidnightKeepsItsDay(t *testing.T) {
+	cfg, err := parseConfig(t, `
+bandwidth:
+  profiles:
+    - start: "22:00"
+      end: "02:00"
+      days: [fri]
+      max_upload_rate: 1MiB/s
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Friday 2024-01-05 night runs into Saturday, but Thursday's does not
+	if got := cfg.Bandwidth.Limits(time.Date(2024, 1, 6, 1, 0, 0, 0, time.Local)); got.MaxUploadRate != 1<<20 {
+		t.Errorf("Expected Friday's profile after midnight, got %+v", got)
+	}
+	if got := cfg.Bandwidth.Limits(time.Date(2024, 1, 5, 1, 0, 0, 0, time.Local)); got.MaxUploadRate != 0 {
+		t.Errorf("Expected no profile early on Friday, got %+v", got)
+	}
+}
+
+func TestInvalidBandwidthProfiles(t *testing.T) {
+	tests := map[string]string{
+		"bad start": `
+bandwidth:
+  profiles:
+    - start: "8am"
+      end: "18:00"
+`,
+		"unknown day": `
+bandwidth:
+  profiles:
+    - start: "08:00"
+      end: "18:00"
+      days: [funday]
+`,
+		"empty window": `
+bandwidth:
+  profiles:
+    - start: "08:00"
+      end: "08:00"
+`,
+	}
+	for name, extra := range tests {
+		if _, err := parseConfig(t, extra); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -2,7 +2,12 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,6 +17,179 @@ type Config struct {
 	Discord    DiscordConfig    `yaml:"discord"`
 	Telegram   TelegramConfig   `yaml:"telegram"`
 	Backup     BackupConfig     `yaml:"backup"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	Upload     UploadConfig     `yaml:"upload"`
+	Bandwidth  BandwidthConfig  `yaml:"bandwidth"`
+	Retry      RetryConfig      `yaml:"retry"`
+	Cache      CacheConfig      `yaml:"cache"`
+	// Destination is a single destination. Validate moves it into
+	// Destinations, which code should use instead.
+	Destination DestinationConfig `yaml:"destination"`
+	// Destinations replicates every backup to several places. The first one
+	// is the primary destination incremental chains are tracked against.
+	Destinations []DestinationConfig `yaml:"destinations"`
+}
+
+// DestinationConfig selects a storage backend backups are written to
+type DestinationConfig struct {
+	// Name identifies the destination in logs, notifications and the
+	// -destination flag of commands. It defaults to the type.
+	Name string `yaml:"name"`
+	// Type is "r2" (default), "s3", "sftp", "webdav" or "local"
+	Type string `yaml:"type"`
+	// Path is the directory backups are stored in on a local destination,
+	// such as an NFS mount, or on an sftp destination's server
+	Path   string       `yaml:"path"`
+	S3     S3Config     `yaml:"s3"`
+	SFTP   SFTPConfig   `yaml:"sftp"`
+	WebDAV WebDAVConfig `yaml:"webdav"`
+	// CloudFlare holds the R2 account of an r2 destination. It defaults to
+	// the top-level cloudflare section.
+	CloudFlare CloudFlareConfig `yaml:"cloudflare"`
+	// Prefix is prepended to every key, such as "hosts/web1/"
+	Prefix string `yaml:"prefix"`
+	// RetentionLimit overrides backup.retention_limit; a negative value
+	// keeps every backup
+	RetentionLimit int `yaml:"retention_limit"`
+	// Policy is "required" (default), where a failed upload fails the
+	// backup, or "best_effort", where it is only reported
+	Policy string `yaml:"policy"`
+	// PresignExpiry, when set, links to backups in notifications with
+	// presigned URLs valid this long, for private buckets. Only r2 and s3
+	// destinations support it.
+	PresignExpiry time.Duration `yaml:"presign_expiry"`
+	// ObjectLock locks every object uploaded to an s3 destination until a
+	// retain-until date, so it cannot be deleted before then
+	ObjectLock ObjectLockConfig `yaml:"object_lock"`
+	// WriteOnly never deletes anything from the destination, leaving old
+	// backups to the bucket's lifecycle rules or the prune command
+	WriteOnly bool `yaml:"write_only"`
+	// Prune holds the credentials the prune command deletes old backups
+	// with, so the credentials the backups are written with need no
+	// delete permission. Only r2 and s3 destinations support it.
+	Prune PruneConfig `yaml:"prune"`
+}
+
+// ObjectLockConfig sets the S3 Object Lock retention of uploaded objects.
+// The bucket must have Object Lock enabled.
+type ObjectLockConfig struct {
+	// Mode is "governance" (default), which credentials allowed to bypass
+	// governance retention can lift, or "compliance", which nobody can
+	Mode string `yaml:"mode"`
+	// RetainFor is how long every object stays locked after its upload
+	RetainFor time.Duration `yaml:"retain_for"`
+}
+
+const (
+	ObjectLockGovernance = "governance"
+	ObjectLockCompliance = "compliance"
+)
+
+// PruneConfig is an access key of the destination's bucket that may delete
+type PruneConfig struct {
+	AccessKeyID string `yaml:"access_key_id"`
+	SecretKey   string `yaml:"secret_key"`
+}
+
+const (
+	DestinationR2     = "r2"
+	DestinationS3     = "s3"
+	DestinationSFTP   = "sftp"
+	DestinationWebDAV = "webdav"
+	DestinationLocal  = "local"
+)
+
+const (
+	PolicyRequired   = "required"
+	PolicyBestEffort = "best_effort"
+)
+
+// S3Config connects to any S3 compatible service, such as MinIO, Wasabi,
+// Backblaze B2 or Ceph
+type S3Config struct {
+	Endpoint    string `yaml:"endpoint"`
+	Region      string `yaml:"region"`
+	Bucket      string `yaml:"bucket"`
+	AccessKeyID string `yaml:"access_key_id"`
+	SecretKey   string `yaml:"secret_key"`
+	// PathStyle addresses buckets as <endpoint>/<bucket>, which MinIO and Ceph usually need
+	PathStyle bool `yaml:"path_style"`
+	// CABundle is a PEM file with the CA certificates of a private endpoint
+	CABundle           string `yaml:"ca_bundle"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// PublicURL is the base of links in notifications
+	PublicURL string `yaml:"public_url"`
+}
+
+// SFTPConfig connects to an SFTP server over SSH with a password, a
+// private key or both
+type SFTPConfig struct {
+	// Host is host or host:port; the port defaults to 22
+	Host          string `yaml:"host"`
+	User          string `yaml:"user"`
+	Password      string `yaml:"password"`
+	KeyFile       string `yaml:"key_file"`
+	KeyPassphrase string `yaml:"key_passphrase"`
+	// KnownHosts is the known_hosts file the server's host key is checked
+	// against. It defaults to ~/.ssh/known_hosts.
+	KnownHosts string `yaml:"known_hosts"`
+}
+
+// WebDAVConfig connects to a WebDAV share, such as a Nextcloud or ownCloud
+// folder, with basic auth or a bearer token
+type WebDAVConfig struct {
+	// URL is the folder backups are stored in, e.g.
+	// https://cloud.example.com/remote.php/dav/files/alice/backups
+	URL         string `yaml:"url"`
+	User        string `yaml:"user"`
+	Password    string `yaml:"password"`
+	BearerToken string `yaml:"bearer_token"`
+	// ChunkedUploadURL enables Nextcloud chunked uploads of archives larger
+	// than upload.part_size, e.g.
+	// https://cloud.example.com/remote.php/dav/uploads/alice
+	ChunkedUploadURL string `yaml:"chunked_upload_url"`
+	// CABundle is a PEM file with the CA certificates of a private server
+	CABundle           string `yaml:"ca_bundle"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// UploadConfig tunes multipart uploads. Files larger than one part are
+// uploaded in parts, in parallel, and an interrupted upload is resumed
+// from the parts recorded in StateDir.
+type UploadConfig struct {
+	PartSize    ByteSize `yaml:"part_size"`
+	Concurrency int      `yaml:"concurrency"`
+	PartRetries int      `yaml:"part_retries"`
+	StateDir    string   `yaml:"state_dir"`
+	// AbortStaleAfter aborts unfinished multipart uploads older than this on
+	// every run. It defaults to 24h; a negative value disables the sweep.
+	AbortStaleAfter time.Duration `yaml:"abort_stale_after"`
+}
+
+// RetryConfig controls how storage operations that fail with a transient
+// error, such as a server error, throttling or a dropped connection, are
+// retried. Errors that would fail again, such as bad credentials or a
+// missing bucket, never are.
+type RetryConfig struct {
+	// Attempts is the most tries per operation, including the first. It
+	// defaults to 5; 1 disables retries.
+	Attempts int `yaml:"attempts"`
+	// BaseDelay is the wait before the first retry, 1s by default. It
+	// doubles with every retry up to MaxDelay, 30s by default, with jitter.
+	BaseDelay time.Duration `yaml:"base_delay"`
+	MaxDelay  time.Duration `yaml:"max_delay"`
+}
+
+// CacheConfig keeps copies of the latest archives on local disk, so
+// restoring a recent backup does not need a download
+type CacheConfig struct {
+	// Dir enables the cache
+	Dir string `yaml:"dir"`
+	// MaxArchives is how many archives to keep and MaxSize how much space
+	// they may take together; zero is no limit. Without either, the last 3
+	// archives are kept.
+	MaxArchives int      `yaml:"max_archives"`
+	MaxSize     ByteSize `yaml:"max_size"`
 }
 
 type CloudFlareConfig struct {
@@ -31,11 +209,92 @@ type TelegramConfig struct {
 	ChatID   string `yaml:"chat_id"`
 }
 
+// FolderConfig is a folder to back up. In YAML it is either a plain path
+// or a mapping with its own exclude and include patterns.
+type FolderConfig struct {
+	Path    string   `yaml:"path"`
+	Exclude []string `yaml:"exclude"`
+	Include []string `yaml:"include"`
+}
+
+func (f *FolderConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&f.Path)
+	}
+	type plain FolderConfig
+	return value.Decode((*plain)(f))
+}
+
+// EncryptionConfig configures client-side encryption. The key is 32 bytes,
+// given inline or in a key file as raw bytes, hex or base64.
+type EncryptionConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Key     string `yaml:"key"`
+	KeyFile string `yaml:"key_file"`
+}
+
 type BackupConfig struct {
-	Schedule       string   `yaml:"schedule"`
-	Folders        []string `yaml:"folders"`
-	NamePrefix     string   `yaml:"name_prefix"`
-	RetentionLimit int      `yaml:"retention_limit"`
+	Schedule       string         `yaml:"schedule"`
+	Folders        []FolderConfig `yaml:"folders"`
+	NamePrefix     string         `yaml:"name_prefix"`
+	RetentionLimit int            `yaml:"retention_limit"`
+	// Exclude and Include patterns apply to every folder
+	Exclude     []string          `yaml:"exclude"`
+	Include     []string          `yaml:"include"`
+	Incremental IncrementalConfig `yaml:"incremental"`
+	// Streaming uploads the archive while it is created instead of writing it to a temporary file first
+	Streaming   bool              `yaml:"streaming"`
+	Compression CompressionConfig `yaml:"compression"`
+	// Mode is either "archive" (default) or "repository"
+	Mode       string           `yaml:"mode"`
+	Repository RepositoryConfig `yaml:"repository"`
+	// KeyTemplate places archives under keys such as
+	// {{.Host}}/{{.Job}}/{{.Year}}/{{.Month}}/{{.Name}}, so several hosts can
+	// share a bucket. Empty stores them at the root under their name.
+	KeyTemplate string `yaml:"key_template"`
+}
+
+const (
+	ModeArchive    = "archive"
+	ModeRepository = "repository"
+)
+
+// CompressionConfig selects how archives are compressed: gzip (default),
+// zstd, xz or none. A level of 0 uses the algorithm's default.
+type CompressionConfig struct {
+	Algorithm string `yaml:"algorithm"`
+	Level     int    `yaml:"level"`
+}
+
+// compressionLevels holds the highest level each algorithm accepts
+var compressionLevels = map[string]int{
+	"gzip": 9,
+	"zstd": 22,
+	"xz":   9,
+	"none": 0,
+}
+
+// UnmarshalYAML also accepts the algorithm name alone, as in "compression: zstd"
+func (c *CompressionConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&c.Algorithm)
+	}
+	type plain CompressionConfig
+	return value.Decode((*plain)(c))
+}
+
+// RepositoryConfig configures the deduplicated repository mode
+type RepositoryConfig struct {
+	// Path is the key prefix the repository is stored under in the bucket
+	Path string `yaml:"path"`
+}
+
+type IncrementalConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// FullEvery forces a full backup every N runs
+	FullEvery int `yaml:"full_every"`
+	// IndexDir is where the local copy of the file-state index is kept
+	IndexDir string `yaml:"index_dir"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -56,22 +315,202 @@ func LoadConfig(path string) (*Config, error) {
 	return &config, nil
 }
 
-func (c *Config) Validate() error {
-	if c.CloudFlare.URI == "" {
-		return fmt.Errorf("cloudflare.uri is required")
+func (c CloudFlareConfig) validate(field string) error {
+	if c.URI == "" {
+		return fmt.Errorf("%s.uri is required", field)
+	}
+	if c.Bucket == "" {
+		return fmt.Errorf("%s.bucket is required", field)
+	}
+	if c.AccessKeyID == "" {
+		return fmt.Errorf("%s.access_key_id is required", field)
+	}
+	if c.SecretKey == "" {
+		return fmt.Errorf("%s.secret_key is required", field)
+	}
+	if c.AccountID == "" {
+		return fmt.Errorf("%s.account_id is required", field)
+	}
+	return nil
+}
+
+func (c SFTPConfig) validate(field string) error {
+	if c.Host == "" {
+		return fmt.Errorf("%s.host is required", field)
+	}
+	if c.User == "" {
+		return fmt.Errorf("%s.user is required", field)
+	}
+	if c.Password == "" && c.KeyFile == "" {
+		return fmt.Errorf("%s.password or %s.key_file is required", field, field)
+	}
+	return nil
+}
+
+func (c WebDAVConfig) validate(field string) error {
+	if c.URL == "" {
+		return fmt.Errorf("%s.url is required", field)
+	}
+	if !isHTTPURL(c.URL) {
+		return fmt.Errorf("%s.url must be an http or https URL", field)
+	}
+	if c.ChunkedUploadURL != "" && !isHTTPURL(c.ChunkedUploadURL) {
+		return fmt.Errorf("%s.chunked_upload_url must be an http or https URL", field)
+	}
+	if c.BearerToken != "" && (c.User != "" || c.Password != "") {
+		return fmt.Errorf("only one of %s.user and %s.bearer_token may be set", field, field)
+	}
+	if c.Password != "" && c.User == "" {
+		return fmt.Errorf("%s.user is required with %s.password", field, field)
+	}
+	if c.CABundle != "" {
+		if _, err := os.Stat(c.CABundle); err != nil {
+			return fmt.Errorf("%s.ca_bundle: %w", field, err)
+		}
+	}
+	return nil
+}
+
+func isHTTPURL(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+func (c S3Config) validate(field string) error {
+	if c.Bucket == "" {
+		return fmt.Errorf("%s.bucket is required", field)
+	}
+	if c.AccessKeyID == "" {
+		return fmt.Errorf("%s.access_key_id is required", field)
+	}
+	if c.SecretKey == "" {
+		return fmt.Errorf("%s.secret_key is required", field)
+	}
+	if c.CABundle != "" {
+		if _, err := os.Stat(c.CABundle); err != nil {
+			return fmt.Errorf("%s.ca_bundle: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// validate checks a destination and fills in its defaults. field is its
+// name in the configuration file, used in errors.
+func (d *DestinationConfig) validate(field string, c *Config) error {
+	switch d.Type {
+	case "":
+		d.Type = DestinationR2
+	case DestinationR2, DestinationS3, DestinationSFTP, DestinationWebDAV, DestinationLocal:
+	default:
+		return fmt.Errorf("%s.type must be %q, %q, %q, %q or %q", field, DestinationR2, DestinationS3, DestinationSFTP, DestinationWebDAV, DestinationLocal)
+	}
+	switch d.Type {
+	case DestinationLocal:
+		if d.Path == "" {
+			return fmt.Errorf("%s.path is required for a local destination", field)
+		}
+	case DestinationS3:
+		if err := d.S3.validate(field + ".s3"); err != nil {
+			return err
+		}
+	case DestinationSFTP:
+		if d.Path == "" {
+			return fmt.Errorf("%s.path is required for an sftp destination", field)
+		}
+		if err := d.SFTP.validate(field + ".sftp"); err != nil {
+			return err
+		}
+	case DestinationWebDAV:
+		if err := d.WebDAV.validate(field + ".webdav"); err != nil {
+			return err
+		}
+	case DestinationR2:
+		if d.CloudFlare == (CloudFlareConfig{}) {
+			d.CloudFlare = c.CloudFlare
+			if err := d.CloudFlare.validate("cloudflare"); err != nil {
+				return err
+			}
+		} else if err := d.CloudFlare.validate(field + ".cloudflare"); err != nil {
+			return err
+		}
+	}
+	if d.Name == "" {
+		d.Name = d.Type
+	}
+	switch d.Policy {
+	case "":
+		d.Policy = PolicyRequired
+	case PolicyRequired, PolicyBestEffort:
+	default:
+		return fmt.Errorf("%s.policy must be %q or %q", field, PolicyRequired, PolicyBestEffort)
+	}
+	if d.RetentionLimit == 0 {
+		d.RetentionLimit = c.Backup.RetentionLimit
+	}
+	if d.PresignExpiry != 0 {
+		if d.Type != DestinationR2 && d.Type != DestinationS3 {
+			return fmt.Errorf("%s.presign_expiry is only supported by r2 and s3 destinations", field)
+		}
+		// SigV4 presigned URLs are valid for at most seven days
+		if d.PresignExpiry < time.Second || d.PresignExpiry > 7*24*time.Hour {
+			return fmt.Errorf("%s.presign_expiry must be between 1s and 168h", field)
+		}
 	}
-	if c.CloudFlare.Bucket == "" {
-		return fmt.Errorf("cloudflare.bucket is required")
+	if d.ObjectLock != (ObjectLockConfig{}) {
+		// R2 only has bucket-wide lock rules, set on the bucket itself
+		if d.Type != DestinationS3 {
+			return fmt.Errorf("%s.object_lock is only supported by s3 destinations", field)
+		}
+		switch d.ObjectLock.Mode {
+		case "":
+			d.ObjectLock.Mode = ObjectLockGovernance
+		case ObjectLockGovernance, ObjectLockCompliance:
+		default:
+			return fmt.Errorf("%s.object_lock.mode must be %q or %q", field, ObjectLockGovernance, ObjectLockCompliance)
+		}
+		if d.ObjectLock.RetainFor <= 0 {
+			return fmt.Errorf("%s.object_lock.retain_for is required", field)
+		}
 	}
-	if c.CloudFlare.AccessKeyID == "" {
-		return fmt.Errorf("cloudflare.access_key_id is required")
+	if d.Prune != (PruneConfig{}) {
+		if d.Type != DestinationR2 && d.Type != DestinationS3 {
+			return fmt.Errorf("%s.prune is only supported by r2 and s3 destinations", field)
+		}
+		if d.Prune.AccessKeyID == "" || d.Prune.SecretKey == "" {
+			return fmt.Errorf("%s.prune.access_key_id and %s.prune.secret_key are required", field, field)
+		}
 	}
-	if c.CloudFlare.SecretKey == "" {
-		return fmt.Errorf("cloudflare.secret_key is required")
+	return nil
+}
+
+func (c *Config) validateDestinations() error {
+	if len(c.Destinations) == 0 {
+		if err := c.Destination.validate("destination", c); err != nil {
+			return err
+		}
+		c.Destinations = []DestinationConfig{c.Destination}
+		c.Destination = DestinationConfig{}
+		return nil
+	}
+	if c.Destination != (DestinationConfig{}) {
+		return fmt.Errorf("only one of destination and destinations may be set")
 	}
-	if c.CloudFlare.AccountID == "" {
-		return fmt.Errorf("cloudflare.account_id is required")
+
+	names := make(map[string]bool)
+	for i := range c.Destinations {
+		destination := &c.Destinations[i]
+		if err := destination.validate(fmt.Sprintf("destinations[%d]", i), c); err != nil {
+			return err
+		}
+		if names[destination.Name] {
+			return fmt.Errorf("destinations[%d].name %q is used more than once", i, destination.Name)
+		}
+		names[destination.Name] = true
 	}
+	return nil
+}
+
+func (c *Config) Validate() error {
 	// At least one notification method must be configured
 	if c.Discord.WebhookURL == "" && c.Telegram.BotToken == "" {
 		return fmt.Errorf("at least one notification method (discord or telegram) must be configured")
@@ -86,8 +525,123 @@ func (c *Config) Validate() error {
 	if len(c.Backup.Folders) == 0 {
 		return fmt.Errorf("backup.folders must contain at least one folder")
 	}
+	for i, folder := range c.Backup.Folders {
+		if folder.Path == "" {
+			return fmt.Errorf("backup.folders[%d].path is required", i)
+		}
+	}
 	if c.Backup.NamePrefix == "" {
 		c.Backup.NamePrefix = "backup"
 	}
+	switch c.Backup.Mode {
+	case "":
+		c.Backup.Mode = ModeArchive
+	case ModeArchive, ModeRepository:
+	default:
+		return fmt.Errorf("backup.mode must be %q or %q", ModeArchive, ModeRepository)
+	}
+	if c.Backup.Mode == ModeRepository && c.Backup.Incremental.Enabled {
+		return fmt.Errorf("backup.incremental cannot be used with the repository mode, which is always deduplicated")
+	}
+	if c.Backup.KeyTemplate != "" {
+		if c.Backup.Mode == ModeRepository {
+			return fmt.Errorf("backup.key_template cannot be used with the repository mode, which is placed by backup.repository.path")
+		}
+		if _, err := template.New("key").Parse(c.Backup.KeyTemplate); err != nil {
+			return fmt.Errorf("backup.key_template is invalid: %w", err)
+		}
+		if !strings.HasSuffix(c.Backup.KeyTemplate, "{{.Name}}") {
+			return fmt.Errorf("backup.key_template must end with {{.Name}}")
+		}
+	}
+	if c.Backup.Repository.Path == "" {
+		c.Backup.Repository.Path = "repository"
+	}
+	if c.Backup.Compression.Algorithm == "" {
+		c.Backup.Compression.Algorithm = "gzip"
+	}
+	maxLevel, ok := compressionLevels[c.Backup.Compression.Algorithm]
+	if !ok {
+		return fmt.Errorf("backup.compression must be gzip, zstd, xz or none")
+	}
+	if c.Backup.Compression.Level < 0 || c.Backup.Compression.Level > maxLevel {
+		return fmt.Errorf("backup.compression.level for %s must be between 0 and %d", c.Backup.Compression.Algorithm, maxLevel)
+	}
+	if err := c.validateDestinations(); err != nil {
+		return err
+	}
+	if c.Encryption.Key != "" && c.Encryption.KeyFile != "" {
+		return fmt.Errorf("only one of encryption.key and encryption.key_file may be set")
+	}
+	if c.Encryption.Enabled && c.Encryption.Key == "" && c.Encryption.KeyFile == "" {
+		return fmt.Errorf("encryption.key or encryption.key_file is required when encryption is enabled")
+	}
+	if c.Upload.PartSize == 0 {
+		c.Upload.PartSize = 16 << 20
+	}
+	if c.Upload.PartSize < 5<<20 {
+		return fmt.Errorf("upload.part_size must be at least 5MiB")
+	}
+	if c.Upload.Concurrency <= 0 {
+		c.Upload.Concurrency = 4
+	}
+	if c.Upload.PartRetries < 0 {
+		return fmt.Errorf("upload.part_retries must not be negative")
+	}
+	if c.Upload.PartRetries == 0 {
+		c.Upload.PartRetries = 3
+	}
+	if c.Upload.StateDir == "" {
+		c.Upload.StateDir = filepath.Join(defaultStateDir(), "uploads")
+	}
+	if c.Upload.AbortStaleAfter == 0 {
+		c.Upload.AbortStaleAfter = 24 * time.Hour
+	}
+	if err := c.Bandwidth.validate(); err != nil {
+		return err
+	}
+	if c.Cache.Dir != "" {
+		if c.Backup.Mode == ModeRepository {
+			return fmt.Errorf("cache cannot be used with the repository mode, which has no archives")
+		}
+		if c.Cache.MaxArchives < 0 || c.Cache.MaxSize < 0 {
+			return fmt.Errorf("cache.max_archives and cache.max_size must not be negative")
+		}
+		if c.Cache.MaxArchives == 0 && c.Cache.MaxSize == 0 {
+			c.Cache.MaxArchives = 3
+		}
+	}
+	if c.Retry.Attempts < 0 || c.Retry.BaseDelay < 0 || c.Retry.MaxDelay < 0 {
+		return fmt.Errorf("retry.attempts, retry.base_delay and retry.max_delay must not be negative")
+	}
+	if c.Retry.Attempts == 0 {
+		c.Retry.Attempts = 5
+	}
+	if c.Retry.BaseDelay == 0 {
+		c.Retry.BaseDelay = time.Second
+	}
+	if c.Retry.MaxDelay == 0 {
+		c.Retry.MaxDelay = 30 * time.Second
+	}
+	if c.Retry.MaxDelay < c.Retry.BaseDelay {
+		return fmt.Errorf("retry.max_delay must not be shorter than retry.base_delay")
+	}
+	if c.Backup.Incremental.FullEvery < 0 {
+		return fmt.Errorf("backup.incremental.full_every must not be negative")
+	}
+	if c.Backup.Incremental.FullEvery == 0 {
+		c.Backup.Incremental.FullEvery = 7
+	}
+	if c.Backup.Incremental.IndexDir == "" {
+		c.Backup.Incremental.IndexDir = defaultStateDir()
+	}
 	return nil
 }
+
+// defaultStateDir returns the directory used for local state such as the incremental index
+func defaultStateDir() string {
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(cacheDir, "cloudflare-backuper")
+	}
+	return filepath.Join(os.TempDir(), "cloudflare-backuper")
+}
@@ -0,0 +1,296 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const baseConfig = `
+cloudflare:
+  uri: "https://backups.example.com"
+  bucket: "backups"
+  access_key_id: "id"
+  secret_key: "secret"
+  account_id: "account"
+discord:
+  webhook_url: "https://discord.invalid/webhook"
+backup:
+  schedule: "@daily"
+  folders: ["/data"]
+  retention_limit: 5
+`
+
+func parseConfig(t *testing.T, extra string) (*Config, error) {
+	t.Helper()
+	var cfg Config
+	if err := yaml.Unmarshal([]byte(baseConfig+extra), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	return &cfg, cfg.Validate()
+}
+
+func TestSingleDestination(t *testing.T) {
+	cfg, err := parseConfig(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Destinations) != 1 {
+		t.Fatalf("Expected one destination, got %+v", cfg.Destinations)
+	}
+	destination := cfg.Destinations[0]
+	if destination.Name != DestinationR2 || destination.Policy != PolicyRequired || destination.RetentionLimit != 5 {
+		t.Errorf("Unexpected defaults %+v", destination)
+	}
+	if destination.CloudFlare.Bucket != "backups" {
+		t.Errorf("Expected the cloudflare section to be used, got %+v", destination.CloudFlare)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validating twice failed: %v", err)
+	}
+}
+
+func TestMultipleDestinations(t *testing.T) {
+	cfg, err := parseConfig(t, `
+destinations:
+  - type: r2
+    presign_expiry: 24h
+  - name: nas
+    type: local
+    path: /mnt/nas
+    prefix: hosts/web1/
+    retention_limit: -1
+    policy: best_effort
+  - name: offsite
+    type: r2
+    cloudflare:
+      uri: "https://offsite.example.com"
+      bucket: "offsite"
+      access_key_id: "id2"
+      secret_key: "secret2"
+      account_id: "account2"
+  - type: sftp
+    path: /srv/backups
+    sftp:
+      host: backup.example.com
+      user: backup
+      key_file: /etc/backuper/id_ed25519
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Destinations) != 4 {
+		t.Fatalf("Expected four destinations, got %+v", cfg.Destinations)
+	}
+	if expiry := cfg.Destinations[0].PresignExpiry; expiry != 24*time.Hour {
+		t.Errorf("Expected links valid for 24h, got %s", expiry)
+	}
+	nas := cfg.Destinations[1]
+	if nas.Policy != PolicyBestEffort || nas.RetentionLimit != -1 || nas.Prefix != "hosts/web1/" {
+		t.Errorf("Unexpected nas destination %+v", nas)
+	}
+	if offsite := cfg.Destinations[2]; offsite.CloudFlare.Bucket != "offsite" {
+		t.Errorf("Expected the offsite account to be kept, got %+v", offsite.CloudFlare)
+	}
+}
+
+func TestInvalidDestinations(t *testing.T) {
+	tests := map[string]string{
+		"duplicate name": `
+destinations:
+  - type: r2
+  - type: r2
+`,
+		"unknown policy": `
+destinations:
+  - type: r2
+    policy: sometimes
+`,
+		"missing path": `
+destinations:
+  - type: local
+`,
+		"sftp without credentials": `
+destinations:
+  - type: sftp
+    path: /srv/backups
+    sftp:
+      host: backup.example.com
+      user: backup
+`,
+		"presigned local links": `
+destinations:
+  - type: local
+    path: /mnt/nas
+    presign_expiry: 1h
+`,
+		"presign expiry too long": `
+destinations:
+  - type: r2
+    presign_expiry: 200h
+`,
+		"both forms": `
+destination:
+  type: r2
+destinations:
+  - type: r2
+`,
+	}
+	for name, extra := range tests {
+		if _, err := parseConfig(t, extra); err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if name == "missing path" && !strings.Contains(err.Error(), "destinations[0].path") {
+			t.Errorf("%s: error %q does not name the field", name, err)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	cfg, err := parseConfig(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Retry != (RetryConfig{Attempts: 5, BaseDelay: time.Second, MaxDelay: 30 * time.Second}) {
+		t.Errorf("Unexpected retry defaults %+v", cfg.Retry)
+	}
+
+	cfg, err = parseConfig(t, `
+retry:
+  attempts: 1
+  base_delay: 2s
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Retry.Attempts != 1 || cfg.Retry.BaseDelay != 2*time.Second {
+		t.Errorf("Unexpected retry settings %+v", cfg.Retry)
+	}
+
+	for _, extra := range []string{"retry:\n  attempts: -1\n", "retry:\n  base_delay: 1m\n  max_delay: 10s\n"} {
+		if _, err := parseConfig(t, extra); err == nil {
+			t.Errorf("Expected %q to be rejected", extra)
+		}
+	}
+}
+
+func TestKeyTemplate(t *testing.T) {
+	cfg, err := parseConfig(t, `
+  key_template: "{{.Host}}/{{.Job}}/{{.Year}}/{{.Month}}/{{.Name}}"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Backup.KeyTemplate == "" {
+		t.Error("Expected the key template to be kept")
+	}
+
+	for name, extra := range map[string]string{
+		"name not last":   "  key_template: \"{{.Name}}/{{.Host}}\"\n",
+		"unparsable":      "  key_template: \"{{.Host}/{{.Name}}\"\n",
+		"repository mode": "  key_template: \"{{.Host}}/{{.Name}}\"\n  mode: repository\n",
+	} {
+		if _, err := parseConfig(t, extra); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	cfg, err := parseConfig(t, "cache:\n  dir: /var/cache/backups\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Cache.MaxArchives != 3 || cfg.Cache.MaxSize != 0 {
+		t.Errorf("Unexpected cache defaults %+v", cfg.Cache)
+	}
+
+	cfg, err = parseConfig(t, "cache:\n  dir: /var/cache/backups\n  max_size: 10GiB\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Cache.MaxArchives != 0 || cfg.Cache.MaxSize != 10<<30 {
+		t.Errorf("Expected only the size limit, got %+v", cfg.Cache)
+	}
+
+	for name, extra := range map[string]string{
+		"negative":        "cache:\n  dir: /var/cache/backups\n  max_archives: -1\n",
+		"repository mode": "  mode: repository\ncache:\n  dir: /var/cache/backups\n",
+	} {
+		if _, err := parseConfig(t, extra); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestObjectLockAndPrune(t *testing.T) {
+	cfg, err := parseConfig(t, `
+destinations:
+  - type: s3
+    write_only: true
+    s3:
+      bucket: backups
+      access_key_id: writer
+      secret_key: secret
+    object_lock:
+      retain_for: 720h
+    prune:
+      access_key_id: pruner
+      secret_key: secret
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := cfg.Destinations[0]
+	if destination.ObjectLock.Mode != ObjectLockGovernance || destination.ObjectLock.RetainFor != 720*time.Hour {
+		t.Errorf("Unexpected object lock %+v", destination.ObjectLock)
+	}
+	if !destination.WriteOnly || destination.Prune.AccessKeyID != "pruner" {
+		t.Errorf("Unexpected destination %+v", destination)
+	}
+
+	s3 := "destination:\n  type: s3\n  s3:\n    bucket: backups\n    access_key_id: id\n    secret_key: secret\n"
+	for name, extra := range map[string]string{
+		"r2 object lock":    "destination:\n  object_lock:\n    retain_for: 24h\n",
+		"unknown mode":      s3 + "  object_lock:\n    mode: strict\n    retain_for: 24h\n",
+		"no retention":      s3 + "  object_lock:\n    mode: compliance\n",
+		"local prune":       "destination:\n  type: local\n  path: /mnt/nas\n  prune:\n    access_key_id: id\n    secret_key: secret\n",
+		"prune without key": s3 + "  prune:\n    access_key_id: id\n",
+		"sftp object lock":  "destination:\n  type: sftp\n  path: /srv\n  sftp:\n    host: h\n    user: u\n    password: p\n  object_lock:\n    retain_for: 24h\n",
+	} {
+		if _, err := parseConfig(t, extra); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestWebDAVDestination(t *testing.T) {
+	cfg, err := parseConfig(t, `
+destination:
+  type: webdav
+  webdav:
+    url: https://cloud.example.com/remote.php/dav/files/alice/backups
+    user: alice
+    password: secret
+    chunked_upload_url: https://cloud.example.com/remote.php/dav/uploads/alice
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if destination := cfg.Destinations[0]; destination.Name != DestinationWebDAV || destination.WebDAV.User != "alice" {
+		t.Errorf("Unexpected destination %+v", destination)
+	}
+
+	for name, webdav := range map[string]string{
+		"missing url":       "    user: alice\n",
+		"relative url":      "    url: /remote.php/dav/files/alice\n",
+		"bad chunk url":     "    url: https://cloud.example.com/dav\n    chunked_upload_url: ftp://cloud.example.com/uploads\n",
+		"both auth methods": "    url: https://cloud.example.com/dav\n    user: alice\n    bearer_token: token\n",
+		"password alone":    "    url: https://cloud.example.com/dav\n    password: secret\n",
+	} {
+		if _, err := parseConfig(t, "destination:\n  type: webdav\n  webdav:\n"+webdav); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a number of bytes. In YAML it is either a plain number or a
+// number with a unit, such as "16MiB", "500MB" or "2GB".
+type ByteSize int64
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1000,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1000 * 1000,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1000 * 1000 * 1000,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"tib": 1 << 40,
+}
+
+func ParseByteSize(value string) (ByteSize, error) {
+	value = strings.TrimSpace(value)
+	split := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if split < 0 {
+		split = len(value)
+	}
+
+	number, err := strconv.ParseFloat(value[:split], 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	multiplier, ok := byteUnits[strings.ToLower(strings.TrimSpace(value[split:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", value)
+	}
+	return ByteSize(number * float64(multiplier)), nil
+}
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// ByteRate is a number of bytes per second, written as a size followed by
+// "/s", such as "20MiB/s". Zero means unlimited.
+type ByteRate int64
+
+func ParseByteRate(value string) (ByteRate, error) {
+	trimmed := strings.TrimSpace(value)
+	if strings.EqualFold(trimmed, "unlimited") {
+		return 0, nil
+	}
+	size, ok := strings.CutSuffix(trimmed, "/s")
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q, expected a size per second such as 20MiB/s", value)
+	}
+	bytes, err := ParseByteSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: %w", value, err)
+	}
+	return ByteRate(bytes), nil
+}
+
+func (r *ByteRate) UnmarshalYAML(value *yaml.Node) error {
+	rate, err := ParseByteRate(value.Value)
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
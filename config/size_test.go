@@ -0,0 +1,51 @@
+package config
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := map[string]ByteSize{
+		"1024":   1024,
+		"16MiB":  16 << 20,
+		"16 MiB": 16 << 20,
+		"5mb":    5000000,
+		"1.5GiB": 3 << 29,
+		"2G":     2 << 30,
+	}
+	for input, want := range tests {
+		got, err := ParseByteSize(input)
+		if err != nil {
+			t.Errorf("ParseByteSize(%q) failed: %v", input, err)
+		} else if got != want {
+			t.Errorf("ParseByteSize(%q) = %d, want %d", input, got, want)
+		}
+	}
+
+	for _, input := range []string{"", "MiB", "-1", "12 parsecs"} {
+		if _, err := ParseByteSize(input); err == nil {
+			t.Errorf("ParseByteSize(%q) should fail", input)
+		}
+	}
+}
+
+func TestParseByteRate(t *testing.T) {
+	tests := map[string]ByteRate{
+		"20MiB/s":   20 << 20,
+		"512 KB/s":  512000,
+		"0/s":       0,
+		"unlimited": 0,
+	}
+	for input, want := range tests {
+		got, err := ParseByteRate(input)
+		if err != nil {
+			t.Errorf("ParseByteRate(%q) failed: %v", input, err)
+		} else if got != want {
+			t.Errorf("ParseByteRate(%q) = %d, want %d", input, got, want)
+		}
+	}
+
+	for _, input := range []string{"20MiB", "/s", "fast/s"} {
+		if _, err := ParseByteRate(input); err == nil {
+			t.Errorf("ParseByteRate(%q) should fail", input)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/backup"
+	"github.com/IndrajeethY/CloudFlareBackuper/config"
+	"github.com/IndrajeethY/CloudFlareBackuper/storage"
+)
+
+func runList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	configPath := flags.String("config", "config.yml", "Path to configuration file")
+	prefix := flags.String("prefix", "", "Name prefix of the backups to list (defaults to backup.name_prefix)")
+	host := flags.String("host", "", "Host whose backups to read when backup.key_template uses {{.Host}} (defaults to this host)")
+	destination := flags.String("destination", "", "Destination to read from (defaults to the first one)")
+	flags.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if cfg.Backup.Mode == config.ModeRepository {
+		return fmt.Errorf("list shows archives; repository snapshots are not supported")
+	}
+
+	backend, err := openDestination(cfg, *destination, *host)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *prefix == "" {
+		*prefix = cfg.Backup.NamePrefix
+	}
+
+	backups, err := listBackups(ctx, backend, *prefix)
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tDATE\tSIZE\tHOST\tJOB\tFILES\tUNCOMPRESSED\tCOMPRESSION\tENCRYPTION\tVERSION\tFOLDERS\tLOCKED UNTIL")
+	for _, name := range backups {
+		// Metadata is only returned by a HEAD request, not by the listing
+		info, err := backend.Stat(ctx, name)
+		if err != nil {
+			return err
+		}
+		metadata, _ := backup.ParseMetadata(info.Metadata)
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			name,
+			info.LastModified.Local().Format(time.DateTime),
+			info.Size,
+			orDash(metadata.Host),
+			orDash(metadata.Job),
+			orDash(count(int64(metadata.Files))),
+			orDash(count(metadata.UncompressedSize)),
+			orDash(string(metadata.Compression)),
+			orDash(metadata.Encryption),
+			orDash(metadata.Version),
+			orDash(strings.Join(metadata.Folders, ",")),
+			orDash(retainUntil(info.RetainUntil)),
+		)
+	}
+	return table.Flush()
+}
+
+// logOrigin logs where a backup came from, as recorded in its metadata
+func logOrigin(ctx context.Context, backend storage.Backend, name string) {
+	info, err := backend.Stat(ctx, name)
+	if err != nil {
+		log.Printf("Failed to read metadata of %s: %v", name, err)
+		return
+	}
+	metadata, ok := backup.ParseMetadata(info.Metadata)
+	if !ok {
+		return
+	}
+	log.Printf("%s was taken by %s on %s (version %s) from %s",
+		name, orDash(metadata.Job), orDash(metadata.Host), orDash(metadata.Version), orDash(strings.Join(metadata.Folders, ", ")))
+	if metadata.Files >= 0 {
+		log.Printf("It holds %d file(s), %d bytes uncompressed", metadata.Files, metadata.UncompressedSize)
+	}
+}
+
+// retainUntil formats when an object's Object Lock expires, which is
+// zero for objects that are not locked
+func retainUntil(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+// count formats a count that is -1 when unknown
+func count(n int64) string {
+	if n < 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -8,10 +8,9 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/IndrajeethY/CloudFlareBackuper/backup"
 	"github.com/IndrajeethY/CloudFlareBackuper/config"
-	"github.com/IndrajeethY/CloudFlareBackuper/notification"
 	"github.com/IndrajeethY/CloudFlareBackuper/scheduler"
-	"github.com/IndrajeethY/CloudFlareBackuper/storage"
 )
 
 var (
@@ -21,6 +20,16 @@ var (
 )
 
 func main() {
+	scheduler.Version = version
+
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatalf("%s failed: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
 
 	configPath := flag.String("config", "config.yml", "Path to configuration file")
 	runOnce := flag.Bool("once", false, "Run backup once and exit")
@@ -41,40 +50,28 @@ func main() {
 	}
 	log.Println("Configuration loaded successfully")
 
-	r2Client, err := storage.NewR2Client(
-		cfg.CloudFlare.AccountID,
-		cfg.CloudFlare.AccessKeyID,
-		cfg.CloudFlare.SecretKey,
-		cfg.CloudFlare.Bucket,
-		cfg.CloudFlare.URI,
-	)
-	if err != nil {
-		log.Fatalf("Failed to initialize R2 client: %v", err)
+	if cfg.Encryption.Enabled {
+		key, err := backup.LoadKey(cfg.Encryption.Key, cfg.Encryption.KeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load encryption key: %v", err)
+		}
+		log.Printf("Client-side encryption enabled (key %s)", key.ID())
 	}
-	log.Println("CloudFlare R2 client initialized")
-
-	// Initialize notifiers based on configuration
-	var notifiers []notification.Notifier
 
-	if cfg.Discord.WebhookURL != "" {
-		discordNotifier := notification.NewDiscordNotifier(cfg.Discord.WebhookURL)
-		notifiers = append(notifiers, discordNotifier)
-		log.Println("Discord notifier initialized")
+	destinations, err := newDestinations(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open destinations: %v", err)
 	}
-
-	if cfg.Telegram.BotToken != "" && cfg.Telegram.ChatID != "" {
-		telegramNotifier := notification.NewTelegramNotifier(cfg.Telegram.BotToken, cfg.Telegram.ChatID)
-		notifiers = append(notifiers, telegramNotifier)
-		log.Println("Telegram notifier initialized")
+	for _, destination := range cfg.Destinations {
+		log.Printf("Destination initialized: %s (%s, %s)", destination.Name, destination.Type, destination.Policy)
 	}
 
-	if len(notifiers) == 0 {
-		log.Fatalf("No notification methods configured")
+	notifier, err := newNotifier(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize notifications: %v", err)
 	}
 
-	notifier := notification.NewMultiNotifier(notifiers...)
-
-	backupScheduler := scheduler.NewBackupScheduler(cfg, r2Client, notifier)
+	backupScheduler := scheduler.NewBackupScheduler(cfg, destinations, notifier)
 
 	if *runOnce {
 		log.Println("Running backup once...")
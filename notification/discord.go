@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"time"
+	"unicode/utf8"
 )
 
 type DiscordNotifier struct {
@@ -37,29 +38,57 @@ type DiscordEmbedField struct {
 	Inline bool   `json:"inline,omitempty"`
 }
 
-func (d *DiscordNotifier) SendBackupSuccess(fileName, fileURL string, fileSize int64) error {
+func (d *DiscordNotifier) SendBackupSuccess(result BackupResult) error {
+	fields := []DiscordEmbedField{
+		{
+			Name:   "File Name",
+			Value:  result.FileName,
+			Inline: false,
+		},
+		{
+			Name:   "File Size",
+			Value:  formatFileSize(result.FileSize),
+			Inline: true,
+		},
+	}
+	if result.Checksum != "" {
+		fields = append(fields, DiscordEmbedField{
+			Name:   "SHA-256",
+			Value:  fmt.Sprintf("`%s`", result.Checksum),
+			Inline: false,
+		})
+	}
+	if result.Retries > 0 {
+		fields = append(fields, DiscordEmbedField{
+			Name:   "Retries",
+			Value:  fmt.Sprintf("%d", result.Retries),
+			Inline: true,
+		})
+	}
+	if len(result.Destinations) > 1 {
+		fields = append(fields, DiscordEmbedField{
+			Name:   "Destinations",
+			Value:  truncate(result.destinationSummary(), 1000),
+			Inline: false,
+		})
+	}
+	fields = append(fields, DiscordEmbedField{
+		Name:   "Download Link",
+		Value:  fmt.Sprintf("[Click here to download](%s)%s", result.FileURL, result.linkExpiry()),
+		Inline: false,
+	})
+
 	embed := DiscordEmbed{
 		Title:       "✅ Backup Successful",
 		Description: "A new backup has been created and uploaded successfully!",
 		Color:       3066993,
-		Fields: []DiscordEmbedField{
-			{
-				Name:   "File Name",
-				Value:  fileName,
-				Inline: false,
-			},
-			{
-				Name:   "File Size",
-				Value:  formatFileSize(fileSize),
-				Inline: true,
-			},
-			{
-				Name:   "Download Link",
-				Value:  fmt.Sprintf("[Click here to download](%s)", fileURL),
-				Inline: false,
-			},
-		},
-		Timestamp: time.Now().Format(time.RFC3339),
+		Fields:      fields,
+		Timestamp:   time.Now().Format(time.RFC3339),
+	}
+	if failed := result.failedDestinations(); failed > 0 {
+		embed.Title = "⚠️ Backup Partially Replicated"
+		embed.Description = fmt.Sprintf("The backup was created, but %d of %d destination(s) could not be reached.", failed, len(result.Destinations))
+		embed.Color = 16776960
 	}
 
 	message := DiscordMessage{
@@ -118,6 +147,50 @@ func (d *DiscordNotifier) SendBackupDeletion(fileName, fileURL string) error {
 	return d.sendMessage(message)
 }
 
+func (d *DiscordNotifier) SendVerifyResult(result VerifyResult) error {
+	fields := []DiscordEmbedField{
+		{
+			Name:   "File Name",
+			Value:  result.FileName,
+			Inline: false,
+		},
+		{
+			Name:   "Entries",
+			Value:  fmt.Sprintf("%d", result.Entries),
+			Inline: true,
+		},
+		{
+			Name:   "Data Checked",
+			Value:  formatFileSize(result.Bytes),
+			Inline: true,
+		},
+	}
+
+	embed := DiscordEmbed{
+		Title:       "🔍 Backup Verified",
+		Description: "The backup was downloaded and every entry matches its manifest.",
+		Color:       3066993,
+		Timestamp:   time.Now().Format(time.RFC3339),
+	}
+	if !result.OK() {
+		embed.Title = "⚠️ Backup Verification Failed"
+		embed.Description = fmt.Sprintf("%d problem(s) were found in the backup.", len(result.Problems))
+		embed.Color = 15158332
+		fields = append(fields, DiscordEmbedField{
+			Name:   "Problems",
+			Value:  fmt.Sprintf("```\n%s\n```", truncate(result.problemSummary(), 1000)),
+			Inline: false,
+		})
+	}
+	embed.Fields = fields
+
+	message := DiscordMessage{
+		Embeds: []DiscordEmbed{embed},
+	}
+
+	return d.sendMessage(message)
+}
+
 func (d *DiscordNotifier) sendMessage(message DiscordMessage) error {
 	payload, err := json.Marshal(message)
 	if err != nil {
@@ -149,3 +222,16 @@ func formatFileSize(size int64) string {
 	}
 	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
 }
+
+// truncate shortens text to fit the length limits of chat messages,
+// without splitting a multi-byte character
+func truncate(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	cut := limit - 3
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "..."
+}
@@ -16,10 +16,10 @@ func NewMultiNotifier(notifiers ...Notifier) *MultiNotifier {
 	}
 }
 
-func (m *MultiNotifier) SendBackupSuccess(fileName, fileURL string, fileSize int64) error {
+func (m *MultiNotifier) SendBackupSuccess(result BackupResult) error {
 	var lastErr error
 	for _, notifier := range m.notifiers {
-		if err := notifier.SendBackupSuccess(fileName, fileURL, fileSize); err != nil {
+		if err := notifier.SendBackupSuccess(result); err != nil {
 			log.Printf("Failed to send success notification: %v", err)
 			lastErr = err
 		}
@@ -48,3 +48,14 @@ func (m *MultiNotifier) SendBackupDeletion(fileName, fileURL string) error {
 	}
 	return lastErr
 }
+
+func (m *MultiNotifier) SendVerifyResult(result VerifyResult) error {
+	var lastErr error
+	for _, notifier := range m.notifiers {
+		if err := notifier.SendVerifyResult(result); err != nil {
+			log.Printf("Failed to send verification notification: %v", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -2,7 +2,11 @@ package notification
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 // TestNotifierInterface verifies that all notifiers implement the Notifier interface
@@ -26,7 +30,11 @@ func TestMultiNotifier(t *testing.T) {
 	multi := NewMultiNotifier(mock1, mock2)
 
 	// Test SendBackupSuccess
-	err := multi.SendBackupSuccess("test.tar.gz", "http://example.com/test.tar.gz", 1024)
+	err := multi.SendBackupSuccess(BackupResult{
+		FileName: "test.tar.gz",
+		FileURL:  "http://example.com/test.tar.gz",
+		FileSize: 1024,
+	})
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -61,6 +69,70 @@ func TestMultiNotifier(t *testing.T) {
 	if !mock2.deletionCalled {
 		t.Error("Expected mock2.SendBackupDeletion to be called")
 	}
+
+	// Test SendVerifyResult
+	err = multi.SendVerifyResult(VerifyResult{FileName: "test.tar.gz", Problems: []string{"missing: /data/a.txt"}})
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if !mock1.verifyCalled {
+		t.Error("Expected mock1.SendVerifyResult to be called")
+	}
+	if !mock2.verifyCalled {
+		t.Error("Expected mock2.SendVerifyResult to be called")
+	}
+}
+
+// TestVerifyProblemSummary verifies that long problem lists are shortened
+func TestVerifyProblemSummary(t *testing.T) {
+	result := VerifyResult{}
+	for i := 0; i < 15; i++ {
+		result.Problems = append(result.Problems, fmt.Sprintf("corrupted: /data/%d", i))
+	}
+	summary := result.problemSummary()
+	if !strings.HasSuffix(summary, "... and 5 more") || strings.Count(summary, "\n") != 10 {
+		t.Errorf("Unexpected summary:\n%s", summary)
+	}
+	if result.OK() {
+		t.Error("Expected a result with problems not to be OK")
+	}
+}
+
+// TestDestinationSummary verifies that each destination is reported with its outcome
+func TestDestinationSummary(t *testing.T) {
+	result := BackupResult{Destinations: []DestinationResult{
+		{Name: "r2", URL: "https://backups.example.com/a.tar.gz", Retries: 2},
+		{Name: "nas", Err: errors.New("disk full")},
+	}}
+	if failed := result.failedDestinations(); failed != 1 {
+		t.Errorf("Expected 1 failed destination, got %d", failed)
+	}
+	if summary := result.destinationSummary(); summary != "✅ r2 (2 retries)\n⚠️ nas: `disk full`" {
+		t.Errorf("Unexpected summary:\n%s", summary)
+	}
+}
+
+// TestLinkExpiry verifies that only presigned links mention when they expire
+func TestLinkExpiry(t *testing.T) {
+	if expiry := (BackupResult{}).linkExpiry(); expiry != "" {
+		t.Errorf("Expected no expiry for a permanent link, got %q", expiry)
+	}
+	result := BackupResult{LinkExpires: time.Date(2024, 1, 2, 6, 0, 0, 0, time.UTC)}
+	if expiry := result.linkExpiry(); expiry != " (expires 2024-01-02 06:00 UTC)" {
+		t.Errorf("Unexpected expiry %q", expiry)
+	}
+}
+
+// TestTruncate verifies that text is cut at a character boundary
+func TestTruncate(t *testing.T) {
+	if got := truncate("short", 10); got != "short" {
+		t.Errorf("Expected short text to be kept, got %q", got)
+	}
+	// The limit falls inside the three bytes of ✅
+	got := truncate("abcd✅ nas", 8)
+	if got != "abcd..." || !utf8.ValidString(got) {
+		t.Errorf("Expected the cut before ✅, got %q", got)
+	}
 }
 
 // mockNotifier is a mock implementation of Notifier for testing
@@ -68,9 +140,10 @@ type mockNotifier struct {
 	successCalled  bool
 	failureCalled  bool
 	deletionCalled bool
+	verifyCalled   bool
 }
 
-func (m *mockNotifier) SendBackupSuccess(fileName, fileURL string, fileSize int64) error {
+func (m *mockNotifier) SendBackupSuccess(result BackupResult) error {
 	m.successCalled = true
 	return nil
 }
@@ -84,3 +157,8 @@ func (m *mockNotifier) SendBackupDeletion(fileName, fileURL string) error {
 	m.deletionCalled = true
 	return nil
 }
+
+func (m *mockNotifier) SendVerifyResult(result VerifyResult) error {
+	m.verifyCalled = true
+	return nil
+}
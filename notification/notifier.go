@@ -1,8 +1,109 @@
 package notification
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BackupResult describes a completed backup
+type BackupResult struct {
+	FileName string
+	FileURL  string
+	// LinkExpires is when a presigned FileURL stops working. It is zero
+	// for permanent links.
+	LinkExpires time.Time
+	FileSize    int64
+	// Checksum is the hex encoded SHA-256 of the uploaded backup, if known
+	Checksum string
+	// Retries is how many failed storage operations were retried during
+	// the run, on every destination together
+	Retries int
+	// Destinations reports the upload to each destination when the backup
+	// is replicated to more than one
+	Destinations []DestinationResult
+}
+
+// DestinationResult is the outcome of uploading a backup to one destination
+type DestinationResult struct {
+	Name string
+	URL  string
+	// Err is why the upload failed, or nil
+	Err error
+	// Retries is how many failed operations on this destination were retried
+	Retries int
+}
+
+// failedDestinations counts the destinations the backup did not reach
+func (r BackupResult) failedDestinations() int {
+	failed := 0
+	for _, destination := range r.Destinations {
+		if destination.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// linkExpiry describes when the download link stops working, or returns
+// an empty string for permanent links
+func (r BackupResult) linkExpiry() string {
+	if r.LinkExpires.IsZero() {
+		return ""
+	}
+	return " (expires " + r.LinkExpires.UTC().Format("2006-01-02 15:04 UTC") + ")"
+}
+
+// destinationSummary lists every destination with the outcome of its upload
+func (r BackupResult) destinationSummary() string {
+	lines := make([]string, len(r.Destinations))
+	for i, destination := range r.Destinations {
+		if destination.Err != nil {
+			lines[i] = fmt.Sprintf("⚠️ %s: `%v`", destination.Name, destination.Err)
+		} else {
+			lines[i] = fmt.Sprintf("✅ %s", destination.Name)
+		}
+		if destination.Retries > 0 {
+			lines[i] += fmt.Sprintf(" (%d retries)", destination.Retries)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// VerifyResult describes the outcome of verifying a stored backup
+type VerifyResult struct {
+	FileName string
+	Entries  int
+	Bytes    int64
+	// Problems lists damaged, missing or unexpected entries, one per line.
+	// It is empty when the backup is intact.
+	Problems []string
+}
+
+func (r VerifyResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// maxListedProblems caps how many problems a notification spells out
+const maxListedProblems = 10
+
+// problemSummary lists the first problems and counts the rest
+func (r VerifyResult) problemSummary() string {
+	listed := r.Problems
+	if len(listed) > maxListedProblems {
+		listed = listed[:maxListedProblems]
+	}
+	summary := strings.Join(listed, "\n")
+	if more := len(r.Problems) - len(listed); more > 0 {
+		summary += fmt.Sprintf("\n... and %d more", more)
+	}
+	return summary
+}
+
 // Notifier defines the interface for sending backup notifications
 type Notifier interface {
-	SendBackupSuccess(fileName, fileURL string, fileSize int64) error
+	SendBackupSuccess(result BackupResult) error
 	SendBackupFailure(err error) error
 	SendBackupDeletion(fileName, fileURL string) error
+	SendVerifyResult(result VerifyResult) error
 }
@@ -25,16 +25,43 @@ type TelegramMessage struct {
 	ParseMode string `json:"parse_mode"`
 }
 
-func (t *TelegramNotifier) SendBackupSuccess(fileName, fileURL string, fileSize int64) error {
+func (t *TelegramNotifier) SendBackupSuccess(result BackupResult) error {
+	checksum := ""
+	if result.Checksum != "" {
+		checksum = fmt.Sprintf("*SHA-256:* `%s`\n", result.Checksum)
+	}
+	retries := ""
+	if result.Retries > 0 {
+		retries = fmt.Sprintf("*Retries:* %d\n", result.Retries)
+	}
+	destinations := ""
+	if len(result.Destinations) > 1 {
+		destinations = fmt.Sprintf("*Destinations:*\n%s\n", truncate(result.destinationSummary(), 2000))
+	}
+
+	header := "✅ *Backup Successful*\n\n" +
+		"A new backup has been created and uploaded successfully!"
+	if failed := result.failedDestinations(); failed > 0 {
+		header = fmt.Sprintf("⚠️ *Backup Partially Replicated*\n\n"+
+			"The backup was created, but %d of %d destination(s) could not be reached.", failed, len(result.Destinations))
+	}
+
 	message := fmt.Sprintf(
-		"✅ *Backup Successful*\n\n"+
-			"A new backup has been created and uploaded successfully!\n\n"+
+		"%s\n\n"+
 			"*File Name:* `%s`\n"+
 			"*File Size:* %s\n"+
-			"*Download Link:* [Click here](%s)",
-		fileName,
-		formatFileSize(fileSize),
-		fileURL,
+			"%s"+
+			"%s"+
+			"%s"+
+			"*Download Link:* [Click here](%s)%s",
+		header,
+		result.FileName,
+		formatFileSize(result.FileSize),
+		checksum,
+		retries,
+		destinations,
+		result.FileURL,
+		result.linkExpiry(),
 	)
 
 	return t.sendMessage(message)
@@ -64,6 +91,34 @@ func (t *TelegramNotifier) SendBackupDeletion(fileName, fileURL string) error {
 	return t.sendMessage(message)
 }
 
+func (t *TelegramNotifier) SendVerifyResult(result VerifyResult) error {
+	if result.OK() {
+		message := fmt.Sprintf(
+			"🔍 *Backup Verified*\n\n"+
+				"The backup was downloaded and every entry matches its manifest.\n\n"+
+				"*File Name:* `%s`\n"+
+				"*Entries:* %d\n"+
+				"*Data Checked:* %s",
+			result.FileName,
+			result.Entries,
+			formatFileSize(result.Bytes),
+		)
+		return t.sendMessage(message)
+	}
+
+	message := fmt.Sprintf(
+		"⚠️ *Backup Verification Failed*\n\n"+
+			"%d problem(s) were found in the backup.\n\n"+
+			"*File Name:* `%s`\n"+
+			"*Problems:*\n```\n%s\n```",
+		len(result.Problems),
+		result.FileName,
+		truncate(result.problemSummary(), 3000),
+	)
+
+	return t.sendMessage(message)
+}
+
 func (t *TelegramNotifier) sendMessage(text string) error {
 	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", t.botToken)
 
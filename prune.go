@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/config"
+	"github.com/IndrajeethY/CloudFlareBackuper/scheduler"
+)
+
+func runPrune(args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	configPath := flags.String("config", "config.yml", "Path to configuration file")
+	host := flags.String("host", "", "Host whose backups to prune when backup.key_template uses {{.Host}} (defaults to this host)")
+	destination := flags.String("destination", "", "Destination to prune (defaults to every one)")
+	flags.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	configs := slices.Clone(cfg.Destinations)
+	if *destination != "" {
+		found, err := findDestination(cfg, *destination)
+		if err != nil {
+			return err
+		}
+		configs = []config.DestinationConfig{found}
+	}
+	for i := range configs {
+		configs[i] = pruneDestination(configs[i])
+	}
+
+	destinations, err := openDestinations(cfg, configs, *host)
+	if err != nil {
+		return err
+	}
+	notifier, err := newNotifier(cfg)
+	if err != nil {
+		return err
+	}
+	return scheduler.NewBackupScheduler(cfg, destinations, notifier).Prune()
+}
+
+// pruneDestination returns destination opened with its prune credentials,
+// if it has them, and allowed to delete
+func pruneDestination(destination config.DestinationConfig) config.DestinationConfig {
+	destination.WriteOnly = false
+	if destination.Prune == (config.PruneConfig{}) {
+		return destination
+	}
+	switch destination.Type {
+	case config.DestinationS3:
+		destination.S3.AccessKeyID = destination.Prune.AccessKeyID
+		destination.S3.SecretKey = destination.Prune.SecretKey
+	case config.DestinationR2:
+		destination.CloudFlare.AccessKeyID = destination.Prune.AccessKeyID
+		destination.CloudFlare.SecretKey = destination.Prune.SecretKey
+	}
+	return destination
+}
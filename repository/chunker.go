@@ -0,0 +1,110 @@
+package repository
+
+import (
+	"io"
+)
+
+// Chunk size bounds for content-defined chunking. Boundaries depend only on
+// the data around them, so inserting bytes into a file only changes the
+// chunks next to the edit and every other chunk deduplicates.
+const (
+	MinChunkSize = 512 << 10
+	AvgChunkSize = 1 << 20
+	MaxChunkSize = 8 << 20
+)
+
+// The masks implement normalized chunking as described for FastCDC: a
+// stricter mask before the average size and a looser one after it pulls
+// chunk sizes towards the average.
+const (
+	maskStrict uint64 = ((1 << 22) - 1) << 42
+	maskLoose  uint64 = ((1 << 18) - 1) << 46
+)
+
+// gearTable maps each byte to a pseudo-random value. It is derived from a
+// fixed seed and must never change, otherwise existing chunks would no
+// longer deduplicate.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6a09e667f3bcc908)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunker splits a stream into content-defined chunks
+type Chunker struct {
+	reader io.Reader
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+func NewChunker(reader io.Reader) *Chunker {
+	return &Chunker{
+		reader: reader,
+		buf:    make([]byte, MaxChunkSize),
+	}
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The returned
+// slice is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < MaxChunkSize && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+
+		n, err := io.ReadFull(c.reader, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cutPoint returns the length of the first chunk in data
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= MinChunkSize {
+		return n
+	}
+	if n > MaxChunkSize {
+		n = MaxChunkSize
+	}
+	normal := min(AvgChunkSize, n)
+
+	var fingerprint uint64
+	i := MinChunkSize
+	for ; i < normal; i++ {
+		fingerprint = (fingerprint << 1) + gearTable[data[i]]
+		if fingerprint&maskStrict == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fingerprint = (fingerprint << 1) + gearTable[data[i]]
+		if fingerprint&maskLoose == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,479 @@
+package repository
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/backup"
+	"github.com/IndrajeethY/CloudFlareBackuper/storage"
+)
+
+const snapshotExtension = ".json.gz"
+
+// Store is the object storage a repository lives in. Every
+// storage.Backend is a Store.
+type Store interface {
+	Upload(ctx context.Context, key string, body io.Reader, size int64) error
+	Download(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]storage.FileInfo, error)
+}
+
+// Repository is a deduplicated backup store. Files are split into
+// content-defined chunks, each chunk is stored once under its SHA-256 at
+// <root>/chunks/, and every backup is a snapshot object at
+// <root>/snapshots/ that references the chunks it needs.
+//
+// With a key, chunks and snapshots are encrypted and chunk IDs are keyed
+// HMACs instead of plain hashes, so the stored names reveal nothing about
+// the content.
+type Repository struct {
+	store Store
+	root  string
+	key   *backup.Key
+	idKey []byte
+}
+
+type BackupStats struct {
+	Files         int
+	Bytes         int64
+	Chunks        int
+	NewChunks     int
+	UploadedBytes int64
+}
+
+func New(store Store, root string, key *backup.Key) *Repository {
+	repo := &Repository{
+		store: store,
+		root:  strings.Trim(root, "/"),
+		key:   key,
+	}
+	if key != nil {
+		repo.idKey = key.Derive("cloudflare-backuper chunk id")
+	}
+	return repo
+}
+
+func (r *Repository) chunkID(data []byte) string {
+	if r.idKey == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, r.idKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal compresses data and encrypts it when the repository has a key
+func (r *Repository) seal(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	var output io.Writer = &buf
+	var encryptWriter io.WriteCloser
+	if r.key != nil {
+		var err error
+		if encryptWriter, err = backup.NewEncryptWriter(&buf, r.key); err != nil {
+			return nil, err
+		}
+		output = encryptWriter
+	}
+
+	gzipWriter, _ := gzip.NewWriterLevel(output, level)
+	if _, err := gzipWriter.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	if encryptWriter != nil {
+		if err := encryptWriter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// open reverses seal
+func (r *Repository) open(body io.Reader) (io.ReadCloser, error) {
+	plain, err := backup.OpenDecrypted(body, r.key)
+	if err != nil {
+		return nil, err
+	}
+	return gzip.NewReader(plain)
+}
+
+func (r *Repository) chunkKey(id string) string {
+	return path.Join(r.root, "chunks", id[:2], id)
+}
+
+func (r *Repository) snapshotPrefix() string {
+	return path.Join(r.root, "snapshots") + "/"
+}
+
+// SnapshotKey returns the object name a snapshot is stored under
+func (r *Repository) SnapshotKey(name string) string {
+	return r.snapshotPrefix() + name + snapshotExtension
+}
+
+// Backup stores the folders as a new snapshot called name. Only chunks that
+// no existing snapshot references are uploaded.
+func (r *Repository) Backup(ctx context.Context, name string, folders []backup.Folder) (*Snapshot, *BackupStats, error) {
+	known, err := r.referencedChunks(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries, err := backup.ScanFolders(folders)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	snapshot := &Snapshot{
+		Version: snapshotVersion,
+		Name:    name,
+		Time:    time.Now(),
+		Folders: backup.FolderPaths(folders),
+	}
+	stats := &BackupStats{}
+
+	for _, entry := range entries {
+		file := SnapshotFile{
+			Path:    entry.Path,
+			Mode:    entry.Info.Mode(),
+			ModTime: entry.Info.ModTime(),
+			Link:    entry.Link,
+		}
+
+		if entry.Info.Mode().IsRegular() {
+			// The size is what was chunked, which differs from the scan
+			// when the file changed in between
+			if file.Chunks, file.Size, err = r.storeFile(ctx, entry.Path, known, stats); err != nil {
+				return nil, nil, err
+			}
+			stats.Bytes += file.Size
+		}
+
+		snapshot.Files = append(snapshot.Files, file)
+		stats.Files++
+	}
+
+	// The snapshot is written last so it never references a chunk that is not stored yet
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	sealed, err := r.seal(encoded, gzip.DefaultCompression)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	if err := r.store.Upload(ctx, r.SnapshotKey(name), bytes.NewReader(sealed), int64(len(sealed))); err != nil {
+		return nil, nil, fmt.Errorf("failed to upload snapshot: %w", err)
+	}
+
+	return snapshot, stats, nil
+}
+
+// storeFile chunks a file and uploads the chunks not known yet. It returns
+// the chunk IDs and the number of bytes read.
+func (r *Repository) storeFile(ctx context.Context, filePath string, known map[string]bool, stats *BackupStats) ([]string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	var ids []string
+	var total int64
+	chunker := NewChunker(file)
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			return ids, total, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read file %s: %w", filePath, err)
+		}
+
+		id := r.chunkID(data)
+		ids = append(ids, id)
+		total += int64(len(data))
+		stats.Chunks++
+
+		if known[id] {
+			continue
+		}
+		size, err := r.uploadChunk(ctx, id, data)
+		if err != nil {
+			return nil, 0, err
+		}
+		known[id] = true
+		stats.NewChunks++
+		stats.UploadedBytes += size
+	}
+}
+
+func (r *Repository) uploadChunk(ctx context.Context, id string, data []byte) (int64, error) {
+	sealed, err := r.seal(data, gzip.BestSpeed)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode chunk %s: %w", id, err)
+	}
+
+	if err := r.store.Upload(ctx, r.chunkKey(id), bytes.NewReader(sealed), int64(len(sealed))); err != nil {
+		return 0, fmt.Errorf("failed to upload chunk %s: %w", id, err)
+	}
+	return int64(len(sealed)), nil
+}
+
+// readChunk downloads a chunk and checks it against its ID
+func (r *Repository) readChunk(ctx context.Context, id string) ([]byte, error) {
+	body, err := r.store.Download(ctx, r.chunkKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	reader, err := r.open(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk %s: %w", id, err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %w", id, err)
+	}
+
+	if r.chunkID(data) != id {
+		return nil, fmt.Errorf("chunk %s is corrupted", id)
+	}
+	return data, nil
+}
+
+// Snapshots returns the names of the snapshots SnapshotName gave prefix,
+// oldest first. Snapshots of other prefixes that start with prefix, such
+// as web-db for web, are left out. An empty prefix returns every snapshot.
+func (r *Repository) Snapshots(ctx context.Context, prefix string) ([]string, error) {
+	files, err := r.store.List(ctx, r.snapshotPrefix()+prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	var names []string
+	times := make(map[string]time.Time)
+	for _, file := range files {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(file.Name, r.snapshotPrefix()), snapshotExtension)
+		if !ok {
+			continue
+		}
+		if prefix != "" {
+			parsed, timestamp, ok := parseSnapshotName(name)
+			if !ok || parsed != prefix {
+				continue
+			}
+			times[name] = timestamp
+		}
+		names = append(names, name)
+	}
+	if prefix != "" {
+		sort.SliceStable(names, func(i, j int) bool {
+			return times[names[i]].Before(times[names[j]])
+		})
+	}
+	return names, nil
+}
+
+func (r *Repository) LoadSnapshot(ctx context.Context, name string) (*Snapshot, error) {
+	body, err := r.store.Download(ctx, r.SnapshotKey(name))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	reader, err := r.open(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot %s: %w", name, err)
+	}
+	defer reader.Close()
+
+	return readSnapshot(reader)
+}
+
+// WriteTar streams the contents of a snapshot as an uncompressed tar archive
+func (r *Repository) WriteTar(ctx context.Context, snapshot *Snapshot, w io.Writer) error {
+	tarWriter := tar.NewWriter(w)
+
+	for _, file := range snapshot.Files {
+		header := &tar.Header{
+			Name:    file.Path,
+			Mode:    int64(file.Mode.Perm()),
+			ModTime: file.ModTime,
+		}
+		switch {
+		case file.Mode.IsDir():
+			header.Typeflag = tar.TypeDir
+		case file.Mode&os.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = file.Link
+		case file.Mode.IsRegular():
+			header.Typeflag = tar.TypeReg
+			header.Size = file.Size
+		default:
+			continue
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write tar header: %w", err)
+		}
+		for _, id := range file.Chunks {
+			data, err := r.readChunk(ctx, id)
+			if err != nil {
+				return err
+			}
+			if _, err := tarWriter.Write(data); err != nil {
+				return fmt.Errorf("failed to write %s: %w", file.Path, err)
+			}
+		}
+	}
+
+	return tarWriter.Close()
+}
+
+// Verify downloads every chunk a snapshot references and checks it against
+// its ID and the file sizes. Chunks shared between files are read once. It
+// returns one line per damaged file; the error is only set when ctx ends.
+func (r *Repository) Verify(ctx context.Context, snapshot *Snapshot) ([]string, error) {
+	type chunkCheck struct {
+		size int64
+		err  error
+	}
+	checked := make(map[string]chunkCheck)
+
+	var problems []string
+	for _, file := range snapshot.Files {
+		var size int64
+		var damaged error
+		for _, id := range file.Chunks {
+			check, ok := checked[id]
+			if !ok {
+				data, err := r.readChunk(ctx, id)
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return problems, ctxErr
+				}
+				check = chunkCheck{size: int64(len(data)), err: err}
+				checked[id] = check
+			}
+			if check.err != nil && damaged == nil {
+				damaged = check.err
+			}
+			size += check.size
+		}
+
+		switch {
+		case damaged != nil:
+			problems = append(problems, fmt.Sprintf("corrupted: %s (%v)", file.Path, damaged))
+		case file.Mode.IsRegular() && size != file.Size:
+			problems = append(problems, fmt.Sprintf("corrupted: %s (%d bytes instead of %d)", file.Path, size, file.Size))
+		}
+	}
+	return problems, nil
+}
+
+// Forget deletes all but the newest keep snapshots of prefix and
+// then garbage collects the chunks that no remaining snapshot references.
+// It returns the names of the deleted snapshots and the number of deleted chunks.
+func (r *Repository) Forget(ctx context.Context, prefix string, keep int) ([]string, int, error) {
+	if keep <= 0 {
+		return nil, 0, nil
+	}
+
+	names, err := r.Snapshots(ctx, prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(names) <= keep {
+		return nil, 0, nil
+	}
+	expired := names[:len(names)-keep]
+
+	// Chunks of expired snapshots are candidates; anything still referenced
+	// by another snapshot, of this prefix or any other, survives
+	candidates := make(map[string]bool)
+	for _, name := range expired {
+		snapshot, err := r.LoadSnapshot(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, file := range snapshot.Files {
+			for _, id := range file.Chunks {
+				candidates[id] = true
+			}
+		}
+	}
+
+	excluded := make(map[string]bool, len(expired))
+	for _, name := range expired {
+		excluded[name] = true
+	}
+	referenced, err := r.referencedChunks(ctx, excluded)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var deleted []string
+	for _, name := range expired {
+		if err := r.store.Delete(ctx, r.SnapshotKey(name)); err != nil {
+			return deleted, 0, fmt.Errorf("failed to delete snapshot %s: %w", name, err)
+		}
+		deleted = append(deleted, name)
+	}
+
+	deletedChunks := 0
+	for id := range candidates {
+		if referenced[id] {
+			continue
+		}
+		if err := r.store.Delete(ctx, r.chunkKey(id)); err != nil {
+			return deleted, deletedChunks, fmt.Errorf("failed to delete chunk %s: %w", id, err)
+		}
+		deletedChunks++
+	}
+
+	return deleted, deletedChunks, nil
+}
+
+// referencedChunks returns the chunk IDs used by every snapshot in the repository except the excluded ones
+func (r *Repository) referencedChunks(ctx context.Context, excluded map[string]bool) (map[string]bool, error) {
+	names, err := r.Snapshots(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool)
+	for _, name := range names {
+		if excluded[name] {
+			continue
+		}
+		snapshot, err := r.LoadSnapshot(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range snapshot.Files {
+			for _, id := range file.Chunks {
+				referenced[id] = true
+			}
+		}
+	}
+	return referenced, nil
+}
@@ -0,0 +1,342 @@
+package repository
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/backup"
+	"github.com/IndrajeethY/CloudFlareBackuper/storage"
+)
+
+// memoryStore is an in-memory Store for testing
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	times   map[string]time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: make(map[string][]byte), times: make(map[string]time.Time)}
+}
+
+func (m *memoryStore) Upload(ctx context.Context, key string, body io.Reader, size int64) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = data
+	m.times[key] = time.Now()
+	return nil
+}
+
+func (m *memoryStore) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("object %s not found", key)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memoryStore) List(ctx context.Context, prefix string) ([]storage.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var files []storage.FileInfo
+	for key, data := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			files = append(files, storage.FileInfo{Name: key, Size: int64(len(data)), LastModified: m.times[key]})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (m *memoryStore) countPrefix(prefix string) int {
+	files, _ := m.List(context.Background(), prefix)
+	return len(files)
+}
+
+// TestChunkerDeterministic verifies that chunking is stable and that an
+// insertion only changes the chunks around it
+func TestChunkerDeterministic(t *testing.T) {
+	data := make([]byte, 12<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunkIDs := func(input []byte) []string {
+		var ids []string
+		chunker := NewChunker(bytes.NewReader(input))
+		for {
+			chunk, err := chunker.Next()
+			if err == io.EOF {
+				return ids
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunk) > MaxChunkSize {
+				t.Fatalf("Chunk of %d bytes exceeds the maximum", len(chunk))
+			}
+			ids = append(ids, fmt.Sprintf("%x", chunk[:16]))
+		}
+	}
+
+	original := chunkIDs(data)
+	if len(original) < 3 {
+		t.Fatalf("Expected several chunks, got %d", len(original))
+	}
+
+	edited := append(append([]byte("inserted"), data[:len(data)/2]...), data[len(data)/2:]...)
+	shared := make(map[string]bool)
+	for _, id := range chunkIDs(edited) {
+		shared[id] = true
+	}
+	matches := 0
+	for _, id := range original {
+		if shared[id] {
+			matches++
+		}
+	}
+	if matches < len(original)-2 {
+		t.Errorf("Expected most chunks to survive an insertion, %d of %d did", matches, len(original))
+	}
+}
+
+// TestRepositoryBackupRestoreForget verifies deduplication, restore and garbage collection
+func TestRepositoryBackupRestoreForget(t *testing.T) {
+	source := t.TempDir()
+	content := make([]byte, 3<<20)
+	rand.New(rand.NewSource(2)).Read(content)
+	if err := os.WriteFile(filepath.Join(source, "big.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	store := newMemoryStore()
+	repo := New(store, "repo", nil)
+
+	first, _, err := repo.Backup(ctx, "job-20240101-000000", []backup.Folder{{Path: source}})
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	_, stats, err := repo.Backup(ctx, "job-20240102-000000", []backup.Folder{{Path: source}})
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if stats.NewChunks != 0 {
+		t.Errorf("Expected unchanged data to be fully deduplicated, uploaded %d chunks", stats.NewChunks)
+	}
+
+	var buf bytes.Buffer
+	if err := repo.WriteTar(ctx, first, &buf); err != nil {
+		t.Fatalf("WriteTar failed: %v", err)
+	}
+	tarReader := tar.NewReader(&buf)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			t.Fatal("big.bin not found in snapshot")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(header.Name) == "big.bin" {
+			restored, _ := io.ReadAll(tarReader)
+			if !bytes.Equal(restored, content) {
+				t.Error("Restored content does not match the original")
+			}
+			break
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(source, "big.bin"), []byte("replaced"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := repo.Backup(ctx, "job-20240103-000000", []backup.Folder{{Path: source}}); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	// The second snapshot still references the original chunks, so forgetting the first frees nothing
+	deleted, freed, err := repo.Forget(ctx, "job", 2)
+	if err != nil {
+		t.Fatalf("Forget failed: %v", err)
+	}
+	if len(deleted) != 1 || freed != 0 {
+		t.Errorf("Expected 1 snapshot and 0 chunks deleted, got %v and %d", deleted, freed)
+	}
+
+	if _, freed, err = repo.Forget(ctx, "job", 1); err != nil {
+		t.Fatalf("Forget failed: %v", err)
+	}
+	if freed == 0 || store.countPrefix("repo/chunks/") != 1 {
+		t.Errorf("Expected only the chunk of the third snapshot to remain, freed %d, left %d", freed, store.countPrefix("repo/chunks/"))
+	}
+}
+
+// TestRepositoryOverlappingPrefixes verifies that the snapshots of a job
+// whose name starts with another job's are not treated as the other's
+func TestRepositoryOverlappingPrefixes(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "file.txt"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	repo := New(newMemoryStore(), "repo", nil)
+	for _, name := range []string{"web-20240101-000000", "web-db-20240102-000000", "web-20240103-000000", "web-db-20240104-000000", "web-backup"} {
+		if _, _, err := repo.Backup(ctx, name, []backup.Folder{{Path: source}}); err != nil {
+			t.Fatalf("Backup failed: %v", err)
+		}
+	}
+
+	names, err := repo.Snapshots(ctx, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "web-20240101-000000,web-20240103-000000" {
+		t.Errorf("Expected only the snapshots of web, got %v", names)
+	}
+
+	deleted, _, err := repo.Forget(ctx, "web", 1)
+	if err != nil {
+		t.Fatalf("Forget failed: %v", err)
+	}
+	if strings.Join(deleted, ",") != "web-20240101-000000" {
+		t.Errorf("Expected only the oldest snapshot of web to be deleted, got %v", deleted)
+	}
+	if names, _ := repo.Snapshots(ctx, "web-db"); len(names) != 2 {
+		t.Errorf("Expected the snapshots of web-db to be kept, got %v", names)
+	}
+	if names, _ := repo.Snapshots(ctx, ""); len(names) != 4 {
+		t.Errorf("Expected every remaining snapshot without a prefix, got %v", names)
+	}
+}
+
+// appendingStore appends to a file after the first chunk is uploaded, as
+// if the file grew while it was being backed up
+type appendingStore struct {
+	*memoryStore
+	path     string
+	appended bool
+}
+
+func (a *appendingStore) Upload(ctx context.Context, key string, body io.Reader, size int64) error {
+	if !a.appended && strings.Contains(key, "/chunks/") {
+		a.appended = true
+		file, err := os.OpenFile(a.path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		file.Write(bytes.Repeat([]byte("appended"), 1<<17))
+		file.Close()
+	}
+	return a.memoryStore.Upload(ctx, key, body, size)
+}
+
+// TestRepositoryFileGrows verifies that a file growing during a backup is
+// recorded with the size that was stored, so the snapshot can be restored
+func TestRepositoryFileGrows(t *testing.T) {
+	source := t.TempDir()
+	filePath := filepath.Join(source, "log.bin")
+	// Larger than one read of the chunker, so the append is read too
+	content := make([]byte, MaxChunkSize+(4<<20))
+	rand.New(rand.NewSource(5)).Read(content)
+	if err := os.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	repo := New(&appendingStore{memoryStore: newMemoryStore(), path: filePath}, "repo", nil)
+	snapshot, stats, err := repo.Backup(ctx, "job-20240101-000000", []backup.Folder{{Path: source}})
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	grown, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grown) == len(content) || stats.Bytes != int64(len(grown)) {
+		t.Fatalf("Expected the appended bytes to be counted, got %d of %d", stats.Bytes, len(grown))
+	}
+
+	var buf bytes.Buffer
+	if err := repo.WriteTar(ctx, snapshot, &buf); err != nil {
+		t.Fatalf("WriteTar failed: %v", err)
+	}
+	tarReader := tar.NewReader(&buf)
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			t.Fatalf("log.bin not found in snapshot: %v", err)
+		}
+		if filepath.Base(header.Name) == "log.bin" {
+			restored, _ := io.ReadAll(tarReader)
+			if !bytes.Equal(restored, grown) {
+				t.Error("Restored content does not match the grown file")
+			}
+			break
+		}
+	}
+}
+
+// TestRepositoryVerify verifies that damaged and missing chunks are reported per file
+func TestRepositoryVerify(t *testing.T) {
+	source := t.TempDir()
+	for name, seed := range map[string]int64{"a.bin": 3, "b.bin": 4} {
+		content := make([]byte, 1<<20)
+		rand.New(rand.NewSource(seed)).Read(content)
+		if err := os.WriteFile(filepath.Join(source, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	store := newMemoryStore()
+	repo := New(store, "repo", nil)
+	snapshot, _, err := repo.Backup(ctx, "job-20240101-000000", []backup.Folder{{Path: source}})
+	if err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	problems, err := repo.Verify(ctx, snapshot)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("Expected an intact snapshot, got %v, %v", problems, err)
+	}
+
+	for _, file := range snapshot.Files {
+		switch filepath.Base(file.Path) {
+		case "a.bin":
+			store.objects[repo.chunkKey(file.Chunks[0])] = []byte("garbage")
+		case "b.bin":
+			delete(store.objects, repo.chunkKey(file.Chunks[0]))
+		}
+	}
+	problems, err = repo.Verify(ctx, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 {
+		t.Errorf("Expected both files to be reported, got %v", problems)
+	}
+}
@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const snapshotVersion = 1
+
+// Snapshot describes one backup run. File contents are referenced by chunk
+// IDs, so a snapshot stays small no matter how much data it covers.
+type Snapshot struct {
+	Version int            `json:"version"`
+	Name    string         `json:"name"`
+	Time    time.Time      `json:"time"`
+	Folders []string       `json:"folders"`
+	Files   []SnapshotFile `json:"files"`
+}
+
+type SnapshotFile struct {
+	Path    string      `json:"path"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size"`
+	Link    string      `json:"link,omitempty"`
+	Chunks  []string    `json:"chunks,omitempty"`
+}
+
+// TotalSize returns the combined size of all files in the snapshot
+func (s *Snapshot) TotalSize() int64 {
+	var total int64
+	for _, file := range s.Files {
+		total += file.Size
+	}
+	return total
+}
+
+func readSnapshot(r io.Reader) (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	return &snapshot, nil
+}
+
+// snapshotTimeLayout is the timestamp that ends every snapshot name
+const snapshotTimeLayout = "20060102-150405"
+
+// SnapshotName returns a timestamped snapshot name for prefix
+func SnapshotName(prefix string) string {
+	return fmt.Sprintf("%s-%s", prefix, time.Now().Format(snapshotTimeLayout))
+}
+
+// parseSnapshotName splits a snapshot name into its prefix and timestamp
+func parseSnapshotName(name string) (string, time.Time, bool) {
+	if len(name) < len(snapshotTimeLayout)+2 || name[len(name)-len(snapshotTimeLayout)-1] != '-' {
+		return "", time.Time{}, false
+	}
+	timestamp, err := time.ParseInLocation(snapshotTimeLayout, name[len(name)-len(snapshotTimeLayout):], time.Local)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return name[:len(name)-len(snapshotTimeLayout)-1], timestamp, true
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/backup"
+	"github.com/IndrajeethY/CloudFlareBackuper/config"
+	"github.com/IndrajeethY/CloudFlareBackuper/repository"
+	"github.com/IndrajeethY/CloudFlareBackuper/storage"
+)
+
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := flags.String("config", "config.yml", "Path to configuration file")
+	name := flags.String("name", "", "Backup to restore (defaults to the latest backup)")
+	prefix := flags.String("prefix", "", "Name prefix used to pick the latest backup (defaults to backup.name_prefix)")
+	host := flags.String("host", "", "Host whose backups to read when backup.key_template uses {{.Host}} (defaults to this host)")
+	destination := flags.String("destination", "", "Destination to read from (defaults to the first one)")
+	target := flags.String("target", "", "Directory to restore into")
+	overwrite := flags.String("overwrite", string(backup.OverwriteNever), "What to do with existing files: always, never or newer")
+	dryRun := flags.Bool("dry-run", false, "List what would be restored without writing anything")
+	useCache := flags.Bool("cache", true, "Restore from the copy in cache.dir when it still matches the stored archive")
+	allowUnencrypted := flags.Bool("allow-unencrypted", false, "Restore archives without encryption although encryption.enabled is set, such as those taken before it was")
+	var mappings, includes stringList
+	flags.Var(&mappings, "map", "Remap an archived path, e.g. /var/www=/srv/www (repeatable)")
+	flags.Var(&includes, "include", "Only restore paths matching this glob, e.g. 'var/www/*.php' (repeatable)")
+	flags.Parse(args)
+
+	if *target == "" {
+		return fmt.Errorf("-target is required")
+	}
+
+	opts := backup.RestoreOptions{
+		TargetDir: *target,
+		Include:   includes,
+		DryRun:    *dryRun,
+	}
+	var err error
+	if opts.Overwrite, err = backup.ParseOverwritePolicy(*overwrite); err != nil {
+		return err
+	}
+	for _, value := range mappings {
+		mapping, err := backup.ParsePathMapping(value)
+		if err != nil {
+			return err
+		}
+		opts.Mappings = append(opts.Mappings, mapping)
+	}
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	backend, err := openDestination(cfg, *destination, *host)
+	if err != nil {
+		return err
+	}
+
+	if opts.DecryptionKey, err = decryptionKey(cfg); err != nil {
+		return err
+	}
+	opts.RequireEncryption = cfg.Encryption.Enabled && !*allowUnencrypted
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *prefix == "" {
+		*prefix = cfg.Backup.NamePrefix
+	}
+
+	restorer, err := backup.NewRestorer(opts)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Backup.Mode == config.ModeRepository {
+		if err := restoreSnapshot(ctx, repository.New(backend, cfg.Backup.Repository.Path, opts.DecryptionKey), restorer, *name, *prefix, *target); err != nil {
+			return err
+		}
+		logRestoreStats(restorer.Finish(), opts.DryRun)
+		return nil
+	}
+
+	fileName := *name
+	if fileName == "" {
+		if fileName, err = latestBackup(ctx, backend, *prefix); err != nil {
+			return fmt.Errorf("failed to find latest backup: %w", err)
+		}
+	}
+
+	logOrigin(ctx, backend, fileName)
+
+	// The cache only holds the archives of this host
+	var cache *backup.Cache
+	if *useCache && cfg.Cache.Dir != "" && *host == "" {
+		cache = backup.NewCache(cfg.Cache.Dir, cfg.Cache.MaxArchives, int64(cfg.Cache.MaxSize))
+	}
+
+	chain, err := restoreChain(ctx, backend, fileName)
+	if err != nil {
+		return err
+	}
+
+	for _, archive := range chain {
+		log.Printf("Restoring %s into %s...", archive, *target)
+		if err := extractBackup(ctx, backend, cache, restorer, archive); err != nil {
+			return err
+		}
+	}
+	logRestoreStats(restorer.Finish(), opts.DryRun)
+	return nil
+}
+
+func logRestoreStats(stats *backup.RestoreStats, dryRun bool) {
+	if dryRun {
+		log.Printf("Dry run complete: %d entries would be restored, %d deleted, %d skipped", stats.Restored, stats.Deleted, stats.Skipped)
+	} else {
+		log.Printf("Restore complete: %d entries restored (%d bytes), %d deleted, %d skipped", stats.Restored, stats.Bytes, stats.Deleted, stats.Skipped)
+	}
+}
+
+// restoreSnapshot restores a repository snapshot by streaming it as a tar
+// archive from its chunks into the restorer
+func restoreSnapshot(ctx context.Context, repo *repository.Repository, restorer *backup.Restorer, name, prefix, target string) error {
+	if name == "" {
+		snapshots, err := repo.Snapshots(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			return fmt.Errorf("no snapshots found with prefix %q", prefix)
+		}
+		name = snapshots[len(snapshots)-1]
+	}
+
+	snapshot, err := repo.LoadSnapshot(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to load snapshot %s: %w", name, err)
+	}
+
+	log.Printf("Restoring snapshot %s into %s...", name, target)
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(repo.WriteTar(ctx, snapshot, pipeWriter))
+	}()
+	defer pipeReader.Close()
+
+	return restorer.ExtractTar(tar.NewReader(pipeReader))
+}
+
+// restoreChain returns the archives to extract for fileName. Incremental
+// backups need the full backup they build on and every backup in between.
+func restoreChain(ctx context.Context, backend storage.Backend, fileName string) ([]string, error) {
+	parsed, ok := backup.ParseBackupName(fileName)
+	if !ok || !parsed.Incremental {
+		return []string{fileName}, nil
+	}
+
+	backups, err := listBackups(ctx, backend, parsed.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	return backup.RestoreChain(backups, fileName)
+}
+
+func extractBackup(ctx context.Context, backend storage.Backend, cache *backup.Cache, restorer *backup.Restorer, fileName string) error {
+	// The metadata holds the checksum a cached copy must have, and whether
+	// the archive must be encrypted
+	info, statErr := backend.Stat(ctx, fileName)
+	body, err := openArchive(ctx, backend, cache, fileName, info, statErr)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if err := restorer.Extract(body, backup.ExpectEncrypted(fileName, info.Metadata)); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", fileName, err)
+	}
+	return nil
+}
+
+// openArchive opens the cached copy of an archive when it still matches
+// the stored one, and downloads the archive otherwise. The cached copy is
+// checked against the checksum in the object's metadata, as info and
+// statErr from Stat describe it, or, for streamed uploads and unreachable
+// destinations, against the checksum it was cached with.
+func openArchive(ctx context.Context, backend storage.Backend, cache *backup.Cache, fileName string, info storage.FileInfo, statErr error) (io.ReadCloser, error) {
+	if cache == nil {
+		return backend.Download(ctx, fileName)
+	}
+
+	checksum, size := "", int64(-1)
+	if statErr == nil {
+		metadata, _ := backup.ParseMetadata(info.Metadata)
+		checksum, size = metadata.Checksum, info.Size
+	} else {
+		log.Printf("Failed to read %s on the destination, checking the cached copy against its own checksum: %v", fileName, statErr)
+	}
+
+	file, err := cache.Open(fileName, checksum, size)
+	if err == nil {
+		log.Printf("Using the cached copy of %s", fileName)
+		return file, nil
+	}
+	log.Printf("Not using the cache for %s: %v", fileName, err)
+	return backend.Download(ctx, fileName)
+}
@@ -0,0 +1,73 @@
+package scheduler
+
+import (
+	"log"
+	"os"
+	"slices"
+)
+
+// cacheArchive moves the archive at archivePath into the local cache, if
+// there is one, once at least one destination stored it
+func (s *BackupScheduler) cacheArchive(fileName, archivePath, checksum string, errs []error) {
+	if s.cache == nil || !slices.Contains(errs, nil) {
+		return
+	}
+
+	kept, err := s.cache.Add(fileName, archivePath, checksum)
+	switch {
+	case err != nil:
+		log.Printf("Failed to keep a copy of %s in the cache: %v", fileName, err)
+	case kept:
+		log.Printf("Kept a copy of %s in the cache", fileName)
+	default:
+		log.Printf("%s is larger than the cache and was not kept", fileName)
+	}
+}
+
+// cacheWriter copies a streamed archive into the cache. Failing to write
+// the copy only loses the copy, never the backup.
+type cacheWriter struct {
+	file *os.File
+	err  error
+}
+
+// newCacheWriter returns a writer for the cached copy of a streamed
+// archive, or nil when there is no cache or the copy cannot be created
+func (s *BackupScheduler) newCacheWriter(fileName string) *cacheWriter {
+	if s.cache == nil {
+		return nil
+	}
+	file, err := s.cache.Create(fileName)
+	if err != nil {
+		log.Printf("Failed to keep a copy of %s in the cache: %v", fileName, err)
+		return nil
+	}
+	return &cacheWriter{file: file}
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.file.Write(p)
+	}
+	return len(p), nil
+}
+
+// finish adds the copy of a complete archive to the cache if a
+// destination stored it
+func (w *cacheWriter) finish(s *BackupScheduler, fileName, checksum string, errs []error) {
+	defer w.discard()
+	if err := w.file.Close(); w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		log.Printf("Failed to keep a copy of %s in the cache: %v", fileName, w.err)
+		return
+	}
+	s.cacheArchive(fileName, w.file.Name(), checksum, errs)
+}
+
+// discard removes the copy, unless it was moved into the cache
+func (w *cacheWriter) discard() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
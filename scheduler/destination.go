@@ -0,0 +1,190 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/notification"
+	"github.com/IndrajeethY/CloudFlareBackuper/storage"
+)
+
+// Destination is a backend every backup is replicated to
+type Destination struct {
+	Name    string
+	Backend storage.Backend
+	// RetentionLimit is how many backups to keep; zero or less keeps all
+	RetentionLimit int
+	// BestEffort destinations may fail without failing the backup, unless
+	// what they stored does not match the archive
+	BestEffort bool
+	// PresignExpiry, when set, makes notification links presigned URLs
+	// valid this long instead of public ones
+	PresignExpiry time.Duration
+	// WriteOnly destinations are never deleted from by backups; old
+	// backups are left to lifecycle rules or Prune
+	WriteOnly bool
+	// ObjectLocked destinations lock every object they store, so an
+	// object that does not match its upload is left to its retention
+	ObjectLocked bool
+}
+
+// discardMismatched deletes key when err reports that the stored object
+// does not match what was uploaded, so it is never mistaken for a good
+// backup. Write-only and locked destinations keep it.
+func (d Destination) discardMismatched(key string, err error) {
+	if !errors.Is(err, storage.ErrChecksumMismatch) {
+		return
+	}
+	if d.WriteOnly || d.ObjectLocked {
+		log.Printf("Leaving mismatched object %s on %s", key, d.Name)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := d.Backend.Delete(ctx, key); err != nil {
+		log.Printf("Failed to delete mismatched object %s from %s: %v", key, d.Name, err)
+	}
+}
+
+// link returns the download link to key for notifications, and when it
+// expires. Without a presign expiry it is the permanent public URL.
+func (d Destination) link(key string) (string, time.Time) {
+	if d.PresignExpiry <= 0 {
+		return d.Backend.URL(key), time.Time{}
+	}
+
+	expires := time.Now().Add(d.PresignExpiry)
+	url, err := storage.PresignURL(context.Background(), d.Backend, key, d.PresignExpiry)
+	if err != nil {
+		log.Printf("Failed to presign link to %s on %s: %v", key, d.Name, err)
+		return d.Backend.URL(key), time.Time{}
+	}
+	return url, expires
+}
+
+// retryCounts returns how many times each destination has retried a
+// failed storage operation so far
+func (s *BackupScheduler) retryCounts() []int64 {
+	counts := make([]int64, len(s.destinations))
+	for i, destination := range s.destinations {
+		counts[i] = storage.RetryCount(destination.Backend)
+	}
+	return counts
+}
+
+// retriesSince returns how many retries each destination made since
+// retryCounts returned before
+func (s *BackupScheduler) retriesSince(before []int64) []int {
+	retries := make([]int, len(s.destinations))
+	for i, count := range s.retryCounts() {
+		retries[i] = int(count - before[i])
+	}
+	return retries
+}
+
+func sum(values []int) int {
+	total := 0
+	for _, value := range values {
+		total += value
+	}
+	return total
+}
+
+// primary returns the destination incremental chains are tracked against
+func (s *BackupScheduler) primary() Destination {
+	return s.destinations[0]
+}
+
+// replicationResults reports the outcome of storing key on every
+// destination, errs holding the error of each. It returns the destinations
+// that have the backup, and an error when none or a required one failed,
+// or when any stored something other than the archive.
+func (s *BackupScheduler) replicationResults(action, key string, errs []error) ([]Destination, []notification.DestinationResult, error) {
+	if len(s.destinations) == 1 {
+		if errs[0] != nil {
+			return nil, nil, fmt.Errorf("failed to %s: %w", action, errs[0])
+		}
+		url, _ := s.destinations[0].link(key)
+		return s.destinations, []notification.DestinationResult{{Name: s.destinations[0].Name, URL: url}}, nil
+	}
+
+	var (
+		stored   []Destination
+		results  []notification.DestinationResult
+		all      []error
+		required []error
+	)
+	for i, destination := range s.destinations {
+		if errs[i] == nil {
+			url, _ := destination.link(key)
+			results = append(results, notification.DestinationResult{Name: destination.Name, URL: url})
+			stored = append(stored, destination)
+			continue
+		}
+		results = append(results, notification.DestinationResult{
+			Name: destination.Name,
+			URL:  destination.Backend.URL(key),
+			Err:  errs[i],
+		})
+
+		log.Printf("Failed to %s on %s: %v", action, destination.Name, errs[i])
+		err := fmt.Errorf("%s: %w", destination.Name, errs[i])
+		all = append(all, err)
+		if !destination.BestEffort || errors.Is(errs[i], storage.ErrChecksumMismatch) {
+			required = append(required, err)
+		}
+	}
+
+	if len(stored) == 0 {
+		return nil, results, fmt.Errorf("failed to %s on every destination: %w", action, errors.Join(all...))
+	}
+	if len(required) > 0 {
+		names := make([]string, len(stored))
+		for i, destination := range stored {
+			names[i] = destination.Name
+		}
+		return stored, results, fmt.Errorf("failed to %s on a required destination (stored on %s): %w",
+			action, strings.Join(names, ", "), errors.Join(required...))
+	}
+	return stored, results, nil
+}
+
+// errAllUploadsFailed stops the archive once no upload is reading it
+var errAllUploadsFailed = errors.New("every upload failed")
+
+// fanOutWriter copies the archive into the upload of every destination.
+// An upload that stops reading is dropped so the others can finish, and
+// writing only fails once none is left. Every upload goes as fast as the
+// slowest one.
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func newFanOutWriter(writers []*io.PipeWriter) *fanOutWriter {
+	return &fanOutWriter{writers: writers, failed: make([]bool, len(writers))}
+}
+
+func (f *fanOutWriter) Write(p []byte) (int, error) {
+	live := 0
+	for i, writer := range f.writers {
+		if f.failed[i] {
+			continue
+		}
+		if _, err := writer.Write(p); err != nil {
+			f.failed[i] = true
+			continue
+		}
+		live++
+	}
+	if live == 0 {
+		return 0, errAllUploadsFailed
+	}
+	return len(p), nil
+}
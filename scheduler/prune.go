@@ -0,0 +1,36 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/config"
+	"github.com/IndrajeethY/CloudFlareBackuper/repository"
+)
+
+// Prune deletes the backups beyond the retention limit of every
+// destination without taking a backup, and aborts stale multipart uploads.
+// It cleans up write-only destinations, given backends opened with
+// credentials that may delete.
+func (s *BackupScheduler) Prune() error {
+	log.Println("Pruning old backups...")
+
+	var errs []error
+	if s.config.Backup.Mode == config.ModeRepository {
+		key, err := s.encryptionKey()
+		if err != nil {
+			return err
+		}
+		for _, destination := range s.destinations {
+			repo := repository.New(destination.Backend, s.config.Backup.Repository.Path, key)
+			errs = append(errs, s.forgetSnapshots(context.Background(), destination, repo))
+		}
+		return errors.Join(errs...)
+	}
+
+	for _, destination := range s.destinations {
+		errs = append(errs, s.applyRetention(destination), s.abortStaleUploads(destination))
+	}
+	return errors.Join(errs...)
+}
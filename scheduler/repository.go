@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/notification"
+	"github.com/IndrajeethY/CloudFlareBackuper/repository"
+)
+
+// runRepositoryBackup stores the folders as a snapshot in the deduplicated
+// repository of every destination and garbage collects snapshots beyond
+// each destination's retention limit
+func (s *BackupScheduler) runRepositoryBackup(before []int64) error {
+	log.Println("Starting repository backup...")
+
+	key, err := s.encryptionKey()
+	if err != nil {
+		return err
+	}
+
+	name := repository.SnapshotName(s.config.Backup.NamePrefix)
+	ctx := context.Background()
+
+	repos := make([]*repository.Repository, len(s.destinations))
+	errs := make([]error, len(s.destinations))
+	var snapshot *repository.Snapshot
+	for i, destination := range s.destinations {
+		repos[i] = repository.New(destination.Backend, s.config.Backup.Repository.Path, key)
+
+		log.Printf("Creating snapshot %s on %s from %d folder(s)...", name, destination.Name, len(s.config.Backup.Folders))
+		created, stats, err := repos[i].Backup(ctx, name, s.folders())
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if snapshot == nil {
+			snapshot = created
+		}
+		log.Printf("Snapshot created on %s: %d files, %d bytes, %d/%d chunks new (%d bytes uploaded)",
+			destination.Name, stats.Files, stats.Bytes, stats.NewChunks, stats.Chunks, stats.UploadedBytes)
+	}
+
+	snapshotKey := repos[0].SnapshotKey(name)
+	stored, replicas, err := s.replicationResults("create snapshot", snapshotKey, errs)
+	if err != nil {
+		return err
+	}
+
+	for i, destination := range s.destinations {
+		if errs[i] != nil {
+			continue
+		}
+		if destination.WriteOnly && destination.RetentionLimit > 0 {
+			log.Printf("Not deleting old snapshots from %s, which is write-only", destination.Name)
+			continue
+		}
+		s.forgetSnapshots(ctx, destination, repos[i])
+	}
+
+	retries := s.retriesSince(before)
+	for i := range replicas {
+		replicas[i].Retries = retries[i]
+	}
+
+	fileURL, linkExpires := stored[0].link(snapshotKey)
+	log.Println("Sending success notification...")
+	if err := s.notifier.SendBackupSuccess(notification.BackupResult{
+		FileName:     name,
+		FileURL:      fileURL,
+		LinkExpires:  linkExpires,
+		FileSize:     snapshot.TotalSize(),
+		Retries:      sum(retries),
+		Destinations: replicas,
+	}); err != nil {
+		log.Printf("Failed to send notification: %v", err)
+	}
+
+	log.Println("Backup completed successfully!")
+	return nil
+}
+
+// forgetSnapshots deletes the snapshots on a destination beyond its
+// retention limit, and the chunks only they used, and reports each
+// deleted snapshot
+func (s *BackupScheduler) forgetSnapshots(ctx context.Context, destination Destination, repo *repository.Repository) error {
+	if destination.RetentionLimit <= 0 {
+		return nil
+	}
+
+	log.Printf("Checking for old snapshots to delete on %s (retention limit: %d)...", destination.Name, destination.RetentionLimit)
+	deleted, deletedChunks, err := repo.Forget(ctx, s.config.Backup.NamePrefix, destination.RetentionLimit)
+	if err != nil {
+		log.Printf("Failed to cleanup old snapshots on %s: %v", destination.Name, err)
+	}
+	if len(deleted) > 0 {
+		log.Printf("Deleted %d old snapshot(s) and %d unreferenced chunk(s) from %s", len(deleted), deletedChunks, destination.Name)
+		for _, name := range deleted {
+			if err := s.notifier.SendBackupDeletion(name, destination.Backend.URL(repo.SnapshotKey(name))); err != nil {
+				log.Printf("Failed to send deletion notification for %s: %v", name, err)
+			}
+		}
+	} else if err == nil {
+		log.Printf("No old snapshots to delete on %s", destination.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to cleanup old snapshots on %s: %w", destination.Name, err)
+	}
+	return nil
+}
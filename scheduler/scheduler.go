@@ -1,11 +1,16 @@
 package scheduler
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/IndrajeethY/CloudFlareBackuper/backup"
@@ -15,22 +20,33 @@ import (
 	"github.com/robfig/cron/v3"
 )
 
+// Version is recorded in the metadata of every backup
+var Version = "dev"
+
 type BackupScheduler struct {
-	config   *config.Config
-	r2Client *storage.R2Client
-	notifier notification.Notifier
-	cron     *cron.Cron
-	tempDir  string
+	config       *config.Config
+	destinations []Destination
+	notifier     notification.Notifier
+	cron         *cron.Cron
+	tempDir      string
+	// cache keeps copies of the latest archives, or is nil
+	cache *backup.Cache
 }
 
-func NewBackupScheduler(cfg *config.Config, r2Client *storage.R2Client, notifier notification.Notifier) *BackupScheduler {
-	return &BackupScheduler{
-		config:   cfg,
-		r2Client: r2Client,
-		notifier: notifier,
-		cron:     cron.New(),
-		tempDir:  os.TempDir(),
+// NewBackupScheduler replicates every backup to destinations, of which
+// there must be at least one
+func NewBackupScheduler(cfg *config.Config, destinations []Destination, notifier notification.Notifier) *BackupScheduler {
+	scheduler := &BackupScheduler{
+		config:       cfg,
+		destinations: destinations,
+		notifier:     notifier,
+		cron:         cron.New(),
+		tempDir:      os.TempDir(),
+	}
+	if cfg.Cache.Dir != "" {
+		scheduler.cache = backup.NewCache(cfg.Cache.Dir, cfg.Cache.MaxArchives, int64(cfg.Cache.MaxSize))
 	}
+	return scheduler
 }
 
 func (s *BackupScheduler) Start() error {
@@ -67,59 +83,130 @@ func (s *BackupScheduler) Stop() {
 }
 
 func (s *BackupScheduler) runBackup() error {
+	before := s.retryCounts()
+	var err error
+	if s.config.Backup.Mode == config.ModeRepository {
+		err = s.runRepositoryBackup(before)
+	} else {
+		err = s.runArchiveBackup(before)
+	}
+	if err != nil {
+		if retries := sum(s.retriesSince(before)); retries > 0 {
+			err = fmt.Errorf("%w (storage operations were retried %d time(s) during the run)", err, retries)
+		}
+	}
+	return err
+}
+
+// runArchiveBackup stores the folders as an archive. before holds the
+// retry counts of the destinations when the run started.
+func (s *BackupScheduler) runArchiveBackup(before []int64) error {
 	log.Println("Starting backup process...")
 
-	fileName := backup.GenerateBackupFilename(s.config.Backup.NamePrefix)
-	archivePath := filepath.Join(s.tempDir, fileName)
+	s.resumePendingUploads()
 
-	log.Printf("Creating archive from %d folder(s)...", len(s.config.Backup.Folders))
-	if err := backup.CreateArchive(s.config.Backup.Folders, archivePath); err != nil {
-		return fmt.Errorf("failed to create archive: %w", err)
+	key, err := s.encryptionKey()
+	if err != nil {
+		return err
 	}
-	defer os.Remove(archivePath)
 
-	fileInfo, err := os.Stat(archivePath)
-	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+	var previous *backup.Index
+	if s.config.Backup.Incremental.Enabled {
+		previous = s.previousIndex(key)
 	}
-	fileSize := fileInfo.Size()
-	log.Printf("Archive created: %s (size: %d bytes)", fileName, fileSize)
 
-	log.Println("Uploading to CloudFlare R2...")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
+	name := backup.NewBackupName(s.config.Backup.NamePrefix)
+	name.Incremental = previous != nil
+	name.Encrypted = key != nil
+	name.Compression = backup.Compression(s.config.Backup.Compression.Algorithm)
+	fileName := name.Filename()
+
+	if previous != nil {
+		log.Printf("Creating incremental archive from %d folder(s) on top of %s...", len(s.config.Backup.Folders), previous.LastBackup)
+	} else {
+		log.Printf("Creating archive from %d folder(s)...", len(s.config.Backup.Folders))
+	}
+	opts := backup.ArchiveOptions{
+		Previous:         previous,
+		EncryptionKey:    key,
+		Compression:      name.Compression,
+		CompressionLevel: s.config.Backup.Compression.Level,
+	}
 
-	fileURL, err := s.r2Client.UploadFile(ctx, archivePath)
+	metadata := s.metadata(name)
+
+	var (
+		result     *backup.ArchiveResult
+		uploadErrs []error
+	)
+	if s.config.Backup.Streaming {
+		result, uploadErrs, err = s.streamArchive(fileName, opts, metadata)
+	} else {
+		result, uploadErrs, err = s.uploadArchive(fileName, opts, metadata)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to upload to R2: %w", err)
+		return err
+	}
+	stored, replicas, err := s.replicationResults("upload archive", fileName, uploadErrs)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		log.Printf("Archived %d changed entries, recorded %d deletion(s)", result.Files, result.Deleted)
 	}
-	log.Printf("Upload successful: %s", fileURL)
 
-	if s.config.Backup.RetentionLimit > 0 {
-		log.Printf("Checking for old backups to delete (retention limit: %d)...", s.config.Backup.RetentionLimit)
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-		defer cancel()
+	fileURL, linkExpires := stored[0].link(fileName)
+	for _, destination := range stored {
+		log.Printf("Upload to %s successful: %s (size: %d bytes, sha256: %s)",
+			destination.Name, destination.Backend.URL(fileName), result.Size, result.Checksum)
 
-		deletedFiles, err := s.r2Client.CleanupOldBackups(ctx, s.config.Backup.NamePrefix, s.config.Backup.RetentionLimit)
-		if err != nil {
-			log.Printf("Failed to cleanup old backups: %v", err)
-		} else if len(deletedFiles) > 0 {
-			log.Printf("Deleted %d old backup(s)", len(deletedFiles))
-			for _, deletedFile := range deletedFiles {
-				deletedFileURL := fmt.Sprintf("%s/%s", s.config.CloudFlare.URI, deletedFile)
-				if err := s.notifier.SendBackupDeletion(deletedFile, deletedFileURL); err != nil {
-					log.Printf("Failed to send deletion notification for %s: %v", deletedFile, err)
-				} else {
-					log.Printf("Sent deletion notification for: %s", deletedFile)
-				}
-			}
-		} else {
-			log.Println("No old backups to delete")
+		if err := s.uploadManifest(destination.Backend, fileName, result.Manifest, key); err != nil {
+			// The manifest is also the first entry of the archive, so it can
+			// still be read from there
+			log.Printf("Failed to upload manifest to %s: %v", destination.Name, err)
+		}
+	}
+
+	if s.config.Backup.Incremental.Enabled {
+		result.Index.LastBackup = fileName
+		if previous != nil {
+			result.Index.Incrementals = previous.Incrementals + 1
+		}
+		if err := s.saveIndex(result.Index, key, stored); err != nil {
+			// The next run notices the missing index and falls back to a full backup
+			log.Printf("Failed to save backup index: %v", err)
 		}
 	}
 
+	for _, destination := range stored {
+		if destination.WriteOnly && destination.RetentionLimit > 0 {
+			log.Printf("Not deleting old backups from %s, which is write-only", destination.Name)
+			continue
+		}
+		s.applyRetention(destination)
+	}
+
+	for _, destination := range s.destinations {
+		if !destination.WriteOnly {
+			s.abortStaleUploads(destination)
+		}
+	}
+
+	retries := s.retriesSince(before)
+	for i := range replicas {
+		replicas[i].Retries = retries[i]
+	}
+
 	log.Println("Sending success notification...")
-	if err := s.notifier.SendBackupSuccess(fileName, fileURL, fileSize); err != nil {
+	if err := s.notifier.SendBackupSuccess(notification.BackupResult{
+		FileName:     fileName,
+		FileURL:      fileURL,
+		LinkExpires:  linkExpires,
+		FileSize:     result.Size,
+		Checksum:     result.Checksum,
+		Retries:      sum(retries),
+		Destinations: replicas,
+	}); err != nil {
 		log.Printf("Failed to send notification: %v", err)
 	}
 
@@ -130,3 +217,380 @@ func (s *BackupScheduler) runBackup() error {
 func (s *BackupScheduler) RunOnce() error {
 	return s.runBackup()
 }
+
+// uploadArchive writes the archive to a temporary file and uploads it to
+// each destination in turn, then moves it into the cache. It returns the
+// upload error of every destination.
+func (s *BackupScheduler) uploadArchive(fileName string, opts backup.ArchiveOptions, metadata backup.Metadata) (*backup.ArchiveResult, []error, error) {
+	archivePath := filepath.Join(s.tempDir, fileName)
+	defer os.Remove(archivePath)
+
+	result, err := backup.CreateArchive(s.folders(), archivePath, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create archive: %w", err)
+	}
+	log.Printf("Archive created: %s (size: %d bytes)", fileName, result.Size)
+
+	metadata.Files = result.Manifest.RegularFiles()
+	metadata.UncompressedSize = result.Manifest.TotalSize()
+	metadata.Checksum = result.Checksum
+
+	errs := make([]error, len(s.destinations))
+	for i, destination := range s.destinations {
+		log.Printf("Uploading archive to %s...", destination.Name)
+		// No deadline: large archives take long, and failed parts are retried on their own
+		errs[i] = destination.Backend.UploadFile(context.Background(), fileName, archivePath, metadata.Map())
+		destination.discardMismatched(fileName, errs[i])
+	}
+	s.cacheArchive(fileName, archivePath, result.Checksum, errs)
+	return result, errs, nil
+}
+
+// streamArchive pipes the archive straight into a multipart upload on
+// every destination at once, so parts are uploaded while files are still
+// being read and no temporary file is needed. It returns the upload error
+// of every destination. The metadata of a streamed archive is sent before
+// its contents are known, so it has no checksum or file count.
+func (s *BackupScheduler) streamArchive(fileName string, opts backup.ArchiveOptions, metadata backup.Metadata) (*backup.ArchiveResult, []error, error) {
+	log.Println("Streaming archive...")
+	values := metadata.Map()
+
+	var wg sync.WaitGroup
+	writers := make([]*io.PipeWriter, len(s.destinations))
+	uploaded := make([]int64, len(s.destinations))
+	errs := make([]error, len(s.destinations))
+	for i, destination := range s.destinations {
+		pipeReader, pipeWriter := io.Pipe()
+		writers[i] = pipeWriter
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// No deadline: the upload takes as long as reading the folders does
+			uploaded[i], errs[i] = destination.Backend.UploadStream(context.Background(), fileName, pipeReader, values)
+			// Unblocks the archiver if the upload stopped reading early
+			pipeReader.CloseWithError(errs[i])
+			destination.discardMismatched(fileName, errs[i])
+		}()
+	}
+
+	var archive io.Writer = newFanOutWriter(writers)
+	cached := s.newCacheWriter(fileName)
+	if cached != nil {
+		archive = io.MultiWriter(archive, cached)
+	}
+
+	result, archiveErr := backup.WriteArchive(archive, s.folders(), opts)
+	// A failed archive fails the uploads, which then abort instead of
+	// completing with a truncated object
+	for _, pipeWriter := range writers {
+		pipeWriter.CloseWithError(archiveErr)
+	}
+	wg.Wait()
+
+	if archiveErr != nil {
+		if cached != nil {
+			cached.discard()
+		}
+		if errors.Is(archiveErr, errAllUploadsFailed) {
+			return nil, errs, nil
+		}
+		return nil, nil, fmt.Errorf("failed to create archive: %w", archiveErr)
+	}
+	for i := range errs {
+		if errs[i] == nil && uploaded[i] != result.Size {
+			errs[i] = fmt.Errorf("uploaded %d bytes but the archive is %d bytes", uploaded[i], result.Size)
+		}
+	}
+	if cached != nil {
+		cached.finish(s, fileName, result.Checksum, errs)
+	}
+	return result, errs, nil
+}
+
+// resumePendingUploads finishes archive uploads a previous process was
+// killed in the middle of, and reports them like any other backup. The
+// index of such a run was never saved, so the next incremental run starts
+// a new chain rather than building on it.
+func (s *BackupScheduler) resumePendingUploads() {
+	// Temporary archives are removed once every destination had its turn,
+	// as several may be resuming uploads of the same file
+	var finished []string
+	defer func() {
+		for _, filePath := range finished {
+			os.Remove(filePath)
+		}
+	}()
+
+	for _, destination := range s.destinations {
+		resumable, ok := destination.Backend.(storage.ResumableBackend)
+		if !ok {
+			continue
+		}
+
+		resumed, err := resumable.ResumePendingUploads(context.Background())
+		if err != nil {
+			log.Printf("Failed to resume interrupted uploads to %s: %v", destination.Name, err)
+		}
+
+		for _, upload := range resumed {
+			if filepath.Dir(upload.FilePath) == filepath.Clean(s.tempDir) {
+				finished = append(finished, upload.FilePath)
+			}
+			if upload.Err != nil {
+				log.Printf("Failed to resume upload of %s to %s: %v", upload.Key, destination.Name, upload.Err)
+				destination.discardMismatched(upload.Key, upload.Err)
+				continue
+			}
+			log.Printf("Resumed interrupted upload of %s to %s", upload.Key, destination.Name)
+			fileURL, linkExpires := destination.link(upload.Key)
+			if err := s.notifier.SendBackupSuccess(notification.BackupResult{
+				FileName:     upload.Key,
+				FileURL:      fileURL,
+				LinkExpires:  linkExpires,
+				FileSize:     upload.Size,
+				Destinations: []notification.DestinationResult{{Name: destination.Name, URL: fileURL}},
+			}); err != nil {
+				log.Printf("Failed to send notification: %v", err)
+			}
+		}
+	}
+}
+
+// abortStaleUploads sweeps away multipart uploads that were abandoned
+// without a trace, such as those of a host that never came back
+func (s *BackupScheduler) abortStaleUploads(destination Destination) error {
+	resumable, ok := destination.Backend.(storage.ResumableBackend)
+	if !ok || s.config.Upload.AbortStaleAfter <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	aborted, err := resumable.AbortStaleUploads(ctx, s.config.Backup.NamePrefix, s.config.Upload.AbortStaleAfter)
+	if err != nil {
+		log.Printf("Failed to abort stale multipart uploads on %s: %v", destination.Name, err)
+		return fmt.Errorf("failed to abort stale multipart uploads on %s: %w", destination.Name, err)
+	}
+	if aborted > 0 {
+		log.Printf("Aborted %d stale multipart upload(s) on %s", aborted, destination.Name)
+	}
+	return nil
+}
+
+// uploadManifest stores the manifest of an archive next to it, encrypted
+// like the archive
+func (s *BackupScheduler) uploadManifest(backend storage.Backend, fileName string, manifest *backup.Manifest, key *backup.Key) error {
+	var buf bytes.Buffer
+	if err := manifest.Write(&buf, key); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	return backend.Upload(ctx, backup.ManifestFilename(fileName), &buf, int64(buf.Len()))
+}
+
+// folders returns the configured folders with the job-wide patterns
+// applied in addition to each folder's own
+func (s *BackupScheduler) folders() []backup.Folder {
+	folders := make([]backup.Folder, len(s.config.Backup.Folders))
+	for i, folder := range s.config.Backup.Folders {
+		folders[i] = backup.Folder{
+			Path:    folder.Path,
+			Exclude: append(slices.Clone(s.config.Backup.Exclude), folder.Exclude...),
+			Include: append(slices.Clone(s.config.Backup.Include), folder.Include...),
+		}
+	}
+	return folders
+}
+
+// metadata describes the backup called name. The contents of the archive
+// are left unknown.
+func (s *BackupScheduler) metadata(name backup.BackupName) backup.Metadata {
+	host, err := os.Hostname()
+	if err != nil {
+		log.Printf("Failed to get hostname: %v", err)
+	}
+
+	folders := make([]string, len(s.config.Backup.Folders))
+	for i, folder := range s.config.Backup.Folders {
+		folders[i] = folder.Path
+	}
+
+	encryption := "none"
+	if name.Encrypted {
+		encryption = backup.EncryptionScheme
+	}
+	return backup.Metadata{
+		Host:             host,
+		Job:              s.config.Backup.NamePrefix,
+		Folders:          folders,
+		Files:            -1,
+		UncompressedSize: -1,
+		Version:          Version,
+		Compression:      name.Compression,
+		Encryption:       encryption,
+	}
+}
+
+// encryptionKey loads the key on every run, so a key file that has gone
+// missing fails the backup instead of silently uploading plaintext
+func (s *BackupScheduler) encryptionKey() (*backup.Key, error) {
+	if !s.config.Encryption.Enabled {
+		return nil, nil
+	}
+
+	key, err := backup.LoadKey(s.config.Encryption.Key, s.config.Encryption.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// listBackups returns the archives for the configured name prefix on
+// backend, oldest first
+func (s *BackupScheduler) listBackups(ctx context.Context, backend storage.Backend) ([]string, error) {
+	files, err := backend.List(ctx, s.config.Backup.NamePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Name
+	}
+	return backup.FilterBackups(names, s.config.Backup.NamePrefix), nil
+}
+
+// applyRetention deletes the backups on a destination beyond its
+// retention limit and reports each deletion
+func (s *BackupScheduler) applyRetention(destination Destination) error {
+	if destination.RetentionLimit <= 0 {
+		return nil
+	}
+
+	log.Printf("Checking for old backups to delete on %s (retention limit: %d)...", destination.Name, destination.RetentionLimit)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	deletedFiles, err := s.cleanupOldBackups(ctx, destination)
+	if err != nil {
+		log.Printf("Failed to cleanup old backups on %s: %v", destination.Name, err)
+	}
+	if len(deletedFiles) > 0 {
+		log.Printf("Deleted %d old backup(s) from %s", len(deletedFiles), destination.Name)
+		for _, deletedFile := range deletedFiles {
+			deletedFileURL := destination.Backend.URL(deletedFile)
+			if err := s.notifier.SendBackupDeletion(deletedFile, deletedFileURL); err != nil {
+				log.Printf("Failed to send deletion notification for %s: %v", deletedFile, err)
+			} else {
+				log.Printf("Sent deletion notification for: %s", deletedFile)
+			}
+		}
+	} else if err == nil {
+		log.Printf("No old backups to delete on %s", destination.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to cleanup old backups on %s: %w", destination.Name, err)
+	}
+	return nil
+}
+
+// cleanupOldBackups deletes backups beyond the retention limit of a
+// destination. Full backups that retained incremental backups depend on
+// are kept.
+func (s *BackupScheduler) cleanupOldBackups(ctx context.Context, destination Destination) ([]string, error) {
+	backups, err := s.listBackups(ctx, destination.Backend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files for cleanup: %w", err)
+	}
+
+	var deletedFiles []string
+	for _, name := range backup.ExpiredBackups(backups, destination.RetentionLimit) {
+		if err := destination.Backend.Delete(ctx, name); err != nil {
+			return deletedFiles, fmt.Errorf("failed to delete file %s: %w", name, err)
+		}
+		deletedFiles = append(deletedFiles, name)
+		if err := destination.Backend.Delete(ctx, backup.ManifestFilename(name)); err != nil {
+			log.Printf("Failed to delete manifest of %s: %v", name, err)
+		}
+	}
+	return deletedFiles, nil
+}
+
+func (s *BackupScheduler) indexPath() string {
+	return filepath.Join(s.config.Backup.Incremental.IndexDir, backup.IndexFilename(s.config.Backup.NamePrefix))
+}
+
+// previousIndex returns the index the next incremental backup builds on,
+// or nil when the next backup has to be a full one. The chain is tracked
+// against the primary destination. The local index is preferred; the copy
+// in the bucket lets a fresh host continue the chain.
+func (s *BackupScheduler) previousIndex(key *backup.Key) *backup.Index {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	backups, err := s.listBackups(ctx, s.primary().Backend)
+	if err != nil {
+		log.Printf("Failed to list backups, running a full backup: %v", err)
+		return nil
+	}
+	if len(backups) == 0 {
+		log.Println("No previous backup found, running a full backup")
+		return nil
+	}
+	latest := backups[len(backups)-1]
+
+	index, err := backup.LoadIndex(s.indexPath(), key)
+	if err != nil || index.LastBackup != latest {
+		log.Println("Local backup index is missing or stale, fetching it from the destination...")
+		if index, err = s.downloadIndex(ctx, key); err != nil {
+			log.Printf("Failed to fetch backup index, running a full backup: %v", err)
+			return nil
+		}
+		if index.LastBackup != latest {
+			log.Printf("Backup index belongs to %s but the latest backup is %s, running a full backup", index.LastBackup, latest)
+			return nil
+		}
+	}
+
+	if index.Incrementals+1 >= s.config.Backup.Incremental.FullEvery {
+		log.Printf("Reached %d runs since the last full backup, running a full backup", s.config.Backup.Incremental.FullEvery)
+		return nil
+	}
+	return index
+}
+
+func (s *BackupScheduler) downloadIndex(ctx context.Context, key *backup.Key) (*backup.Index, error) {
+	body, err := s.primary().Backend.Download(ctx, backup.IndexFilename(s.config.Backup.NamePrefix))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return backup.ReadIndex(body, key)
+}
+
+// saveIndex stores the index locally and uploads it next to the archives
+// on every destination that has them
+func (s *BackupScheduler) saveIndex(index *backup.Index, key *backup.Key, destinations []Destination) error {
+	indexPath := s.indexPath()
+	if err := index.Save(indexPath, key); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	var errs []error
+	for _, destination := range destinations {
+		if err := destination.Backend.UploadFile(ctx, backup.IndexFilename(s.config.Backup.NamePrefix), indexPath, nil); err != nil {
+			destination.discardMismatched(backup.IndexFilename(s.config.Backup.NamePrefix), err)
+			errs = append(errs, fmt.Errorf("failed to upload backup index to %s: %w", destination.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,580 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/backup"
+	"github.com/IndrajeethY/CloudFlareBackuper/config"
+	"github.com/IndrajeethY/CloudFlareBackuper/notification"
+	"github.com/IndrajeethY/CloudFlareBackuper/storage"
+	"golang.org/x/net/webdav"
+)
+
+// recordingNotifier keeps every notification it is sent
+type recordingNotifier struct {
+	successes []notification.BackupResult
+	failures  []error
+	deletions []string
+}
+
+func (r *recordingNotifier) SendBackupSuccess(result notification.BackupResult) error {
+	r.successes = append(r.successes, result)
+	return nil
+}
+
+func (r *recordingNotifier) SendBackupFailure(err error) error {
+	r.failures = append(r.failures, err)
+	return nil
+}
+
+func (r *recordingNotifier) SendBackupDeletion(fileName, fileURL string) error {
+	r.deletions = append(r.deletions, fileName)
+	return nil
+}
+
+func (r *recordingNotifier) SendVerifyResult(result notification.VerifyResult) error {
+	return nil
+}
+
+func newTestScheduler(t *testing.T, source string) (*BackupScheduler, storage.Backend, *recordingNotifier) {
+	t.Helper()
+	cfg := &config.Config{
+		Discord:     config.DiscordConfig{WebhookURL: "https://discord.invalid/webhook"},
+		Destination: config.DestinationConfig{Type: config.DestinationLocal, Path: filepath.Join(t.TempDir(), "backups")},
+		Backup: config.BackupConfig{
+			Schedule:       "@daily",
+			Folders:        []config.FolderConfig{{Path: source}},
+			NamePrefix:     "job",
+			RetentionLimit: 2,
+		},
+		Upload: config.UploadConfig{StateDir: t.TempDir()},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := storage.NewLocalBackend(cfg.Destinations[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier := &recordingNotifier{}
+	scheduler := NewBackupScheduler(cfg, []Destination{{
+		Name:           "local",
+		Backend:        backend,
+		RetentionLimit: cfg.Backup.RetentionLimit,
+	}}, notifier)
+	scheduler.tempDir = t.TempDir()
+	return scheduler, backend, notifier
+}
+
+// TestRunBackupToLocalDestination runs a whole backup against a directory:
+// archive, manifest sidecar, retention and notifications
+func TestRunBackupToLocalDestination(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scheduler, backend, notifier := newTestScheduler(t, source)
+
+	ctx := context.Background()
+	for _, old := range []string{"job-20200101-000000.tar.gz", "job-20200102-000000.tar.gz"} {
+		for _, key := range []string{old, backup.ManifestFilename(old)} {
+			if err := backend.Upload(ctx, key, strings.NewReader("old"), 3); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := scheduler.RunOnce(); err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+
+	if len(notifier.successes) != 1 || len(notifier.failures) != 0 {
+		t.Fatalf("Expected one success notification, got %+v and %v", notifier.successes, notifier.failures)
+	}
+	result := notifier.successes[0]
+	if !strings.HasPrefix(result.FileURL, "file://") || result.Checksum == "" {
+		t.Errorf("Unexpected success notification %+v", result)
+	}
+	if len(notifier.deletions) != 1 || notifier.deletions[0] != "job-20200101-000000.tar.gz" {
+		t.Errorf("Expected the oldest backup to be deleted, got %v", notifier.deletions)
+	}
+
+	files, err := backend.List(ctx, "job-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	if len(names) != 4 {
+		t.Errorf("Expected two archives with their manifests, got %v", names)
+	}
+
+	body, err := backend.Download(ctx, result.FileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	target := t.TempDir()
+	if _, err := backup.ExtractArchive(body, backup.RestoreOptions{TargetDir: target}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(target, source, "data.txt")); err != nil || string(data) != "payload" {
+		t.Errorf("Restored %q, %v", data, err)
+	}
+}
+
+// failingBackend refuses every archive upload
+type failingBackend struct {
+	storage.Backend
+}
+
+func (f failingBackend) UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error {
+	return errors.New("destination unreachable")
+}
+
+func (f failingBackend) UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	return 0, errors.New("destination unreachable")
+}
+
+// corruptingBackend stores archives that do not match what was uploaded,
+// and records what is deleted from it
+type corruptingBackend struct {
+	storage.Backend
+	deleted *[]string
+}
+
+func (c corruptingBackend) Delete(ctx context.Context, key string) error {
+	if c.deleted != nil {
+		*c.deleted = append(*c.deleted, key)
+	}
+	return nil
+}
+
+func (c corruptingBackend) UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error {
+	return fmt.Errorf("failed to verify %s: %w", key, storage.ErrChecksumMismatch)
+}
+
+func (c corruptingBackend) UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	io.Copy(io.Discard, body)
+	return 0, fmt.Errorf("failed to verify %s: %w", key, storage.ErrChecksumMismatch)
+}
+
+// flakyBackend fails the first uploads with a dropped connection
+type flakyBackend struct {
+	storage.Backend
+	failures *int
+}
+
+func (f flakyBackend) UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error {
+	if *f.failures > 0 {
+		*f.failures--
+		return fmt.Errorf("failed to upload %s: %w", key, syscall.ECONNRESET)
+	}
+	return f.Backend.UploadFile(ctx, key, filePath, metadata)
+}
+
+func listNames(t *testing.T, backend storage.Backend, prefix string) []string {
+	t.Helper()
+	files, err := backend.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+// TestRunBackupReplicates uploads to two destinations with their own
+// prefix and retention, in both upload modes
+func TestRunBackupReplicates(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		source := t.TempDir()
+		if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("payload"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		scheduler, primary, notifier := newTestScheduler(t, source)
+		scheduler.config.Backup.Streaming = streaming
+
+		nas, err := storage.NewLocalBackend(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		secondary := storage.WithPrefix(nas, "hosts/web1/")
+		scheduler.destinations = append(scheduler.destinations, Destination{Name: "nas", Backend: secondary, RetentionLimit: 1})
+
+		ctx := context.Background()
+		if err := secondary.Upload(ctx, "job-20200101-000000.tar.gz", strings.NewReader("old"), 3); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := scheduler.RunOnce(); err != nil {
+			t.Fatalf("RunOnce failed: %v", err)
+		}
+
+		if len(notifier.successes) != 1 {
+			t.Fatalf("Expected one success notification, got %+v", notifier.successes)
+		}
+		result := notifier.successes[0]
+		if len(result.Destinations) != 2 || result.Destinations[0].Err != nil || result.Destinations[1].Err != nil {
+			t.Errorf("Unexpected destination results %+v", result.Destinations)
+		}
+		if names := listNames(t, primary, "job-"); len(names) != 2 {
+			t.Errorf("Expected the archive and its manifest on the primary destination, got %v", names)
+		}
+		if names := listNames(t, nas, "hosts/web1/"); len(names) != 2 || names[0] != "hosts/web1/"+result.FileName {
+			t.Errorf("Expected only the new archive and manifest under the prefix, got %v", names)
+		}
+		if len(notifier.deletions) != 1 {
+			t.Errorf("Expected the old backup on the secondary to be deleted, got %v", notifier.deletions)
+		}
+	}
+}
+
+// TestRunBackupBestEffortFailure reports a failed best effort destination
+// without failing the backup
+func TestRunBackupBestEffortFailure(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scheduler, _, notifier := newTestScheduler(t, source)
+	nas, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.destinations = append(scheduler.destinations, Destination{Name: "nas", Backend: failingBackend{nas}, BestEffort: true})
+
+	if err := scheduler.RunOnce(); err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+	if len(notifier.successes) != 1 {
+		t.Fatalf("Expected one success notification, got %+v", notifier.successes)
+	}
+	destinations := notifier.successes[0].Destinations
+	if len(destinations) != 2 || destinations[0].Err != nil || destinations[1].Err == nil {
+		t.Errorf("Expected only the nas destination to fail, got %+v", destinations)
+	}
+	if names := listNames(t, nas, ""); len(names) != 0 {
+		t.Errorf("Expected nothing on the failed destination, got %v", names)
+	}
+}
+
+// TestRunBackupRequiredFailure fails the backup when a required
+// destination is missed, in both upload modes
+func TestRunBackupRequiredFailure(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		source := t.TempDir()
+		if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("payload"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		scheduler, primary, notifier := newTestScheduler(t, source)
+		scheduler.config.Backup.Streaming = streaming
+		scheduler.destinations = append(scheduler.destinations, Destination{Name: "nas", Backend: failingBackend{primary}})
+
+		err := scheduler.RunOnce()
+		if err == nil || !strings.Contains(err.Error(), "nas: destination unreachable") {
+			t.Fatalf("Expected the nas failure to fail the backup, got %v", err)
+		}
+		if len(notifier.successes) != 0 {
+			t.Errorf("Expected no success notification, got %+v", notifier.successes)
+		}
+		if names := listNames(t, primary, "job-"); len(names) != 1 {
+			t.Errorf("Expected the archive to still reach the other destination, got %v", names)
+		}
+	}
+}
+
+// TestRunBackupChecksumMismatch fails the backup when a stored archive does
+// not match, even on a best effort destination, and deletes no old backups
+func TestRunBackupChecksumMismatch(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		source := t.TempDir()
+		if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("payload"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		scheduler, primary, notifier := newTestScheduler(t, source)
+		scheduler.config.Backup.Streaming = streaming
+		var deleted []string
+		scheduler.destinations = append(scheduler.destinations, Destination{Name: "nas", Backend: corruptingBackend{primary, &deleted}, BestEffort: true})
+
+		ctx := context.Background()
+		for _, name := range []string{"job-20200101-000000.tar.gz", "job-20200102-000000.tar.gz"} {
+			if err := primary.Upload(ctx, name, strings.NewReader("old"), 3); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := scheduler.RunOnce()
+		if !errors.Is(err, storage.ErrChecksumMismatch) {
+			t.Fatalf("Expected the mismatch to fail the backup, got %v", err)
+		}
+		if len(notifier.successes) != 0 || len(notifier.deletions) != 0 {
+			t.Errorf("Expected no success or deletion, got %+v and %v", notifier.successes, notifier.deletions)
+		}
+		if names := listNames(t, primary, "job-2020"); len(names) != 2 {
+			t.Errorf("Expected the old backups to be kept, got %v", names)
+		}
+		if len(deleted) != 1 || !strings.HasPrefix(deleted[0], "job-") {
+			t.Errorf("Expected the mismatched archive to be deleted, got %v", deleted)
+		}
+	}
+}
+
+// TestRunBackupChecksumMismatchWriteOnly keeps the mismatched archive on a
+// write-only destination
+func TestRunBackupChecksumMismatchWriteOnly(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scheduler, primary, _ := newTestScheduler(t, source)
+	var deleted []string
+	scheduler.destinations = append(scheduler.destinations, Destination{
+		Name:      "nas",
+		Backend:   storage.WithWriteOnly(corruptingBackend{primary, &deleted}),
+		WriteOnly: true,
+	})
+
+	if err := scheduler.RunOnce(); !errors.Is(err, storage.ErrChecksumMismatch) {
+		t.Fatalf("Expected the mismatch to fail the backup, got %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("Expected no DELETE on a write-only destination, got %v", deleted)
+	}
+}
+
+func TestRunBackupCountsRetries(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scheduler, _, notifier := newTestScheduler(t, source)
+	nas, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures := 2
+	policy := storage.RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond}
+	scheduler.destinations = append(scheduler.destinations, Destination{
+		Name:    "nas",
+		Backend: storage.WithRetry(flakyBackend{Backend: nas, failures: &failures}, policy),
+	})
+
+	if err := scheduler.RunOnce(); err != nil {
+		t.Fatalf("Expected the retried upload to succeed: %v", err)
+	}
+	if len(notifier.successes) != 1 {
+		t.Fatalf("Expected one success notification, got %+v", notifier.successes)
+	}
+	result := notifier.successes[0]
+	if result.Retries != 2 || result.Destinations[0].Retries != 0 || result.Destinations[1].Retries != 2 {
+		t.Errorf("Expected 2 retries on nas, got %d in total and %+v", result.Retries, result.Destinations)
+	}
+
+	failures = 3
+	err = scheduler.RunOnce()
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") || !strings.Contains(err.Error(), "retried 2 time(s)") {
+		t.Errorf("Expected the failure to report the retries, got %v", err)
+	}
+}
+
+// TestRunBackupWithKeyLayout shares a bucket between hosts and jobs, and
+// checks that retention only deletes backups of its own host and job
+func TestRunBackupWithKeyLayout(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scheduler, _, notifier := newTestScheduler(t, source)
+	bucket, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(host string) storage.Backend {
+		layout, err := backup.NewKeyLayout("{{.Host}}/{{.Job}}/{{.Year}}/{{.Month}}/{{.Name}}", host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage.WithKeyLayout(bucket, layout)
+	}
+	web1, web2 := open("web1"), open("web2")
+	scheduler.destinations = []Destination{{Name: "bucket", Backend: web1, RetentionLimit: 2}}
+
+	ctx := context.Background()
+	for _, backend := range []storage.Backend{web1, web2} {
+		for _, name := range []string{"job-20200101-000000.tar.gz", "job-20200201-000000.tar.gz", "other-20200101-000000.tar.gz"} {
+			if err := backend.Upload(ctx, name, strings.NewReader("old"), 3); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := scheduler.RunOnce(); err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+	if len(notifier.successes) != 1 {
+		t.Fatalf("Expected one success notification, got %+v", notifier.successes)
+	}
+	fileName := notifier.successes[0].FileName
+
+	if names := backup.FilterBackups(listNames(t, web1, "job-"), "job"); len(names) != 2 || names[0] != "job-20200201-000000.tar.gz" || names[1] != fileName {
+		t.Errorf("Expected web1's oldest job backup to be deleted, got %v", names)
+	}
+	if names := listNames(t, web1, "other-"); len(names) != 1 {
+		t.Errorf("Expected web1's other job to be kept, got %v", names)
+	}
+	if names := listNames(t, web2, ""); len(names) != 3 {
+		t.Errorf("Expected web2's backups to be kept, got %v", names)
+	}
+	if len(notifier.deletions) != 1 || notifier.deletions[0] != "job-20200101-000000.tar.gz" {
+		t.Errorf("Expected one deletion, got %v", notifier.deletions)
+	}
+
+	parsed, _ := backup.ParseBackupName(fileName)
+	key := fmt.Sprintf("web1/job/%s/%s", parsed.Time.Format("2006"), parsed.Time.Format("01"))
+	for _, name := range []string{fileName, backup.ManifestFilename(fileName)} {
+		if _, err := bucket.Stat(ctx, key+"/"+name); err != nil {
+			t.Errorf("Expected %s under %s: %v", name, key, err)
+		}
+	}
+}
+
+// TestRunBackupKeepsCachedCopy keeps the archive in the local cache in
+// both upload modes, unless no destination stored it
+func TestRunBackupKeepsCachedCopy(t *testing.T) {
+	for _, streaming := range []bool{false, true} {
+		source := t.TempDir()
+		if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("payload"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		scheduler, primary, notifier := newTestScheduler(t, source)
+		scheduler.config.Backup.Streaming = streaming
+		cacheDir := t.TempDir()
+		scheduler.cache = backup.NewCache(cacheDir, 1, 0)
+
+		if err := scheduler.RunOnce(); err != nil {
+			t.Fatalf("RunOnce failed: %v", err)
+		}
+		result := notifier.successes[0]
+		file, err := scheduler.cache.Open(result.FileName, result.Checksum, result.FileSize)
+		if err != nil {
+			t.Fatalf("Expected a cached copy matching the upload (streaming: %v): %v", streaming, err)
+		}
+		file.Close()
+		if entries, _ := os.ReadDir(scheduler.tempDir); len(entries) != 0 {
+			t.Errorf("Expected no temporary archive to be left behind, got %v", entries)
+		}
+
+		scheduler.destinations = []Destination{{Name: "local", Backend: failingBackend{primary}}}
+		if err := scheduler.RunOnce(); err == nil {
+			t.Fatal("Expected the failed upload to fail the backup")
+		}
+		if entries, _ := os.ReadDir(cacheDir); len(entries) != 2 {
+			t.Errorf("Expected only the first archive and its checksum in the cache, got %v", entries)
+		}
+	}
+}
+
+// TestRunBackupWriteOnly never deletes from a write-only destination, and
+// leaves retention to Prune
+func TestRunBackupWriteOnly(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scheduler, backend, notifier := newTestScheduler(t, source)
+	scheduler.destinations = []Destination{{
+		Name:           "local",
+		Backend:        storage.WithWriteOnly(backend),
+		RetentionLimit: 2,
+		WriteOnly:      true,
+	}}
+
+	ctx := context.Background()
+	for _, old := range []string{"job-20200101-000000.tar.gz", "job-20200102-000000.tar.gz"} {
+		if err := backend.Upload(ctx, old, strings.NewReader("old"), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := scheduler.RunOnce(); err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+	if names := backup.FilterBackups(listNames(t, backend, "job-"), "job"); len(names) != 3 {
+		t.Errorf("Expected every backup to be kept, got %v", names)
+	}
+	if len(notifier.deletions) != 0 {
+		t.Errorf("Expected no deletions, got %v", notifier.deletions)
+	}
+
+	// The prune credentials open the destination without the restriction
+	scheduler.destinations = []Destination{{Name: "local", Backend: backend, RetentionLimit: 2}}
+	if err := scheduler.Prune(); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if names := backup.FilterBackups(listNames(t, backend, "job-"), "job"); len(names) != 2 || names[0] != "job-20200102-000000.tar.gz" {
+		t.Errorf("Expected the oldest backup to be pruned, got %v", names)
+	}
+	if len(notifier.deletions) != 1 || len(notifier.successes) != 1 {
+		t.Errorf("Expected one deletion and no new backup, got %v and %d backup(s)", notifier.deletions, len(notifier.successes))
+	}
+
+	// Pruning a write-only backend fails rather than silently keeping backups
+	scheduler.destinations = []Destination{{Name: "local", Backend: storage.WithWriteOnly(backend), RetentionLimit: 1}}
+	if err := scheduler.Prune(); !errors.Is(err, storage.ErrWriteOnly) {
+		t.Errorf("Expected ErrWriteOnly, got %v", err)
+	}
+}
+
+// TestRunBackupToWebDAV applies retention to a WebDAV share like to any
+// other destination
+func TestRunBackupToWebDAV(t *testing.T) {
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "data.txt"), []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	scheduler, _, notifier := newTestScheduler(t, source)
+	server := httptest.NewServer(&webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()})
+	defer server.Close()
+	backend, err := storage.NewWebDAVBackend(storage.WebDAVOptions{URL: server.URL + "/backups"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.destinations = []Destination{{Name: "webdav", Backend: backend, RetentionLimit: 2}}
+
+	ctx := context.Background()
+	for _, old := range []string{"job-20200101-000000.tar.gz", "job-20200102-000000.tar.gz"} {
+		if err := backend.Upload(ctx, old, strings.NewReader("old"), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := scheduler.RunOnce(); err != nil {
+		t.Fatalf("RunOnce failed: %v", err)
+	}
+	fileName := notifier.successes[0].FileName
+	if names := backup.FilterBackups(listNames(t, backend, "job-"), "job"); len(names) != 2 || names[1] != fileName {
+		t.Errorf("Expected the new backup and the newest old one, got %v", names)
+	}
+	if len(notifier.deletions) != 1 || notifier.deletions[0] != "job-20200101-000000.tar.gz" {
+		t.Errorf("Expected the oldest backup to be deleted, got %v", notifier.deletions)
+	}
+	if _, err := backend.Stat(ctx, backup.ManifestFilename(fileName)); err != nil {
+		t.Errorf("Expected the manifest next to the archive: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/config"
+	"github.com/IndrajeethY/CloudFlareBackuper/storage"
+)
+
+func runShare(args []string) error {
+	flags := flag.NewFlagSet("share", flag.ExitOnError)
+	configPath := flags.String("config", "config.yml", "Path to configuration file")
+	name := flags.String("name", "", "Backup to share (defaults to the latest backup)")
+	prefix := flags.String("prefix", "", "Name prefix used to pick the latest backup (defaults to backup.name_prefix)")
+	host := flags.String("host", "", "Host whose backups to read when backup.key_template uses {{.Host}} (defaults to this host)")
+	destination := flags.String("destination", "", "Destination to share from (defaults to the first one)")
+	expiry := flags.Duration("expiry", 0, "How long the link stays valid, at most 168h (defaults to the destination's presign_expiry, or 24h)")
+	flags.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if cfg.Backup.Mode == config.ModeRepository {
+		return fmt.Errorf("share links to archives; repository snapshots cannot be downloaded as one object")
+	}
+
+	destinationConfig, err := findDestination(cfg, *destination)
+	if err != nil {
+		return err
+	}
+	layout, err := newKeyLayout(cfg, *host)
+	if err != nil {
+		return err
+	}
+	backend, err := newBackend(cfg, destinationConfig, nil, layout)
+	if err != nil {
+		return err
+	}
+
+	if *expiry == 0 {
+		*expiry = destinationConfig.PresignExpiry
+	}
+	if *expiry == 0 {
+		*expiry = 24 * time.Hour
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *prefix == "" {
+		*prefix = cfg.Backup.NamePrefix
+	}
+
+	fileName := *name
+	if fileName == "" {
+		if fileName, err = latestBackup(ctx, backend, *prefix); err != nil {
+			return fmt.Errorf("failed to find latest backup: %w", err)
+		}
+	} else if _, err := backend.Stat(ctx, fileName); err != nil {
+		// Presigning never contacts the bucket, so check the link leads somewhere
+		return err
+	}
+
+	link, err := storage.PresignURL(ctx, backend, fileName, *expiry)
+	if errors.Is(err, storage.ErrPresignUnsupported) {
+		return fmt.Errorf("destination %s is a %s destination: %w", destinationConfig.Name, destinationConfig.Type, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Link to %s valid until %s:", fileName, time.Now().Add(*expiry).Format(time.DateTime))
+	fmt.Println(link)
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/backup"
+	"github.com/IndrajeethY/CloudFlareBackuper/config"
+	"github.com/IndrajeethY/CloudFlareBackuper/storage"
+)
+
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	configPath := flags.String("config", "config.yml", "Path to configuration file")
+	destination := flags.String("destination", "", "Destination to read from (defaults to the first one)")
+	last := flags.Int("last", 10, "Number of recent backups of each job the growth trend is measured over")
+	jsonOutput := flags.Bool("json", false, "Print the statistics as JSON instead of tables")
+	readMetadata := flags.Bool("metadata", false, "Read the host of each archive from its metadata, with a HEAD request per archive, when backup.key_template has no {{.Host}}")
+	flags.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if *last < 2 {
+		return fmt.Errorf("-last must be at least 2 to measure growth")
+	}
+
+	found, err := findDestination(cfg, *destination)
+	if err != nil {
+		return err
+	}
+	// Without the key layout, the objects of every host and job are listed
+	backend, err := newBackend(cfg, found, newBandwidth(cfg), nil)
+	if err != nil {
+		return err
+	}
+	// The layout is only used to read the host from keys
+	var layout *backup.KeyLayout
+	if cfg.Backup.KeyTemplate != "" {
+		parsed, err := newKeyLayout(cfg, "")
+		if err != nil {
+			return err
+		}
+		layout = parsed.(*backup.KeyLayout)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	objects, err := storedObjects(ctx, backend, layout, *readMetadata)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	stats := backup.NewStats(objects, *last, found.RetentionLimit)
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+	return printStats(os.Stdout, stats)
+}
+
+// storedObjects lists every object of backend. The host of each archive is
+// taken from its key when layout places it there, and otherwise from its
+// metadata when readMetadata is set. layout may be nil.
+func storedObjects(ctx context.Context, backend storage.Backend, layout *backup.KeyLayout, readMetadata bool) ([]backup.StoredObject, error) {
+	var objects []backup.StoredObject
+	for file, err := range backend.Objects(ctx, "") {
+		if err != nil {
+			return nil, err
+		}
+		object := backup.StoredObject{Key: file.Name, Size: file.Size}
+		if _, ok := backup.ParseBackupName(path.Base(file.Name)); ok {
+			host, ok := "", false
+			if layout != nil {
+				host, ok = layout.Host(file.Name)
+			}
+			if !ok && readMetadata {
+				// Metadata is only returned by a HEAD request, not by the listing
+				info, err := backend.Stat(ctx, file.Name)
+				if err != nil {
+					// Such as an archive deleted since it was listed
+					log.Printf("Skipping %s: %v", file.Name, err)
+					continue
+				}
+				metadata, _ := backup.ParseMetadata(info.Metadata)
+				host = metadata.Host
+			}
+			object.Host = host
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+func printStats(w io.Writer, stats backup.Stats) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "TOTAL\t%d objects\t%s\n", stats.Total.Objects, formatSize(stats.Total.Size))
+	fmt.Fprintf(table, "PROJECTED IN 30 DAYS\t\t%s\n", formatSize(stats.ProjectedSize))
+
+	for _, group := range []struct {
+		title string
+		usage map[string]backup.Usage
+	}{
+		{"PREFIX", stats.Prefixes},
+		{"HOST", stats.Hosts},
+	} {
+		fmt.Fprintf(table, "\n%s\tOBJECTS\tSIZE\n", group.title)
+		for _, name := range slices.Sorted(maps.Keys(group.usage)) {
+			usage := group.usage[name]
+			if group.title == "PREFIX" && name == "" {
+				name = "/"
+			}
+			fmt.Fprintf(table, "%s\t%d\t%s\n", orDash(name), usage.Objects, formatSize(usage.Size))
+		}
+	}
+
+	fmt.Fprintln(table, "\nHOST\tJOB\tOBJECTS\tSIZE\tBACKUPS\tLATEST\tAVERAGE\tGROWTH/BACKUP\tBACKUPS/DAY\tPROJECTED")
+	for _, job := range stats.Jobs {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%d\t%s\t%s\t%s (%+.1f%%)\t%.1f\t%s\n",
+			orDash(job.Host),
+			job.Job,
+			job.Objects,
+			formatSize(job.Size),
+			job.Backups,
+			latest(job.Latest),
+			formatSize(job.AverageSize),
+			formatSize(job.Growth),
+			job.GrowthPercent,
+			job.BackupsPerDay,
+			formatSize(job.ProjectedSize),
+		)
+	}
+	return table.Flush()
+}
+
+// latest formats when a job last ran, which is zero for jobs that only
+// have manifests left
+func latest(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.DateTime)
+}
+
+// formatSize formats a size, or a change in size, in binary units
+func formatSize(size int64) string {
+	const unit = 1024
+	sign := ""
+	if size < 0 {
+		sign, size = "-", -size
+	}
+	if size < unit {
+		return fmt.Sprintf("%s%d B", sign, size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%s%.1f %cB", sign, float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned, wrapped, when an object does not exist
+	ErrNotFound = errors.New("object not found")
+	// ErrPresignUnsupported is returned by PresignURL for backends that
+	// cannot share objects through signed links
+	ErrPresignUnsupported = errors.New("presigned URLs are not supported by this destination")
+	// ErrChecksumMismatch is returned, wrapped, when a stored object does
+	// not match what was uploaded
+	ErrChecksumMismatch = errors.New("stored object does not match the upload")
+)
+
+// MaxPresignExpiry is the longest a SigV4 presigned URL can be valid for
+const MaxPresignExpiry = 7 * 24 * time.Hour
+
+// Backend is a place backups are stored. Keys are slash separated paths
+// relative to the root of the backend.
+type Backend interface {
+	// Upload stores size bytes read from body under key
+	Upload(ctx context.Context, key string, body io.Reader, size int64) error
+	// UploadFile stores a local file under key with metadata attached.
+	// Backends without object metadata, such as directories, ignore it.
+	UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error
+	// UploadStream stores everything read from body under key without
+	// knowing the size in advance and returns the number of bytes stored.
+	// Nothing is stored when it fails.
+	UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error)
+	// Download streams an object. The caller must close the returned reader.
+	Download(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the objects whose key starts with prefix, oldest first
+	List(ctx context.Context, prefix string) ([]FileInfo, error)
+	// Objects streams the objects whose key starts with prefix in key
+	// order, a page at a time, so large buckets are never held in memory.
+	// Iteration ends after the first error, which is yielded.
+	Objects(ctx context.Context, prefix string) iter.Seq2[FileInfo, error]
+	// Stat describes one object, including its metadata
+	Stat(ctx context.Context, key string) (FileInfo, error)
+	Delete(ctx context.Context, key string) error
+	// URL returns a link to an object for notifications
+	URL(key string) string
+}
+
+// ResumableBackend is a Backend whose uploads can be interrupted and
+// resumed later, leaving unfinished uploads behind that need cleaning up
+type ResumableBackend interface {
+	Backend
+	// ResumePendingUploads finishes the uploads an earlier process left unfinished
+	ResumePendingUploads(ctx context.Context) ([]ResumedUpload, error)
+	// AbortStaleUploads aborts unfinished uploads under prefix older than
+	// olderThan and returns how many it aborted
+	AbortStaleUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error)
+}
+
+// Presigner is a Backend that can link to objects in a private bucket
+type Presigner interface {
+	// PresignURL returns a link that downloads key without credentials
+	// until expiry has passed
+	PresignURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// PresignURL returns a presigned link to key on backend, or
+// ErrPresignUnsupported when backend cannot make one
+func PresignURL(ctx context.Context, backend Backend, key string, expiry time.Duration) (string, error) {
+	presigner, ok := backend.(Presigner)
+	if !ok {
+		return "", ErrPresignUnsupported
+	}
+	return presigner.PresignURL(ctx, key, expiry)
+}
+
+type FileInfo struct {
+	Name         string
+	LastModified time.Time
+	Size         int64
+	// Metadata is only filled in by Stat, on backends that keep it
+	Metadata map[string]string
+	// RetainUntil is when the object's Object Lock expires. It is only
+	// filled in by Stat, for locked objects.
+	RetainUntil time.Time
+}
+
+// collect reads every object from objects, oldest first
+func collect(objects iter.Seq2[FileInfo, error]) ([]FileInfo, error) {
+	var files []FileInfo
+	for file, err := range objects {
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].LastModified.Before(files[j].LastModified)
+	})
+	return files, nil
+}
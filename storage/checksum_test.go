@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// uploadEach stores data as key with a single request, as a multipart file
+// upload and as a multipart stream
+func uploadEach(t *testing.T, client *S3Client) map[string]error {
+	t.Helper()
+	ctx := context.Background()
+
+	small, _ := writeTestFile(t, 1024)
+	large, _ := writeTestFile(t, 2*minPartSize+1)
+	_, streamErr := client.UploadStream(ctx, "stream.tar.gz", strings.NewReader(strings.Repeat("x", minPartSize+1)), nil)
+	return map[string]error{
+		"small.tar.gz":  client.UploadFile(ctx, "small.tar.gz", small, nil),
+		"large.tar.gz":  client.UploadFile(ctx, "large.tar.gz", large, nil),
+		"stream.tar.gz": streamErr,
+	}
+}
+
+func TestUploadChecksums(t *testing.T) {
+	fake, client := newFakeS3(t)
+	for key, err := range uploadEach(t, client) {
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+	}
+
+	if got, want := fake.objects["small.tar.gz"].checksum, checksum(fake.objects["small.tar.gz"].data); got != want {
+		t.Errorf("Single request upload has checksum %q, want %q", got, want)
+	}
+	for _, key := range []string{"large.tar.gz", "stream.tar.gz"} {
+		if got := fake.objects[key].checksum; !strings.HasSuffix(got, "-2") && !strings.HasSuffix(got, "-3") {
+			t.Errorf("%s: expected a composite checksum, got %q", key, got)
+		}
+	}
+	if fake.requests["HeadObject"] != 3 {
+		t.Errorf("Expected every upload to be verified, got %d HEAD requests", fake.requests["HeadObject"])
+	}
+}
+
+// TestUploadDetectsCorruption leaves mismatched objects for the caller to
+// delete through the destination's wrappers
+func TestUploadDetectsCorruption(t *testing.T) {
+	fake, client := newFakeS3(t)
+	for _, key := range []string{"small.tar.gz", "large.tar.gz", "stream.tar.gz"} {
+		fake.corrupt[key] = true
+	}
+
+	for key, err := range uploadEach(t, client) {
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("%s: expected ErrChecksumMismatch, got %v", key, err)
+		}
+		if _, ok := fake.objects[key]; !ok {
+			t.Errorf("%s: the mismatched object was deleted", key)
+		}
+	}
+	if fake.requests["DeleteObject"] != 0 {
+		t.Errorf("Expected no DELETE requests, got %d", fake.requests["DeleteObject"])
+	}
+}
+
+func TestUploadMismatchWriteOnly(t *testing.T) {
+	fake, client := newFakeS3(t)
+	fake.corrupt["small.tar.gz"] = true
+	backend := WithWriteOnly(client)
+
+	path, _ := writeTestFile(t, 1024)
+	err := backend.UploadFile(context.Background(), "small.tar.gz", path, nil)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Expected ErrChecksumMismatch, got %v", err)
+	}
+	if _, ok := fake.objects["small.tar.gz"]; !ok || fake.requests["DeleteObject"] != 0 {
+		t.Errorf("Expected the object of a write-only destination to be kept, got %d DELETE requests", fake.requests["DeleteObject"])
+	}
+}
+
+func TestUploadRejectsDamagedPart(t *testing.T) {
+	fake, client := newFakeS3(t)
+	client.upload.PartRetries = 0
+	fake.uploads["42"] = &fakeUpload{key: "key", parts: make(map[int32][]byte), checksums: make(map[int32]string)}
+
+	// The checksum is computed before the part is sent, so damage on the
+	// way is caught by the service
+	uploadID := "42"
+	part, err := client.uploadPart(context.Background(), "key", &uploadID, 1, &damagingReader{Reader: bytes.NewReader([]byte("part data"))}, 9)
+	if err == nil || !strings.Contains(err.Error(), "BadDigest") {
+		t.Fatalf("Expected the damaged part to be rejected, got %+v, %v", part, err)
+	}
+}
+
+// damagingReader flips the first byte of every read after the first pass,
+// like a flaky disk or network card
+type damagingReader struct {
+	*bytes.Reader
+	passes int
+}
+
+func (d *damagingReader) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == 0 {
+		d.passes++
+	}
+	return d.Reader.Seek(offset, whence)
+}
+
+func (d *damagingReader) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	if d.passes > 1 && n > 0 {
+		p[0] ^= 0xff
+	}
+	return n, err
+}
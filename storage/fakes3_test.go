@@ -0,0 +1,410 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const testBucket = "backups"
+
+// fakeS3 implements the part of the S3 API the client uses, in memory
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]fakeObject
+	uploads  map[string]*fakeUpload
+	nextID   int
+	requests map[string]int
+	// failParts makes the next n uploads of a part number fail
+	failParts map[int32]int
+	// failRequests are the errors returned, in order, to the next requests
+	failRequests []fakeFailure
+	// pageSize is the most keys one ListObjectsV2 response holds
+	pageSize int
+	// corrupt loses the last byte of the objects stored under these keys,
+	// after their checksums were checked
+	corrupt map[string]bool
+}
+
+type fakeFailure struct {
+	status int
+	code   string
+}
+
+type fakeObject struct {
+	data     []byte
+	modified time.Time
+	metadata http.Header
+	// checksum is the x-amz-checksum-sha256 the object reports, if any
+	checksum string
+}
+
+type fakeUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int32][]byte
+	checksums map[int32]string
+	metadata  http.Header
+}
+
+// checksum returns the base64 SHA-256 S3 checksum headers carry
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// store keeps an object, damaging it if its key is to be corrupted
+func (f *fakeS3) store(key string, object fakeObject) {
+	if f.corrupt[key] && len(object.data) > 0 {
+		object.data = object.data[:len(object.data)-1]
+		if object.checksum != "" {
+			object.checksum = checksum(object.data)
+		}
+	}
+	f.objects[key] = object
+}
+
+// userMetadata keeps the x-amz-meta-* and x-amz-object-lock-* headers of a
+// request, which HEAD returns
+func userMetadata(header http.Header) http.Header {
+	metadata := make(http.Header)
+	for name, values := range header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-meta-") || strings.HasPrefix(lower, "x-amz-object-lock-") {
+			metadata[name] = values
+		}
+	}
+	return metadata
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3Client) {
+	fake := &fakeS3{
+		objects:   make(map[string]fakeObject),
+		uploads:   make(map[string]*fakeUpload),
+		requests:  make(map[string]int),
+		failParts: make(map[int32]int),
+		pageSize:  1000,
+		corrupt:   make(map[string]bool),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:                     "auto",
+		BaseEndpoint:               aws.String(server.URL),
+		UsePathStyle:               true,
+		Credentials:                credentials.NewStaticCredentialsProvider("id", "secret", ""),
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+		RetryMaxAttempts:           1,
+	})
+	return fake, &S3Client{
+		client:    client,
+		bucket:    testBucket,
+		publicURL: "https://backups.example.com",
+		upload: UploadOptions{
+			PartSize:    minPartSize,
+			Concurrency: 3,
+			PartRetries: 2,
+			StateDir:    t.TempDir(),
+		}.withDefaults(),
+		retry: RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}.withDefaults(),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.failRequests) > 0 {
+		failure := f.failRequests[0]
+		f.failRequests = f.failRequests[1:]
+		io.Copy(io.Discard, req.Body)
+		writeS3Error(w, failure.status, failure.code)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if bucket != testBucket {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := req.URL.Query()
+	body, _ := io.ReadAll(req.Body)
+
+	switch {
+	case key == "" && req.Method == http.MethodGet && query.Has("uploads"):
+		f.requests["ListMultipartUploads"]++
+		f.listUploads(w)
+	case key == "" && req.Method == http.MethodGet:
+		f.requests["ListObjects"]++
+		f.listObjects(w, query.Get("prefix"), query.Get("continuation-token"))
+	case req.Method == http.MethodPost && query.Has("uploads"):
+		f.requests["CreateMultipartUpload"]++
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = &fakeUpload{
+			key:       key,
+			initiated: time.Now(),
+			parts:     make(map[int32][]byte),
+			checksums: make(map[int32]string),
+			metadata:  userMetadata(req.Header),
+		}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case req.Method == http.MethodPut && query.Has("uploadId"):
+		f.requests["UploadPart"]++
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if f.failParts[int32(number)] > 0 {
+			f.failParts[int32(number)]--
+			writeS3Error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		sent := req.Header.Get("x-amz-checksum-sha256")
+		if sent != "" && sent != checksum(body) {
+			writeS3Error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		upload.parts[int32(number)] = body
+		upload.checksums[int32(number)] = sent
+		w.Header().Set("ETag", etag(body))
+	case req.Method == http.MethodPost && query.Has("uploadId"):
+		f.requests["CompleteMultipartUpload"]++
+		f.completeUpload(w, bucket, key, query.Get("uploadId"), body)
+	case req.Method == http.MethodDelete && query.Has("uploadId"):
+		f.requests["AbortMultipartUpload"]++
+		if _, ok := f.uploads[query.Get("uploadId")]; !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodGet && query.Has("uploadId"):
+		f.requests["ListParts"]++
+		f.listParts(w, bucket, key, query.Get("uploadId"))
+	case req.Method == http.MethodPut:
+		f.requests["PutObject"]++
+		sent := req.Header.Get("x-amz-checksum-sha256")
+		if req.Header.Get("x-amz-object-lock-mode") != "" && sent == "" && req.Header.Get("Content-MD5") == "" {
+			// Locked objects must be sent with a checksum
+			writeS3Error(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		if sent != "" && sent != checksum(body) {
+			writeS3Error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		f.store(key, fakeObject{data: body, modified: time.Now(), metadata: userMetadata(req.Header), checksum: sent})
+		w.Header().Set("ETag", etag(body))
+	case req.Method == http.MethodHead:
+		f.requests["HeadObject"]++
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, values := range object.metadata {
+			w.Header()[name] = values
+		}
+		if req.Header.Get("x-amz-checksum-mode") == "ENABLED" && object.checksum != "" {
+			w.Header().Set("x-amz-checksum-sha256", object.checksum)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+	case req.Method == http.MethodGet:
+		f.requests["GetObject"]++
+		object, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Write(object.data)
+	case req.Method == http.MethodDelete:
+		f.requests["DeleteObject"]++
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) completeUpload(w http.ResponseWriter, bucket, key, uploadID string, body []byte) {
+	upload, ok := f.uploads[uploadID]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	var request struct {
+		Parts []struct {
+			PartNumber     int32
+			ETag           string
+			ChecksumSHA256 string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	var data []byte
+	digests := sha256.New()
+	composite := true
+	for i, part := range request.Parts {
+		stored, ok := upload.parts[part.PartNumber]
+		if !ok || etag(stored) != part.ETag || (i > 0 && request.Parts[i-1].PartNumber >= part.PartNumber) ||
+			part.ChecksumSHA256 != upload.checksums[part.PartNumber] {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		data = append(data, stored...)
+		digest, _ := base64.StdEncoding.DecodeString(part.ChecksumSHA256)
+		digests.Write(digest)
+		composite = composite && part.ChecksumSHA256 != ""
+	}
+	delete(f.uploads, uploadID)
+
+	object := fakeObject{data: data, modified: time.Now(), metadata: upload.metadata}
+	if composite {
+		object.checksum = fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(digests.Sum(nil)), len(request.Parts))
+	}
+	f.store(key, object)
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: bucket, Key: key, ETag: etag(data)})
+}
+
+func (f *fakeS3) listParts(w http.ResponseWriter, bucket, key, uploadID string) {
+	upload, ok := f.uploads[uploadID]
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	type part struct {
+		PartNumber     int32
+		ETag           string
+		Size           int
+		ChecksumSHA256 string `xml:",omitempty"`
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListPartsResult"`
+		Bucket      string
+		Key         string
+		UploadId    string
+		IsTruncated bool
+		Parts       []part `xml:"Part"`
+	}{Bucket: bucket, Key: key, UploadId: uploadID}
+	for number, data := range upload.parts {
+		result.Parts = append(result.Parts, part{PartNumber: number, ETag: etag(data), Size: len(data), ChecksumSHA256: upload.checksums[number]})
+	}
+	sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+	writeXML(w, result)
+}
+
+func (f *fakeS3) listUploads(w http.ResponseWriter) {
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Bucket      string
+		IsTruncated bool
+		Uploads     []upload `xml:"Upload"`
+	}{Bucket: testBucket}
+	for id, u := range f.uploads {
+		result.Uploads = append(result.Uploads, upload{Key: u.key, UploadId: id, Initiated: u.initiated.UTC().Format(time.RFC3339)})
+	}
+	writeXML(w, result)
+}
+
+// listObjects pages like S3, using the last key of a page as the
+// continuation token
+func (f *fakeS3) listObjects(w http.ResponseWriter, prefix, token string) {
+	type content struct {
+		Key          string
+		LastModified string
+		Size         int
+		ETag         string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{Name: testBucket, Prefix: prefix}
+	for key, object := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > token {
+			result.Contents = append(result.Contents, content{
+				Key:          key,
+				LastModified: object.modified.UTC().Format(time.RFC3339Nano),
+				Size:         len(object.data),
+				ETag:         etag(object.data),
+			})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	if len(result.Contents) > f.pageSize {
+		result.Contents = result.Contents[:f.pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = result.Contents[f.pageSize-1].Key
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, value any) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(value); err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(buf.Bytes())
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
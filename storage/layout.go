@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"iter"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// KeyLayout maps the names objects are known by to the keys they are
+// stored under. A key must end with its name as the last path element.
+type KeyLayout interface {
+	// Key returns the key name is stored under
+	Key(name string) string
+	// Prefix returns the start every key of the layout has in common
+	Prefix() string
+}
+
+// layoutBackend stores objects under the keys of a layout
+type layoutBackend struct {
+	backend Backend
+	layout  KeyLayout
+}
+
+// resumableLayoutBackend keeps the resumable uploads of the backend it wraps
+type resumableLayoutBackend struct {
+	*layoutBackend
+	resumable ResumableBackend
+}
+
+var (
+	_ Backend          = (*layoutBackend)(nil)
+	_ Presigner        = (*layoutBackend)(nil)
+	_ ResumableBackend = (*resumableLayoutBackend)(nil)
+)
+
+// WithKeyLayout returns a backend that stores every object under the key
+// layout gives its name. Listings return names, and only hold the objects
+// whose key is the one layout gives their name, so objects of other hosts
+// or jobs sharing the bucket are never listed, and never deleted by
+// retention.
+func WithKeyLayout(backend Backend, layout KeyLayout) Backend {
+	if layout == nil {
+		return backend
+	}
+
+	mapped := &layoutBackend{backend: backend, layout: layout}
+	if resumable, ok := backend.(ResumableBackend); ok {
+		return &resumableLayoutBackend{layoutBackend: mapped, resumable: resumable}
+	}
+	return mapped
+}
+
+// name returns the name key is stored for, and false if key is not part
+// of the layout
+func (l *layoutBackend) name(key string) (string, bool) {
+	name := path.Base(key)
+	return name, l.layout.Key(name) == key
+}
+
+func (l *layoutBackend) Upload(ctx context.Context, key string, body io.Reader, size int64) error {
+	return l.backend.Upload(ctx, l.layout.Key(key), body, size)
+}
+
+func (l *layoutBackend) UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error {
+	return l.backend.UploadFile(ctx, l.layout.Key(key), filePath, metadata)
+}
+
+func (l *layoutBackend) UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	return l.backend.UploadStream(ctx, l.layout.Key(key), body, metadata)
+}
+
+func (l *layoutBackend) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	return l.backend.Download(ctx, l.layout.Key(key))
+}
+
+func (l *layoutBackend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return collect(l.Objects(ctx, prefix))
+}
+
+// Objects lists every key of the layout and yields those whose name
+// starts with prefix
+func (l *layoutBackend) Objects(ctx context.Context, prefix string) iter.Seq2[FileInfo, error] {
+	return func(yield func(FileInfo, error) bool) {
+		for file, err := range l.backend.Objects(ctx, l.layout.Prefix()) {
+			if err != nil {
+				yield(file, err)
+				return
+			}
+			name, ok := l.name(file.Name)
+			if !ok || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			file.Name = name
+			if !yield(file, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (l *layoutBackend) Stat(ctx context.Context, key string) (FileInfo, error) {
+	info, err := l.backend.Stat(ctx, l.layout.Key(key))
+	if err == nil {
+		info.Name = key
+	}
+	return info, err
+}
+
+func (l *layoutBackend) Delete(ctx context.Context, key string) error {
+	return l.backend.Delete(ctx, l.layout.Key(key))
+}
+
+func (l *layoutBackend) URL(key string) string {
+	return l.backend.URL(l.layout.Key(key))
+}
+
+func (l *layoutBackend) PresignURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return PresignURL(ctx, l.backend, l.layout.Key(key), expiry)
+}
+
+func (l *layoutBackend) Retries() int64 {
+	return RetryCount(l.backend)
+}
+
+// ResumePendingUploads resumes every upload the wrapped backend left
+// unfinished. Only uploads of the layout are returned, by name.
+func (l *resumableLayoutBackend) ResumePendingUploads(ctx context.Context) ([]ResumedUpload, error) {
+	all, err := l.resumable.ResumePendingUploads(ctx)
+
+	var resumed []ResumedUpload
+	for _, upload := range all {
+		name, ok := l.name(upload.Key)
+		if !ok {
+			log.Printf("Resumed interrupted upload of %s", upload.Key)
+			continue
+		}
+		upload.Key = name
+		resumed = append(resumed, upload)
+	}
+	return resumed, err
+}
+
+// AbortStaleUploads aborts the stale uploads under the layout's prefix.
+// Keys are not ordered by name, so prefix cannot narrow it further.
+func (l *resumableLayoutBackend) AbortStaleUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error) {
+	return l.resumable.AbortStaleUploads(ctx, l.layout.Prefix(), olderThan)
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/backup"
+)
+
+func TestWithKeyLayout(t *testing.T) {
+	ctx := context.Background()
+	local, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(host string) Backend {
+		layout, err := backup.NewKeyLayout("{{.Host}}/{{.Job}}/{{.Year}}/{{.Month}}/{{.Name}}", host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return WithKeyLayout(local, layout)
+	}
+	web1, web2 := open("web1"), open("web2")
+
+	name := backup.BackupName{Prefix: "db", Time: time.Date(2024, 3, 9, 4, 5, 6, 0, time.Local)}.Filename()
+	for _, backend := range []Backend{web1, web2} {
+		if err := backend.Upload(ctx, name, strings.NewReader("data"), 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An object outside the layout, such as one uploaded by hand
+	if err := local.Upload(ctx, "web1/db/"+name, strings.NewReader("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := local.Stat(ctx, "web1/db/2024/03/"+name); err != nil {
+		t.Errorf("Expected the archive under its templated key: %v", err)
+	}
+	files, err := web1.List(ctx, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != name {
+		t.Errorf("Expected only web1's archive by name, got %+v", files)
+	}
+	if info, err := web1.Stat(ctx, name); err != nil || info.Name != name {
+		t.Errorf("Stat returned %+v, %v", info, err)
+	}
+	if url := web1.URL(name); !strings.HasSuffix(url, "/web1/db/2024/03/"+name) {
+		t.Errorf("Unexpected URL %s", url)
+	}
+
+	if err := web1.Delete(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := web2.List(ctx, ""); len(files) != 1 {
+		t.Errorf("Expected web2's archive to be kept, got %+v", files)
+	}
+	if _, err := local.Stat(ctx, "web1/db/"+name); err != nil {
+		t.Errorf("Expected the object outside the layout to be kept: %v", err)
+	}
+}
+
+func TestWithKeyLayoutKeepsResumableUploads(t *testing.T) {
+	_, client := newFakeS3(t)
+	layout, err := backup.NewKeyLayout("{{.Host}}/{{.Name}}", "web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := WithKeyLayout(client, layout).(ResumableBackend); !ok {
+		t.Error("Expected an S3 client with a key layout to stay resumable")
+	}
+	if WithKeyLayout(client, nil) != Backend(client) {
+		t.Error("Expected no layout to return the backend itself")
+	}
+}
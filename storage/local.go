@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// tempPrefix marks files that are still being written
+const tempPrefix = ".upload-"
+
+// LocalBackend stores backups in a directory, such as a second disk or an
+// NFS or SMB mount. Objects are written to a temporary file and renamed
+// into place, so a crash never leaves a partial backup under its final name.
+type LocalBackend struct {
+	root string
+}
+
+var _ Backend = (*LocalBackend)(nil)
+
+func NewLocalBackend(root string) (*LocalBackend, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", root, err)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	return &LocalBackend{root: root}, nil
+}
+
+// path maps a key to a file below the root. Keys cannot escape the root.
+func (l *LocalBackend) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (l *LocalBackend) Upload(ctx context.Context, key string, body io.Reader, size int64) error {
+	_, err := l.write(ctx, key, body, size)
+	return err
+}
+
+func (l *LocalBackend) UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = l.write(ctx, key, file, -1)
+	return err
+}
+
+func (l *LocalBackend) UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	return l.write(ctx, key, body, -1)
+}
+
+// write copies body into a temporary file next to the destination, syncs
+// it and renames it into place. A size of -1 accepts any length.
+func (l *LocalBackend) write(ctx context.Context, key string, body io.Reader, size int64) (int64, error) {
+	dest := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directory for %s: %w", key, err)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(dest), tempPrefix+"*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	tmpPath := tmpFile.Name()
+
+	written, err := io.Copy(tmpFile, contextReader{ctx: ctx, r: body})
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("read %d of %d bytes", written, size)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dest)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	return written, nil
+}
+
+func (l *LocalBackend) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to download %s: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return file, nil
+}
+
+func (l *LocalBackend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return collect(l.Objects(ctx, prefix))
+}
+
+// Objects walks the directory tree in lexical order, skipping the
+// temporary files of uploads in progress
+func (l *LocalBackend) Objects(ctx context.Context, prefix string) iter.Seq2[FileInfo, error] {
+	return func(yield func(FileInfo, error) bool) {
+		err := filepath.WalkDir(l.root, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), tempPrefix) {
+				return nil
+			}
+
+			rel, err := filepath.Rel(l.root, filePath)
+			if err != nil {
+				return err
+			}
+			key := filepath.ToSlash(rel)
+			if !strings.HasPrefix(key, prefix) {
+				return nil
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			if !yield(FileInfo{Name: key, LastModified: info.ModTime(), Size: info.Size()}, nil) {
+				return fs.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			yield(FileInfo{}, fmt.Errorf("failed to list files: %w", err))
+		}
+	}
+}
+
+func (l *LocalBackend) Stat(ctx context.Context, key string) (FileInfo, error) {
+	info, err := os.Stat(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return FileInfo{}, fmt.Errorf("failed to stat %s: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat %s: %w", key, err)
+	}
+	return FileInfo{Name: key, LastModified: info.ModTime(), Size: info.Size()}, nil
+}
+
+func (l *LocalBackend) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(l.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return nil
+}
+
+func (l *LocalBackend) URL(key string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(l.path(key))}).String()
+}
+
+// contextReader stops a copy when its context ends
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalBackend(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	backend, err := NewLocalBackend(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.Upload(ctx, "db/one.tar.gz", strings.NewReader("one"), 3); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if err := backend.Upload(ctx, "db/short.tar.gz", strings.NewReader("ab"), 3); err == nil {
+		t.Error("Expected a short body to fail the upload")
+	}
+	if size, err := backend.UploadStream(ctx, "db/two.tar.gz", strings.NewReader("second"), nil); err != nil || size != 6 {
+		t.Fatalf("UploadStream returned %d, %v", size, err)
+	}
+	// Make the listing order independent of the file system's timestamp resolution
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(root, "db", "one.tar.gz"), old, old)
+
+	files, err := backend.List(ctx, "db/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "db/one.tar.gz" || files[1].Size != 6 {
+		t.Errorf("Unexpected listing %+v", files)
+	}
+	for file, err := range backend.Objects(ctx, "db/") {
+		if err != nil || file.Name != "db/one.tar.gz" {
+			t.Errorf("Objects yielded %+v, %v first", file, err)
+		}
+		break
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, "db")); len(entries) != 2 {
+		t.Errorf("Expected no temporary files to be left, got %d entries", len(entries))
+	}
+
+	body, err := backend.Download(ctx, "db/two.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(data, []byte("second")) {
+		t.Errorf("Downloaded %q", data)
+	}
+
+	if info, err := backend.Stat(ctx, "db/one.tar.gz"); err != nil || info.Size != 3 {
+		t.Errorf("Stat returned %+v, %v", info, err)
+	}
+	if err := backend.Delete(ctx, "db/one.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Stat(ctx, "db/one.tar.gz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after deleting, got %v", err)
+	}
+	if _, err := backend.Download(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing object, got %v", err)
+	}
+}
+
+// TestLocalBackendStaysInRoot verifies that keys cannot point outside the root
+func TestLocalBackendStaysInRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	backend, err := NewLocalBackend(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backend.Upload(context.Background(), "../../escape", strings.NewReader("x"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escape")); err != nil {
+		t.Errorf("Expected the object to be stored inside the root: %v", err)
+	}
+}
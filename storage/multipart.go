@@ -0,0 +1,437 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// S3 requires every part except the last to have the same size, of at least 5 MiB
+	minPartSize     = 5 << 20
+	defaultPartSize = 16 << 20
+	// S3 accepts at most 10,000 parts in one multipart upload
+	defaultMaxParts    = 10000
+	defaultConcurrency = 4
+	defaultPartRetries = 3
+	maxRetryDelay      = 30 * time.Second
+)
+
+// UploadOptions tunes multipart uploads
+type UploadOptions struct {
+	// PartSize is the size of every part but the last. Files and streams
+	// no larger than one part are sent with a single request.
+	PartSize int64
+	// Concurrency is the number of parts uploaded at the same time
+	Concurrency int
+	// PartRetries is how often a failed part is retried before the whole
+	// upload fails
+	PartRetries int
+	// StateDir records the progress of file uploads so one interrupted by
+	// a crash or restart can be resumed. Empty disables resuming.
+	StateDir string
+	// maxParts is the most parts one upload may have
+	maxParts int64
+}
+
+func (o UploadOptions) withDefaults() UploadOptions {
+	if o.PartSize == 0 {
+		o.PartSize = defaultPartSize
+	}
+	o.PartSize = max(o.PartSize, minPartSize)
+	if o.Concurrency <= 0 {
+		o.Concurrency = defaultConcurrency
+	}
+	if o.PartRetries < 0 {
+		o.PartRetries = defaultPartRetries
+	}
+	if o.maxParts == 0 {
+		o.maxParts = defaultMaxParts
+	}
+	return o
+}
+
+// partSizeFor returns the part size a file of size bytes is uploaded
+// with: PartSize, or for files that would need more than the maximum
+// number of parts, the smallest whole number of MiB that fits them
+func (o UploadOptions) partSizeFor(size int64) int64 {
+	const unit = 1 << 20
+	needed := (size + o.maxParts - 1) / o.maxParts
+	return max(o.PartSize, (needed+unit-1)/unit*unit)
+}
+
+// UploadStream uploads everything read from body under key without
+// knowing the size in advance. Data is sent as a multipart upload while
+// it is still being produced, so memory use is bounded by the part size
+// times the number of parts in flight. Bodies smaller than one part are
+// sent with a single request. Every part is sent with its SHA-256, and the
+// stored object is checked against them afterwards. It returns the number
+// of bytes uploaded.
+//
+// Parts must all have the same size, so a stream can be at most the
+// maximum number of parts times PartSize. The upload fails, and is
+// aborted, as soon as the stream turns out to be larger.
+func (r *S3Client) UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	// Buffers are allocated on first use and recycled between parts
+	buffers := make(chan []byte, r.upload.Concurrency+1)
+	for i := 0; i < cap(buffers); i++ {
+		buffers <- nil
+	}
+	nextBuffer := func() []byte {
+		buf := <-buffers
+		if buf == nil {
+			buf = make([]byte, r.upload.PartSize)
+		}
+		return buf
+	}
+
+	buf := nextBuffer()
+	n, err := io.ReadFull(body, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		checksum, err := r.put(ctx, key, bytes.NewReader(buf[:n]), int64(n), metadata)
+		if err == nil {
+			err = r.verifyUpload(ctx, key, int64(n), checksum)
+		}
+		if err != nil {
+			return 0, err
+		}
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read upload data: %w", err)
+	}
+
+	created, err := r.client.CreateMultipartUpload(ctx, r.createMultipartUploadInput(key, metadata))
+	if err != nil {
+		return 0, fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
+
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		parts     []types.CompletedPart
+		uploadErr error
+		total     int64
+	)
+
+	for partNumber := int32(1); ; partNumber++ {
+		if int64(partNumber) > r.upload.maxParts {
+			mu.Lock()
+			if uploadErr == nil {
+				uploadErr = fmt.Errorf("stream is larger than %d parts of %d bytes; raise upload.part_size", r.upload.maxParts, r.upload.PartSize)
+			}
+			mu.Unlock()
+			break
+		}
+		last := err == io.ErrUnexpectedEOF
+		total += int64(n)
+
+		wg.Add(1)
+		go func(partNumber int32, buf []byte, size int) {
+			defer wg.Done()
+			defer func() { buffers <- buf }()
+
+			part, err := r.uploadPart(uploadCtx, key, uploadID, partNumber, bytes.NewReader(buf[:size]), int64(size))
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if uploadErr == nil {
+					uploadErr = err
+					cancel()
+				}
+				return
+			}
+			parts = append(parts, part)
+		}(partNumber, buf, n)
+
+		if last {
+			break
+		}
+
+		buf = nextBuffer()
+		if uploadCtx.Err() != nil {
+			break
+		}
+		n, err = io.ReadFull(body, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			mu.Lock()
+			if uploadErr == nil {
+				uploadErr = fmt.Errorf("failed to read upload data: %w", err)
+			}
+			mu.Unlock()
+			break
+		}
+	}
+
+	wg.Wait()
+	if uploadErr == nil && uploadCtx.Err() != nil {
+		uploadErr = uploadCtx.Err()
+	}
+	if uploadErr != nil {
+		r.abortMultipartUpload(key, uploadID)
+		return 0, uploadErr
+	}
+
+	checksum, err := r.completeMultipartUpload(ctx, key, uploadID, parts)
+	if err != nil {
+		r.abortMultipartUpload(key, uploadID)
+		return 0, err
+	}
+	if err := r.verifyUpload(ctx, key, total, checksum); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// uploadFileParts uploads a file as a multipart upload, several parts at
+// a time. Progress is recorded in the state directory after every part,
+// so when the process dies mid-upload the next attempt for the same,
+// unchanged file only sends the parts that are missing.
+func (r *S3Client) uploadFileParts(ctx context.Context, key string, file *os.File, info os.FileInfo, metadata map[string]string) error {
+	state := r.resumableUpload(ctx, key, file.Name(), info)
+	if state == nil {
+		created, err := r.client.CreateMultipartUpload(ctx, r.createMultipartUploadInput(key, metadata))
+		if err != nil {
+			return fmt.Errorf("failed to start multipart upload: %w", err)
+		}
+		state = &uploadState{
+			Bucket:    r.bucket,
+			Key:       key,
+			UploadID:  *created.UploadId,
+			FilePath:  file.Name(),
+			FileSize:  info.Size(),
+			ModTime:   info.ModTime(),
+			PartSize:  r.upload.partSizeFor(info.Size()),
+			Parts:     make(map[int32]string),
+			Checksums: make(map[int32]string),
+			Metadata:  metadata,
+		}
+	}
+	if err := r.saveUploadState(state); err != nil {
+		log.Printf("Failed to record upload progress, %s cannot be resumed: %v", key, err)
+	}
+
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		uploadErr error
+	)
+
+	numbers := make(chan int32)
+	for i := 0; i < r.upload.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range numbers {
+				offset := int64(number-1) * state.PartSize
+				size := min(state.PartSize, state.FileSize-offset)
+				part, err := r.uploadPart(uploadCtx, key, &state.UploadID, number, io.NewSectionReader(file, offset, size), size)
+
+				mu.Lock()
+				if err != nil {
+					if uploadErr == nil {
+						uploadErr = err
+						cancel()
+					}
+				} else {
+					state.Parts[number] = aws.ToString(part.ETag)
+					state.Checksums[number] = aws.ToString(part.ChecksumSHA256)
+					if err := r.saveUploadState(state); err != nil {
+						log.Printf("Failed to record upload progress for %s: %v", key, err)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	partCount := int32((state.FileSize + state.PartSize - 1) / state.PartSize)
+	for number := int32(1); number <= partCount && uploadCtx.Err() == nil; number++ {
+		if _, done := state.Parts[number]; done {
+			continue
+		}
+		select {
+		case numbers <- number:
+		case <-uploadCtx.Done():
+		}
+	}
+	close(numbers)
+	wg.Wait()
+
+	if uploadErr == nil && uploadCtx.Err() != nil {
+		uploadErr = uploadCtx.Err()
+	}
+	if uploadErr == nil {
+		parts := make([]types.CompletedPart, 0, len(state.Parts))
+		for number, etag := range state.Parts {
+			parts = append(parts, types.CompletedPart{
+				ETag:           aws.String(etag),
+				PartNumber:     aws.Int32(number),
+				ChecksumSHA256: aws.String(state.Checksums[number]),
+			})
+		}
+		var checksum string
+		if checksum, uploadErr = r.completeMultipartUpload(ctx, key, &state.UploadID, parts); uploadErr == nil {
+			r.removeUploadState(key)
+			return r.verifyUpload(ctx, key, state.FileSize, checksum)
+		}
+	}
+	r.abortMultipartUpload(key, &state.UploadID)
+	r.removeUploadState(key)
+	return uploadErr
+}
+
+// uploadPart sends one part with its SHA-256, retrying it with a growing
+// delay. body is rewound before every attempt.
+func (r *S3Client) uploadPart(ctx context.Context, key string, uploadID *string, number int32, body io.ReadSeeker, size int64) (types.CompletedPart, error) {
+	checksum, err := checksumSHA256(body)
+	if err != nil {
+		return types.CompletedPart{}, fmt.Errorf("failed to read part %d: %w", number, err)
+	}
+
+	// The SDK retries each request already; a part that still fails is
+	// sent again from the start, so one bad part does not fail the upload
+	policy := r.retry.withDefaults()
+	policy.Attempts = r.upload.PartRetries + 1
+	var part *s3.UploadPartOutput
+	err = policy.do(ctx, fmt.Sprintf("Uploading part %d of %s", number, key), &r.retries, func() error {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind part %d: %w", number, err)
+		}
+		var err error
+		part, err = r.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:         aws.String(r.bucket),
+			Key:            aws.String(key),
+			UploadId:       uploadID,
+			PartNumber:     aws.Int32(number),
+			Body:           body,
+			ContentLength:  aws.Int64(size),
+			ChecksumSHA256: aws.String(checksum),
+		})
+		return err
+	})
+	if err != nil {
+		return types.CompletedPart{}, fmt.Errorf("failed to upload part %d: %w", number, err)
+	}
+	return types.CompletedPart{
+		ETag:           part.ETag,
+		PartNumber:     aws.Int32(number),
+		ChecksumSHA256: aws.String(checksum),
+	}, nil
+}
+
+// createMultipartUploadInput starts a multipart upload whose parts are
+// sent with their SHA-256, locked like a single request upload
+func (r *S3Client) createMultipartUploadInput(key string, metadata map[string]string) *s3.CreateMultipartUploadInput {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(r.bucket),
+		Key:               aws.String(key),
+		Metadata:          encodeMetadata(metadata),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	}
+	input.ObjectLockMode, input.ObjectLockRetainUntilDate = r.lock.retention()
+	return input
+}
+
+// completeMultipartUpload assembles the parts into the object and returns
+// the checksum the object should have
+func (r *S3Client) completeMultipartUpload(ctx context.Context, key string, uploadID *string, parts []types.CompletedPart) (string, error) {
+	sort.Slice(parts, func(i, j int) bool {
+		return *parts[i].PartNumber < *parts[j].PartNumber
+	})
+	checksum, err := compositeChecksum(parts)
+	if err != nil {
+		return "", fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	_, err = r.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(r.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	return checksum, nil
+}
+
+// abortMultipartUpload discards the parts of a failed upload so they do not
+// keep taking up storage. It uses its own context because the upload's
+// context is usually already cancelled at this point.
+func (r *S3Client) abortMultipartUpload(key string, uploadID *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	_, _ = r.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(r.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+}
+
+// AbortStaleUploads aborts multipart uploads under prefix that were started
+// more than olderThan ago and never completed or aborted, for example
+// because the host lost power mid-upload. Until then their parts are
+// stored, and billed, without being visible as objects. It returns the
+// number of uploads aborted.
+func (r *S3Client) AbortStaleUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(r.bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	aborted := 0
+	for {
+		result, err := r.client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return aborted, fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+
+		for _, upload := range result.Uploads {
+			if upload.Initiated == nil || upload.Initiated.After(cutoff) {
+				continue
+			}
+			_, err := r.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(r.bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return aborted, fmt.Errorf("failed to abort multipart upload of %s: %w", *upload.Key, err)
+			}
+			if state := r.loadUploadState(*upload.Key); state != nil && state.UploadID == *upload.UploadId {
+				r.removeUploadState(*upload.Key)
+			}
+			aborted++
+		}
+
+		if !aws.ToBool(result.IsTruncated) {
+			return aborted, nil
+		}
+		input.KeyMarker = result.NextKeyMarker
+		input.UploadIdMarker = result.NextUploadIdMarker
+	}
+}
@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+
+	path := filepath.Join(t.TempDir(), "backup-20240101-000000.tar.gz")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestUploadFileInParallelParts(t *testing.T) {
+	fake, client := newFakeS3(t)
+	path, data := writeTestFile(t, 3*minPartSize+1234)
+
+	// Part 2 fails twice and succeeds on its last retry
+	fake.failParts[2] = 2
+
+	if err := client.UploadFile(context.Background(), filepath.Base(path), path, nil); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	if got := fake.objects[filepath.Base(path)].data; !bytes.Equal(got, data) {
+		t.Fatalf("uploaded object differs from the file (%d vs %d bytes)", len(got), len(data))
+	}
+	if got := fake.requests["UploadPart"]; got != 6 {
+		t.Errorf("expected 4 parts and 2 retries, got %d part requests", got)
+	}
+	if got := RetryCount(client); got != 2 {
+		t.Errorf("expected 2 retries to be counted, got %d", got)
+	}
+	if entries, _ := os.ReadDir(client.upload.StateDir); len(entries) != 0 {
+		t.Errorf("upload state was not removed after completing: %v", entries)
+	}
+}
+
+func TestPartSizeFor(t *testing.T) {
+	opts := UploadOptions{PartSize: defaultPartSize}.withDefaults()
+	for _, tc := range []struct {
+		size, want int64
+	}{
+		{0, defaultPartSize},
+		{defaultPartSize * defaultMaxParts, defaultPartSize},
+		// 200 GiB needs parts of 20.48 MiB, rounded up to whole MiB
+		{200 << 30, 21 << 20},
+		{5 << 40, 525 << 20},
+	} {
+		got := opts.partSizeFor(tc.size)
+		if got != tc.want {
+			t.Errorf("partSizeFor(%d) = %d, want %d", tc.size, got, tc.want)
+		}
+		if parts := (tc.size + got - 1) / got; parts > defaultMaxParts {
+			t.Errorf("partSizeFor(%d) needs %d parts", tc.size, parts)
+		}
+	}
+}
+
+func TestUploadFileGrowsPartsToFitLimit(t *testing.T) {
+	fake, client := newFakeS3(t)
+	client.upload.maxParts = 2
+	path, data := writeTestFile(t, 3*minPartSize+1234)
+
+	if err := client.UploadFile(context.Background(), filepath.Base(path), path, nil); err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	if got := fake.objects[filepath.Base(path)].data; !bytes.Equal(got, data) {
+		t.Fatal("uploaded object differs from the file")
+	}
+	if got := fake.requests["UploadPart"]; got != 2 {
+		t.Errorf("expected the file in 2 larger parts, got %d part requests", got)
+	}
+}
+
+func TestUploadFileAbortsAfterRetries(t *testing.T) {
+	fake, client := newFakeS3(t)
+	path, _ := writeTestFile(t, 2*minPartSize+1)
+
+	fake.failParts[3] = client.upload.PartRetries + 1
+
+	if err := client.UploadFile(context.Background(), filepath.Base(path), path, nil); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("failed upload was left behind: %d open uploads", len(fake.uploads))
+	}
+	if _, ok := fake.objects[filepath.Base(path)]; ok {
+		t.Error("failed upload created an object")
+	}
+}
+
+func TestResumeInterruptedUpload(t *testing.T) {
+	fake, client := newFakeS3(t)
+	path, data := writeTestFile(t, 4*minPartSize)
+	key := filepath.Base(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a process that died after uploading parts 1 and 3, having
+	// only recorded part 1
+	fake.uploads["42"] = &fakeUpload{
+		key:       key,
+		initiated: time.Now(),
+		parts: map[int32][]byte{
+			1: data[:minPartSize],
+			3: data[2*minPartSize : 3*minPartSize],
+		},
+		checksums: map[int32]string{
+			1: checksum(data[:minPartSize]),
+			3: checksum(data[2*minPartSize : 3*minPartSize]),
+		},
+	}
+	state := &uploadState{
+		Bucket:    testBucket,
+		Key:       key,
+		UploadID:  "42",
+		FilePath:  path,
+		FileSize:  info.Size(),
+		ModTime:   info.ModTime(),
+		PartSize:  minPartSize,
+		Parts:     map[int32]string{1: etag(data[:minPartSize])},
+		Checksums: map[int32]string{1: checksum(data[:minPartSize])},
+	}
+	if err := client.saveUploadState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := client.ResumePendingUploads(context.Background())
+	if err != nil {
+		t.Fatalf("ResumePendingUploads failed: %v", err)
+	}
+	if len(resumed) != 1 || resumed[0].Key != key || resumed[0].Size != int64(len(data)) {
+		t.Fatalf("unexpected resumed uploads %+v", resumed)
+	}
+	if got := fake.requests["UploadPart"]; got != 2 {
+		t.Errorf("expected only parts 2 and 4 to be sent, got %d part requests", got)
+	}
+	if got := fake.objects[key].data; !bytes.Equal(got, data) {
+		t.Fatal("resumed object differs from the file")
+	}
+	if client.loadUploadState(key) != nil {
+		t.Error("upload state was not removed after resuming")
+	}
+}
+
+func TestResumeStartsOverWithoutChecksums(t *testing.T) {
+	fake, client := newFakeS3(t)
+	path, data := writeTestFile(t, 2*minPartSize)
+	key := filepath.Base(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An upload recorded before parts were sent with checksums
+	fake.uploads["42"] = &fakeUpload{key: key, initiated: time.Now(), parts: map[int32][]byte{1: data[:minPartSize]}}
+	state := &uploadState{
+		Bucket:   testBucket,
+		Key:      key,
+		UploadID: "42",
+		FilePath: path,
+		FileSize: info.Size(),
+		ModTime:  info.ModTime(),
+		PartSize: minPartSize,
+		Parts:    map[int32]string{1: etag(data[:minPartSize])},
+	}
+	if err := client.saveUploadState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.ResumePendingUploads(context.Background()); err != nil {
+		t.Fatalf("ResumePendingUploads failed: %v", err)
+	}
+	if _, ok := fake.uploads["42"]; ok {
+		t.Error("expected the old upload to be aborted")
+	}
+	if got := fake.requests["UploadPart"]; got != 2 {
+		t.Errorf("expected every part to be sent again, got %d part requests", got)
+	}
+	if got := fake.objects[key]; !bytes.Equal(got.data, data) || got.checksum == "" {
+		t.Fatal("restarted upload differs from the file or has no checksum")
+	}
+}
+
+func TestResumeAbortsUploadOfChangedFile(t *testing.T) {
+	fake, client := newFakeS3(t)
+	path, _ := writeTestFile(t, 2*minPartSize)
+	key := filepath.Base(path)
+
+	fake.uploads["7"] = &fakeUpload{key: key, initiated: time.Now(), parts: map[int32][]byte{}}
+	state := &uploadState{
+		Bucket:   testBucket,
+		Key:      key,
+		UploadID: "7",
+		FilePath: path,
+		FileSize: 1,
+		PartSize: minPartSize,
+	}
+	if err := client.saveUploadState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := client.ResumePendingUploads(context.Background())
+	if err != nil || len(resumed) != 0 {
+		t.Fatalf("expected nothing to resume, got %v, %v", resumed, err)
+	}
+	if len(fake.uploads) != 0 {
+		t.Error("upload of a changed file was not aborted")
+	}
+	if client.loadUploadState(key) != nil {
+		t.Error("upload state of a changed file was kept")
+	}
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+	fake, client := newFakeS3(t)
+	fake.uploads["1"] = &fakeUpload{key: "backup-old.tar.gz", initiated: time.Now().Add(-48 * time.Hour)}
+	fake.uploads["2"] = &fakeUpload{key: "backup-new.tar.gz", initiated: time.Now()}
+
+	aborted, err := client.AbortStaleUploads(context.Background(), "backup", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("AbortStaleUploads failed: %v", err)
+	}
+	if aborted != 1 {
+		t.Errorf("expected 1 aborted upload, got %d", aborted)
+	}
+	if _, ok := fake.uploads["2"]; !ok || len(fake.uploads) != 1 {
+		t.Errorf("wrong uploads left: %v", fake.uploads)
+	}
+}
+
+func TestUploadStream(t *testing.T) {
+	fake, client := newFakeS3(t)
+	data := make([]byte, 2*minPartSize+99)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	size, err := client.UploadStream(context.Background(), "stream.tar.gz", bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("UploadStream failed: %v", err)
+	}
+	if size != int64(len(data)) || !bytes.Equal(fake.objects["stream.tar.gz"].data, data) {
+		t.Fatal("streamed object differs from the input")
+	}
+
+	if _, err := client.UploadStream(context.Background(), "small", bytes.NewReader([]byte("tiny")), nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.requests["PutObject"] != 1 {
+		t.Errorf("expected small streams to use a single request")
+	}
+}
+
+func TestUploadStreamPartLimit(t *testing.T) {
+	fake, client := newFakeS3(t)
+	client.upload.maxParts = 2
+	data := make([]byte, 2*minPartSize+99)
+
+	if _, err := client.UploadStream(context.Background(), "stream.tar.gz", bytes.NewReader(data), nil); err == nil || !strings.Contains(err.Error(), "upload.part_size") {
+		t.Fatalf("Expected a stream of 3 parts to fail, got %v", err)
+	}
+	if _, ok := fake.objects["stream.tar.gz"]; ok || len(fake.uploads) != 0 {
+		t.Error("Expected the upload to be aborted")
+	}
+
+	if _, err := client.UploadStream(context.Background(), "stream.tar.gz", bytes.NewReader(data[:2*minPartSize]), nil); err != nil {
+		t.Errorf("Expected a stream of exactly 2 parts to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ObjectLock makes every uploaded object immutable until a retain-until
+// date, so whoever holds the credentials that wrote a backup still cannot
+// delete or overwrite it before then. The bucket must have Object Lock
+// enabled, which also turns on versioning.
+type ObjectLock struct {
+	// Mode is "GOVERNANCE", which credentials with the
+	// s3:BypassGovernanceRetention permission can lift, or "COMPLIANCE",
+	// which nobody can
+	Mode string
+	// RetainFor is how long each object is locked after its upload
+	// starts; zero disables the lock
+	RetainFor time.Duration
+}
+
+// retention returns the lock mode and retain-until date to upload with,
+// which are empty when objects are not locked
+func (l ObjectLock) retention() (types.ObjectLockMode, *time.Time) {
+	if l.RetainFor <= 0 {
+		return "", nil
+	}
+	return types.ObjectLockMode(l.Mode), aws.Time(time.Now().Add(l.RetainFor).UTC())
+}
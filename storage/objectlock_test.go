@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3ClientObjectLock(t *testing.T) {
+	fake, client := newFakeS3(t)
+	client.lock = ObjectLock{Mode: "COMPLIANCE", RetainFor: 30 * 24 * time.Hour}
+	ctx := context.Background()
+
+	small, _ := writeTestFile(t, 1024)
+	large, _ := writeTestFile(t, 2*minPartSize+1)
+	if err := client.UploadFile(ctx, "small.tar.gz", small, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UploadFile(ctx, "large.tar.gz", large, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.UploadStream(ctx, "stream.tar.gz", strings.NewReader(strings.Repeat("x", minPartSize+1)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// A body that cannot be rewound still has to carry a checksum
+	if err := client.Upload(ctx, "manifest.json.gz", io.MultiReader(strings.NewReader("manifest")), 8); err != nil {
+		t.Fatal(err)
+	}
+
+	earliest := time.Now().Add(29 * 24 * time.Hour)
+	for _, key := range []string{"small.tar.gz", "large.tar.gz", "stream.tar.gz", "manifest.json.gz"} {
+		if mode := fake.objects[key].metadata.Get("x-amz-object-lock-mode"); mode != "COMPLIANCE" {
+			t.Errorf("%s: expected the COMPLIANCE lock mode, got %q", key, mode)
+		}
+		info, err := client.Stat(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.RetainUntil.Before(earliest) {
+			t.Errorf("%s: expected to be locked for 30 days, got %v", key, info.RetainUntil)
+		}
+	}
+}
+
+func TestS3ClientWithoutObjectLock(t *testing.T) {
+	fake, client := newFakeS3(t)
+	ctx := context.Background()
+	if err := client.Upload(ctx, "plain.tar.gz", strings.NewReader("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if mode := fake.objects["plain.tar.gz"].metadata.Get("x-amz-object-lock-mode"); mode != "" {
+		t.Errorf("Expected no lock, got %q", mode)
+	}
+	if info, err := client.Stat(ctx, "plain.tar.gz"); err != nil || !info.RetainUntil.IsZero() {
+		t.Errorf("Expected no retain-until date, got %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"iter"
+	"log"
+	"strings"
+	"time"
+)
+
+// prefixBackend stores every key of a backend under a fixed prefix, so
+// several hosts or destinations can share a bucket
+type prefixBackend struct {
+	backend Backend
+	prefix  string
+}
+
+// resumablePrefixBackend keeps the resumable uploads of the backend it wraps
+type resumablePrefixBackend struct {
+	*prefixBackend
+	resumable ResumableBackend
+}
+
+var (
+	_ Backend          = (*prefixBackend)(nil)
+	_ Presigner        = (*prefixBackend)(nil)
+	_ ResumableBackend = (*resumablePrefixBackend)(nil)
+)
+
+// WithPrefix returns a backend that stores every key under prefix. Keys in
+// listings are returned without it.
+func WithPrefix(backend Backend, prefix string) Backend {
+	if prefix == "" {
+		return backend
+	}
+
+	prefixed := &prefixBackend{backend: backend, prefix: prefix}
+	if resumable, ok := backend.(ResumableBackend); ok {
+		return &resumablePrefixBackend{prefixBackend: prefixed, resumable: resumable}
+	}
+	return prefixed
+}
+
+func (p *prefixBackend) Upload(ctx context.Context, key string, body io.Reader, size int64) error {
+	return p.backend.Upload(ctx, p.prefix+key, body, size)
+}
+
+func (p *prefixBackend) UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error {
+	return p.backend.UploadFile(ctx, p.prefix+key, filePath, metadata)
+}
+
+func (p *prefixBackend) UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	return p.backend.UploadStream(ctx, p.prefix+key, body, metadata)
+}
+
+func (p *prefixBackend) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	return p.backend.Download(ctx, p.prefix+key)
+}
+
+func (p *prefixBackend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return collect(p.Objects(ctx, prefix))
+}
+
+func (p *prefixBackend) Objects(ctx context.Context, prefix string) iter.Seq2[FileInfo, error] {
+	return func(yield func(FileInfo, error) bool) {
+		for file, err := range p.backend.Objects(ctx, p.prefix+prefix) {
+			file.Name = strings.TrimPrefix(file.Name, p.prefix)
+			if !yield(file, err) {
+				return
+			}
+		}
+	}
+}
+
+func (p *prefixBackend) Stat(ctx context.Context, key string) (FileInfo, error) {
+	info, err := p.backend.Stat(ctx, p.prefix+key)
+	info.Name = strings.TrimPrefix(info.Name, p.prefix)
+	return info, err
+}
+
+func (p *prefixBackend) Delete(ctx context.Context, key string) error {
+	return p.backend.Delete(ctx, p.prefix+key)
+}
+
+func (p *prefixBackend) URL(key string) string {
+	return p.backend.URL(p.prefix + key)
+}
+
+// PresignURL presigns through the wrapped backend, returning
+// ErrPresignUnsupported when it cannot
+func (p *prefixBackend) PresignURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return PresignURL(ctx, p.backend, p.prefix+key, expiry)
+}
+
+func (p *prefixBackend) Retries() int64 {
+	return RetryCount(p.backend)
+}
+
+// ResumePendingUploads resumes every upload the wrapped backend left
+// unfinished, which includes those outside the prefix when the bucket is
+// shared. Only uploads under the prefix are returned.
+func (p *resumablePrefixBackend) ResumePendingUploads(ctx context.Context) ([]ResumedUpload, error) {
+	all, err := p.resumable.ResumePendingUploads(ctx)
+
+	var resumed []ResumedUpload
+	for _, upload := range all {
+		key, ok := strings.CutPrefix(upload.Key, p.prefix)
+		if !ok {
+			log.Printf("Resumed interrupted upload of %s", upload.Key)
+			continue
+		}
+		upload.Key = key
+		resumed = append(resumed, upload)
+	}
+	return resumed, err
+}
+
+func (p *resumablePrefixBackend) AbortStaleUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error) {
+	return p.resumable.AbortStaleUploads(ctx, p.prefix+prefix, olderThan)
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestWithPrefix(t *testing.T) {
+	ctx := context.Background()
+	local, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := WithPrefix(local, "hosts/web1/")
+
+	if err := backend.Upload(ctx, "backup.tar.gz", strings.NewReader("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := local.Stat(ctx, "hosts/web1/backup.tar.gz"); err != nil {
+		t.Errorf("Expected the object under the prefix: %v", err)
+	}
+
+	files, err := backend.List(ctx, "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "backup.tar.gz" {
+		t.Errorf("Expected keys without the prefix, got %+v", files)
+	}
+	if info, err := backend.Stat(ctx, "backup.tar.gz"); err != nil || info.Name != "backup.tar.gz" {
+		t.Errorf("Stat returned %+v, %v", info, err)
+	}
+	if url := backend.URL("backup.tar.gz"); !strings.HasSuffix(url, "/hosts/web1/backup.tar.gz") {
+		t.Errorf("Unexpected URL %s", url)
+	}
+	if err := backend.Delete(ctx, "backup.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := local.List(ctx, ""); len(files) != 0 {
+		t.Errorf("Expected the object to be deleted, got %+v", files)
+	}
+}
+
+func TestWithPrefixKeepsResumableUploads(t *testing.T) {
+	_, client := newFakeS3(t)
+	if _, ok := WithPrefix(client, "hosts/web1/").(ResumableBackend); !ok {
+		t.Error("Expected a prefixed S3 client to stay resumable")
+	}
+	if WithPrefix(client, "") != Backend(client) {
+		t.Error("Expected an empty prefix to return the backend itself")
+	}
+}
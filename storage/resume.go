@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// uploadState is the progress of a multipart file upload, kept on disk
+// while the upload runs
+type uploadState struct {
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	UploadID string    `json:"upload_id"`
+	FilePath string    `json:"file_path"`
+	FileSize int64     `json:"file_size"`
+	ModTime  time.Time `json:"mod_time"`
+	PartSize int64     `json:"part_size"`
+	// Parts maps the numbers of the uploaded parts to their ETags
+	Parts map[int32]string `json:"parts"`
+	// Checksums maps the numbers of the uploaded parts to their SHA-256.
+	// It is nil for uploads started without checksums, which cannot be
+	// completed with them and are started over.
+	Checksums map[int32]string `json:"checksums"`
+	// Metadata is attached again if the upload has to start over
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ResumedUpload is a file upload that was interrupted and has now completed
+type ResumedUpload struct {
+	Key      string
+	FilePath string
+	Size     int64
+	// Err wraps ErrChecksumMismatch when the stored object does not match
+	// the file. The object is left in place.
+	Err error
+}
+
+func (r *S3Client) statePath(key string) string {
+	return filepath.Join(r.upload.StateDir, url.PathEscape(r.bucket)+"_"+url.PathEscape(key)+".json")
+}
+
+func (r *S3Client) loadUploadState(key string) *uploadState {
+	if r.upload.StateDir == "" {
+		return nil
+	}
+	state, err := readUploadState(r.statePath(key))
+	if err != nil {
+		return nil
+	}
+	return state
+}
+
+func readUploadState(path string) (*uploadState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state uploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse upload state %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// saveUploadState writes the state through a temporary file, so a crash
+// while saving leaves the previous state intact
+func (r *S3Client) saveUploadState(state *uploadState) error {
+	if r.upload.StateDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.upload.StateDir, 0700); err != nil {
+		return err
+	}
+
+	path := r.statePath(state.Key)
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+func (r *S3Client) removeUploadState(key string) {
+	if r.upload.StateDir == "" {
+		return
+	}
+	if err := os.Remove(r.statePath(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to remove upload state for %s: %v", key, err)
+	}
+}
+
+// resumableUpload returns the recorded progress of an earlier upload of
+// the same file to key, or nil when it has to start from scratch. Recorded
+// uploads of a file that has since changed are aborted.
+func (r *S3Client) resumableUpload(ctx context.Context, key, filePath string, info os.FileInfo) *uploadState {
+	state := r.loadUploadState(key)
+	if state == nil {
+		return nil
+	}
+
+	if state.Bucket != r.bucket || state.FilePath != filePath || state.FileSize != info.Size() ||
+		!state.ModTime.Equal(info.ModTime()) || state.PartSize < minPartSize || state.Checksums == nil {
+		r.abortMultipartUpload(key, &state.UploadID)
+		r.removeUploadState(key)
+		return nil
+	}
+
+	// The bucket knows best which parts arrived: a part may have been
+	// stored just before the crash that prevented recording it
+	parts, checksums, err := r.listParts(ctx, key, state.UploadID)
+	if err != nil {
+		log.Printf("Cannot resume upload of %s, starting over: %v", key, err)
+		r.removeUploadState(key)
+		return nil
+	}
+	state.Parts = parts
+	state.Checksums = checksums
+
+	log.Printf("Resuming upload of %s with %d part(s) already uploaded", key, len(parts))
+	return state
+}
+
+// listParts returns the ETags and checksums of the parts the bucket has
+// received. Parts without a checksum are left out, so they are sent again.
+func (r *S3Client) listParts(ctx context.Context, key, uploadID string) (map[int32]string, map[int32]string, error) {
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(r.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}
+
+	parts := make(map[int32]string)
+	checksums := make(map[int32]string)
+	for {
+		result, err := r.client.ListParts(ctx, input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list uploaded parts: %w", err)
+		}
+		for _, part := range result.Parts {
+			if part.ChecksumSHA256 == nil {
+				continue
+			}
+			number := aws.ToInt32(part.PartNumber)
+			parts[number] = aws.ToString(part.ETag)
+			checksums[number] = aws.ToString(part.ChecksumSHA256)
+		}
+		if !aws.ToBool(result.IsTruncated) {
+			return parts, checksums, nil
+		}
+		input.PartNumberMarker = result.NextPartNumberMarker
+	}
+}
+
+// ResumePendingUploads finishes the file uploads an earlier process
+// started but did not complete. Uploads whose file is gone or has changed
+// are aborted instead.
+func (r *S3Client) ResumePendingUploads(ctx context.Context) ([]ResumedUpload, error) {
+	if r.upload.StateDir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(r.upload.StateDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload state directory: %w", err)
+	}
+
+	var resumed []ResumedUpload
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !strings.HasPrefix(name, url.PathEscape(r.bucket)+"_") {
+			continue
+		}
+		state, err := readUploadState(filepath.Join(r.upload.StateDir, entry.Name()))
+		if err != nil {
+			log.Printf("Ignoring upload state: %v", err)
+			continue
+		}
+
+		info, err := os.Stat(state.FilePath)
+		if err != nil || info.Size() != state.FileSize || !info.ModTime().Equal(state.ModTime) {
+			log.Printf("Source of the interrupted upload of %s is gone, aborting it", state.Key)
+			r.abortMultipartUpload(state.Key, &state.UploadID)
+			r.removeUploadState(state.Key)
+			continue
+		}
+
+		err = r.UploadFile(ctx, state.Key, state.FilePath, state.Metadata)
+		if err != nil && !errors.Is(err, ErrChecksumMismatch) {
+			return resumed, fmt.Errorf("failed to resume upload of %s: %w", state.Key, err)
+		}
+		resumed = append(resumed, ResumedUpload{
+			Key:      state.Key,
+			FilePath: state.FilePath,
+			Size:     state.FileSize,
+			Err:      err,
+		})
+	}
+	return resumed, nil
+}
@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/pkg/sftp"
+)
+
+const (
+	defaultRetryAttempts  = 5
+	defaultRetryBaseDelay = time.Second
+)
+
+// RetryPolicy decides how often, and after how long, a storage operation
+// that failed with a transient error is tried again
+type RetryPolicy struct {
+	// Attempts is the most tries per operation, including the first; 1
+	// disables retries
+	Attempts int
+	// BaseDelay is the wait before the first retry. It doubles with every
+	// retry up to MaxDelay, and each wait is jittered so clients that failed
+	// together do not retry together.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Attempts <= 0 {
+		p.Attempts = defaultRetryAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = maxRetryDelay
+	}
+	p.MaxDelay = max(p.MaxDelay, p.BaseDelay)
+	return p
+}
+
+// delay returns how long to wait after the given failed attempt, counted
+// from 1. It is between half and all of the exponential backoff.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	backoff := p.MaxDelay
+	if shift := attempt - 1; shift < 32 {
+		backoff = min(p.BaseDelay<<shift, p.MaxDelay)
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	half := backoff / 2
+	return half + rand.N(backoff-half+1)
+}
+
+// do runs op until it succeeds, fails with an error that is not
+// retryable, or runs out of attempts. Every retry is logged and added to
+// retries.
+func (p RetryPolicy) do(ctx context.Context, what string, retries *atomic.Int64, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if attempt >= p.Attempts || !IsRetryable(err) || ctx.Err() != nil {
+			if attempt > 1 {
+				return fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			return err
+		}
+
+		delay := p.delay(attempt)
+		log.Printf("%s failed (attempt %d of %d), retrying in %s: %v",
+			what, attempt, p.Attempts, delay.Round(time.Millisecond), err)
+		retries.Add(1)
+		if sleepContext(ctx, delay) != nil {
+			return fmt.Errorf("%w (after %d attempts)", err, attempt)
+		}
+	}
+}
+
+// IsRetryable reports whether err is worth retrying: server errors,
+// throttling, timeouts and dropped connections. Errors that would fail the
+// same way again, such as bad credentials, a missing bucket or object, or
+// a checksum mismatch, are not, and neither are errors it does not know.
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled),
+		errors.Is(err, ErrNotFound),
+		errors.Is(err, ErrChecksumMismatch),
+		errors.Is(err, ErrPresignUnsupported),
+		errors.Is(err, ErrWriteOnly),
+		errors.Is(err, fs.ErrPermission):
+		return false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "TooManyRequests",
+			"RequestTimeout", "RequestTimeTooSkewed", "InternalError", "ServiceUnavailable":
+			return true
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "NoSuchBucket", "NoSuchKey":
+			return false
+		}
+	}
+	// Both SDK and WebDAV responses carry their HTTP status
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status >= 500 || status == 429 || status == 408
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ETIMEDOUT) ||
+		errors.Is(err, sftp.ErrSSHFxConnectionLost)
+}
+
+// retryCounter is implemented by backends that count their retries
+type retryCounter interface {
+	Retries() int64
+}
+
+// RetryCount returns how many times backend has retried a failed
+// operation since it was created, or 0 if it does not retry
+func RetryCount(backend Backend) int64 {
+	if counter, ok := backend.(retryCounter); ok {
+		return counter.Retries()
+	}
+	return 0
+}
+
+// retryBackend retries the operations of a backend that has no retries of
+// its own
+type retryBackend struct {
+	backend Backend
+	policy  RetryPolicy
+	retries atomic.Int64
+}
+
+// resumableRetryBackend keeps the resumable uploads of the backend it wraps
+type resumableRetryBackend struct {
+	*retryBackend
+	resumable ResumableBackend
+}
+
+var (
+	_ Backend          = (*retryBackend)(nil)
+	_ Presigner        = (*retryBackend)(nil)
+	_ ResumableBackend = (*resumableRetryBackend)(nil)
+)
+
+// WithRetry returns a backend that retries the operations of backend that
+// fail with a transient error. Uploads are only retried when their body
+// can be rewound; UploadStream never is, since its body cannot be read
+// twice.
+func WithRetry(backend Backend, policy RetryPolicy) Backend {
+	retrying := &retryBackend{backend: backend, policy: policy.withDefaults()}
+	if resumable, ok := backend.(ResumableBackend); ok {
+		return &resumableRetryBackend{retryBackend: retrying, resumable: resumable}
+	}
+	return retrying
+}
+
+func (r *retryBackend) Upload(ctx context.Context, key string, body io.Reader, size int64) error {
+	seeker, ok := body.(io.Seeker)
+	if !ok {
+		return r.backend.Upload(ctx, key, body, size)
+	}
+	return r.policy.do(ctx, "Uploading "+key, &r.retries, func() error {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind upload of %s: %w", key, err)
+		}
+		return r.backend.Upload(ctx, key, body, size)
+	})
+}
+
+func (r *retryBackend) UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error {
+	return r.policy.do(ctx, "Uploading "+key, &r.retries, func() error {
+		return r.backend.UploadFile(ctx, key, filePath, metadata)
+	})
+}
+
+func (r *retryBackend) UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	return r.backend.UploadStream(ctx, key, body, metadata)
+}
+
+func (r *retryBackend) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := r.policy.do(ctx, "Downloading "+key, &r.retries, func() error {
+		var err error
+		body, err = r.backend.Download(ctx, key)
+		return err
+	})
+	return body, err
+}
+
+func (r *retryBackend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return collect(r.Objects(ctx, prefix))
+}
+
+// Objects retries a listing that fails before it yields anything. Once
+// objects have been yielded a retry would repeat them, so later errors are
+// passed on.
+func (r *retryBackend) Objects(ctx context.Context, prefix string) iter.Seq2[FileInfo, error] {
+	return func(yield func(FileInfo, error) bool) {
+		for attempt := 1; ; attempt++ {
+			yielded := false
+			var failed error
+			for info, err := range r.backend.Objects(ctx, prefix) {
+				if err != nil && !yielded {
+					failed = err
+					break
+				}
+				yielded = true
+				if !yield(info, err) {
+					return
+				}
+			}
+			if failed == nil {
+				return
+			}
+			if attempt >= r.policy.Attempts || !IsRetryable(failed) || ctx.Err() != nil {
+				yield(FileInfo{}, failed)
+				return
+			}
+			delay := r.policy.delay(attempt)
+			log.Printf("Listing %s failed (attempt %d of %d), retrying in %s: %v",
+				prefix, attempt, r.policy.Attempts, delay.Round(time.Millisecond), failed)
+			r.retries.Add(1)
+			if sleepContext(ctx, delay) != nil {
+				yield(FileInfo{}, failed)
+				return
+			}
+		}
+	}
+}
+
+func (r *retryBackend) Stat(ctx context.Context, key string) (FileInfo, error) {
+	var info FileInfo
+	err := r.policy.do(ctx, "Reading "+key, &r.retries, func() error {
+		var err error
+		info, err = r.backend.Stat(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+func (r *retryBackend) Delete(ctx context.Context, key string) error {
+	return r.policy.do(ctx, "Deleting "+key, &r.retries, func() error {
+		return r.backend.Delete(ctx, key)
+	})
+}
+
+func (r *retryBackend) URL(key string) string {
+	return r.backend.URL(key)
+}
+
+func (r *retryBackend) PresignURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return PresignURL(ctx, r.backend, key, expiry)
+}
+
+// Retries counts the retries made here and by the backend itself
+func (r *retryBackend) Retries() int64 {
+	return r.retries.Load() + RetryCount(r.backend)
+}
+
+func (r *resumableRetryBackend) ResumePendingUploads(ctx context.Context) ([]ResumedUpload, error) {
+	return r.resumable.ResumePendingUploads(ctx)
+}
+
+func (r *resumableRetryBackend) AbortStaleUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error) {
+	var aborted int
+	err := r.policy.do(ctx, "Aborting stale uploads under "+prefix, &r.retries, func() error {
+		var err error
+		aborted, err = r.resumable.AbortStaleUploads(ctx, prefix, olderThan)
+		return err
+	})
+	return aborted, err
+}
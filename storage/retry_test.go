@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+func responseError(status int, code string) error {
+	return &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+		Err:      &smithy.GenericAPIError{Code: code},
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", responseError(500, "InternalError"), true},
+		{"unavailable", responseError(503, "ServiceUnavailable"), true},
+		{"slow down", responseError(503, "SlowDown"), true},
+		{"too many requests", responseError(429, "TooManyRequests"), true},
+		{"request timeout", responseError(400, "RequestTimeout"), true},
+		{"access denied", responseError(403, "AccessDenied"), false},
+		{"bad key", responseError(403, "InvalidAccessKeyId"), false},
+		{"bad signature", responseError(403, "SignatureDoesNotMatch"), false},
+		{"missing bucket", responseError(404, "NoSuchBucket"), false},
+		{"bad request", responseError(400, "InvalidArgument"), false},
+		{"connection reset", fmt.Errorf("send: %w", syscall.ECONNRESET), true},
+		{"connection refused", fmt.Errorf("dial: %w", syscall.ECONNREFUSED), true},
+		{"truncated", fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{"not found", fmt.Errorf("stat: %w", ErrNotFound), false},
+		{"checksum mismatch", fmt.Errorf("verify: %w", ErrChecksumMismatch), false},
+		{"permission", fmt.Errorf("open: %w", os.ErrPermission), false},
+		{"canceled", context.Canceled, false},
+		{"unknown", errors.New("ssh: handshake failed: ssh: unable to authenticate"), false},
+	}
+	for _, test := range tests {
+		if got := IsRetryable(test.err); got != test.want {
+			t.Errorf("%s: IsRetryable(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}.withDefaults()
+	for attempt, backoff := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 5: 10 * time.Second, 100: 10 * time.Second} {
+		for range 20 {
+			if delay := policy.delay(attempt); delay < backoff/2 || delay > backoff {
+				t.Errorf("Delay after attempt %d is %s, want between %s and %s", attempt, delay, backoff/2, backoff)
+			}
+		}
+	}
+}
+
+func TestS3ClientRetriesTransientErrors(t *testing.T) {
+	fake, _ := newFakeS3(t)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client, err := NewS3Client(S3Options{
+		Endpoint:        server.URL,
+		Bucket:          testBucket,
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+		Upload:          UploadOptions{StateDir: t.TempDir()},
+		Retry:           RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	fake.failRequests = []fakeFailure{{503, "SlowDown"}, {500, "InternalError"}}
+	if err := client.Upload(ctx, "backup.tar.gz", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("Expected the upload to succeed on its third attempt: %v", err)
+	}
+	if got := RetryCount(client); got != 2 {
+		t.Errorf("Expected 2 retries, got %d", got)
+	}
+
+	fake.failRequests = []fakeFailure{{403, "AccessDenied"}, {403, "AccessDenied"}}
+	if err := client.Delete(ctx, "backup.tar.gz"); err == nil {
+		t.Fatal("Expected access denied to fail the request")
+	}
+	if got := RetryCount(client); got != 2 {
+		t.Errorf("Expected access denied not to be retried, got %d retries", got)
+	}
+
+	fake.failRequests = []fakeFailure{{503, "SlowDown"}, {503, "SlowDown"}, {503, "SlowDown"}}
+	if _, err := client.Stat(ctx, "backup.tar.gz"); err == nil {
+		t.Fatal("Expected the request to fail once its attempts ran out")
+	}
+	if got := RetryCount(client); got != 4 {
+		t.Errorf("Expected 2 more retries, got %d in total", got)
+	}
+}
+
+// flakyBackend fails the first calls of every operation with err
+type flakyBackend struct {
+	Backend
+	err      error
+	failures int
+	calls    int
+}
+
+func (f *flakyBackend) fail() error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func (f *flakyBackend) Upload(ctx context.Context, key string, body io.Reader, size int64) error {
+	if err := f.fail(); err != nil {
+		io.Copy(io.Discard, body)
+		return err
+	}
+	return f.Backend.Upload(ctx, key, body, size)
+}
+
+func (f *flakyBackend) UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	if err := f.fail(); err != nil {
+		return 0, err
+	}
+	return f.Backend.UploadStream(ctx, key, body, metadata)
+}
+
+func (f *flakyBackend) Stat(ctx context.Context, key string) (FileInfo, error) {
+	if err := f.fail(); err != nil {
+		return FileInfo{}, err
+	}
+	return f.Backend.Stat(ctx, key)
+}
+
+func TestWithRetry(t *testing.T) {
+	ctx := context.Background()
+	local, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond}
+
+	flaky := &flakyBackend{Backend: local, err: fmt.Errorf("write: %w", syscall.ECONNRESET), failures: 2}
+	backend := WithRetry(flaky, policy)
+	if err := backend.Upload(ctx, "backup.tar.gz", bytes.NewReader([]byte("data")), 4); err != nil {
+		t.Fatalf("Expected the upload to be retried until it succeeded: %v", err)
+	}
+	if body, err := os.ReadFile(local.path("backup.tar.gz")); err != nil || string(body) != "data" {
+		t.Errorf("Expected the rewound body to be stored, got %q, %v", body, err)
+	}
+	if got := RetryCount(backend); got != 2 {
+		t.Errorf("Expected 2 retries, got %d", got)
+	}
+
+	flaky = &flakyBackend{Backend: local, err: fmt.Errorf("stat: %w", ErrNotFound), failures: 1}
+	backend = WithRetry(flaky, policy)
+	if _, err := backend.Stat(ctx, "backup.tar.gz"); !errors.Is(err, ErrNotFound) || flaky.calls != 1 {
+		t.Errorf("Expected a missing object not to be retried, got %v after %d calls", err, flaky.calls)
+	}
+
+	flaky = &flakyBackend{Backend: local, err: fmt.Errorf("stat: %w", syscall.ECONNRESET), failures: 5}
+	backend = WithRetry(flaky, policy)
+	if _, err := backend.Stat(ctx, "backup.tar.gz"); err == nil || !strings.Contains(err.Error(), "after 3 attempts") || flaky.calls != 3 {
+		t.Errorf("Expected the stat to give up after 3 attempts, got %v after %d calls", err, flaky.calls)
+	}
+
+	flaky = &flakyBackend{Backend: local, err: fmt.Errorf("write: %w", syscall.ECONNRESET), failures: 1}
+	backend = WithRetry(flaky, policy)
+	if _, err := backend.UploadStream(ctx, "stream.tar.gz", strings.NewReader("data"), nil); err == nil || flaky.calls != 1 {
+		t.Errorf("Expected a stream not to be retried, got %v after %d calls", err, flaky.calls)
+	}
+}
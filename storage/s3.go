@@ -0,0 +1,402 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// S3Client stores backups in a bucket of any S3 compatible service, such
+// as CloudFlare R2, MinIO, Wasabi, Backblaze B2 or Ceph
+type S3Client struct {
+	client    *s3.Client
+	bucket    string
+	publicURL string
+	upload    UploadOptions
+	retry     RetryPolicy
+	lock      ObjectLock
+	// retries counts the requests and parts retried so far
+	retries atomic.Int64
+}
+
+var (
+	_ ResumableBackend = (*S3Client)(nil)
+	_ Presigner        = (*S3Client)(nil)
+)
+
+type S3Options struct {
+	// Endpoint is the base URL of the service, e.g. https://minio.local:9000
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses buckets as <endpoint>/<bucket> instead of
+	// <bucket>.<endpoint>, which most self-hosted services need
+	PathStyle bool
+	// CABundle is a PEM file with the certificates that sign the endpoint's
+	// certificate, for services behind a private CA
+	CABundle           string
+	InsecureSkipVerify bool
+	// PublicURL is the base of the links in notifications. It defaults to
+	// the object's URL on the endpoint.
+	PublicURL string
+	Upload    UploadOptions
+	// Bandwidth limits the transfer rates; nil is unlimited
+	Bandwidth *Bandwidth
+	// Retry controls how failed requests are retried
+	Retry RetryPolicy
+	// ObjectLock locks every uploaded object until a retain-until date
+	ObjectLock ObjectLock
+}
+
+func NewS3Client(opts S3Options) (*S3Client, error) {
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+
+	httpClient, err := newHTTPClient(opts.CABundle, opts.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(opts.Region),
+		config.WithHTTPClient(httpClient),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			opts.AccessKeyID,
+			opts.SecretAccessKey,
+			"",
+		)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	publicURL := opts.PublicURL
+	if publicURL == "" && opts.Endpoint != "" {
+		publicURL = strings.TrimSuffix(opts.Endpoint, "/") + "/" + opts.Bucket
+	}
+
+	r := &S3Client{
+		bucket:    opts.Bucket,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		upload:    opts.Upload.withDefaults(),
+		retry:     opts.Retry.withDefaults(),
+		lock:      opts.ObjectLock,
+	}
+	r.client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+		o.UsePathStyle = opts.PathStyle
+		// Many S3 compatible services reject the aws-chunked trailing
+		// checksums the SDK adds by default
+		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		if opts.Bandwidth != nil {
+			o.HTTPClient = &throttledHTTPClient{client: o.HTTPClient, bandwidth: opts.Bandwidth}
+		}
+		o.Retryer = r.newRetryer()
+	})
+	return r, nil
+}
+
+// newRetryer returns the SDK retryer for the client's policy. Errors are
+// classified by IsRetryable, and retries are not rationed by the SDK's
+// retry quota, since a backup has nothing better to do than wait.
+func (r *S3Client) newRetryer() aws.Retryer {
+	return retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = r.retry.Attempts
+		o.MaxBackoff = r.retry.MaxDelay
+		o.RateLimiter = ratelimit.None
+		o.Retryables = []retry.IsErrorRetryable{
+			retry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+				return aws.BoolTernary(IsRetryable(err))
+			}),
+		}
+		o.Backoff = retry.BackoffDelayerFunc(func(attempt int, err error) (time.Duration, error) {
+			delay := r.retry.delay(attempt)
+			log.Printf("S3 request failed (attempt %d of %d), retrying in %s: %v",
+				attempt, r.retry.Attempts, delay.Round(time.Millisecond), err)
+			r.retries.Add(1)
+			return delay, nil
+		})
+	})
+}
+
+// Retries counts the requests and parts retried since the client was created
+func (r *S3Client) Retries() int64 {
+	return r.retries.Load()
+}
+
+// R2Options returns the S3 settings for a CloudFlare R2 bucket, which has
+// an endpoint per account and the region "auto"
+func R2Options(accountID, accessKeyID, secretAccessKey, bucket, publicURL string, upload UploadOptions) S3Options {
+	return S3Options{
+		Endpoint:        fmt.Sprintf("https://%s.r2.cloudflarestorage.com", accountID),
+		Region:          "auto",
+		Bucket:          bucket,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		PublicURL:       publicURL,
+		Upload:          upload,
+	}
+}
+
+// newHTTPClient returns the SDK's default client, trusting the
+// certificates in caBundle in addition to the system ones
+func newHTTPClient(caBundle string, insecureSkipVerify bool) (*awshttp.BuildableClient, error) {
+	var pool *x509.CertPool
+	if caBundle != "" {
+		pem, err := os.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		if pool, err = x509.SystemCertPool(); err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caBundle)
+		}
+	}
+
+	return awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		if pool != nil {
+			transport.TLSClientConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = insecureSkipVerify
+	}), nil
+}
+
+// UploadFile stores a file under key. Files larger than one part are sent
+// as a resumable multipart upload. The stored object is checked against
+// the SHA-256 of the file afterwards.
+func (r *S3Client) UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	// Get file size for Content-Length header
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	if fileInfo.Size() > r.upload.PartSize {
+		return r.uploadFileParts(ctx, key, file, fileInfo, metadata)
+	}
+
+	// Stream the file directly without loading into memory
+	checksum, err := r.put(ctx, key, file, fileInfo.Size(), metadata)
+	if err != nil {
+		return err
+	}
+	return r.verifyUpload(ctx, key, fileInfo.Size(), checksum)
+}
+
+// Upload stores size bytes read from body under key
+func (r *S3Client) Upload(ctx context.Context, key string, body io.Reader, size int64) error {
+	_, err := r.put(ctx, key, body, size, nil)
+	return err
+}
+
+// put stores body with a single request. A body that can be rewound is
+// sent with its SHA-256, which the service checks before storing the
+// object; put returns that checksum.
+func (r *S3Client) put(ctx context.Context, key string, body io.Reader, size int64, metadata map[string]string) (string, error) {
+	// A locked object must be sent with a checksum, so a body that cannot
+	// be rewound is read into memory first. Only small objects, such as
+	// manifests, are uploaded that way.
+	if _, ok := body.(io.ReadSeeker); !ok && r.lock.RetainFor > 0 {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return "", fmt.Errorf("failed to read upload data: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(r.bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		Metadata:      encodeMetadata(metadata),
+	}
+	input.ObjectLockMode, input.ObjectLockRetainUntilDate = r.lock.retention()
+
+	var checksum string
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		var err error
+		if checksum, err = checksumSHA256(seeker); err != nil {
+			return "", fmt.Errorf("failed to read upload data: %w", err)
+		}
+		input.ChecksumSHA256 = aws.String(checksum)
+	}
+
+	if _, err := r.client.PutObject(ctx, input); err != nil {
+		return "", fmt.Errorf("failed to upload to S3: %w", err)
+	}
+	return checksum, nil
+}
+
+// URL returns the public link for an object
+func (r *S3Client) URL(key string) string {
+	return fmt.Sprintf("%s/%s", r.publicURL, key)
+}
+
+// PresignURL signs a GET request for key, so an object in a private bucket
+// can be downloaded without credentials. Signing happens locally; the
+// object is not checked to exist.
+func (r *S3Client) PresignURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if expiry <= 0 || expiry > MaxPresignExpiry {
+		return "", fmt.Errorf("presigned URL expiry must be between 1s and %s, got %s", MaxPresignExpiry, expiry)
+	}
+
+	request, err := s3.NewPresignClient(r.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s: %w", key, err)
+	}
+	return request.URL, nil
+}
+
+// Download streams an object from S3. The caller must close the returned reader.
+func (r *S3Client) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	result, err := r.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s from S3: %w", key, notFound(err))
+	}
+	return result.Body, nil
+}
+
+func (r *S3Client) Stat(ctx context.Context, key string) (FileInfo, error) {
+	result, err := r.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat %s: %w", key, notFound(err))
+	}
+	return FileInfo{
+		Name:         key,
+		LastModified: aws.ToTime(result.LastModified),
+		Size:         aws.ToInt64(result.ContentLength),
+		Metadata:     decodeMetadata(result.Metadata),
+		RetainUntil:  aws.ToTime(result.ObjectLockRetainUntilDate),
+	}, nil
+}
+
+// encodeMetadata makes values safe to send as HTTP headers. Values that
+// are not plain ASCII, such as folder names, are RFC 2047 encoded.
+func encodeMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	encoded := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		encoded[strings.ToLower(key)] = mime.QEncoding.Encode("utf-8", value)
+	}
+	return encoded
+}
+
+func decodeMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	var decoder mime.WordDecoder
+	decoded := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		if text, err := decoder.DecodeHeader(value); err == nil {
+			value = text
+		}
+		decoded[strings.ToLower(key)] = value
+	}
+	return decoded
+}
+
+func (r *S3Client) Delete(ctx context.Context, fileName string) error {
+	_, err := r.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(fileName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete file from S3: %w", err)
+	}
+	return nil
+}
+
+func (r *S3Client) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return collect(r.Objects(ctx, prefix))
+}
+
+// Objects pages through ListObjectsV2 until the listing is no longer
+// truncated, fetching the next page only when the previous one is consumed
+func (r *S3Client) Objects(ctx context.Context, prefix string) iter.Seq2[FileInfo, error] {
+	return func(yield func(FileInfo, error) bool) {
+		paginator := s3.NewListObjectsV2Paginator(r.client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(r.bucket),
+			Prefix: aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(FileInfo{}, fmt.Errorf("failed to list files: %w", err))
+				return
+			}
+			for _, obj := range page.Contents {
+				file := FileInfo{
+					Name:         aws.ToString(obj.Key),
+					LastModified: aws.ToTime(obj.LastModified),
+					Size:         aws.ToInt64(obj.Size),
+				}
+				if !yield(file, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// notFound wraps ErrNotFound around the error S3 returns for a missing object
+func notFound(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return fmt.Errorf("%w: %w", ErrNotFound, err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTLSFakeS3 serves the fake over HTTPS with a self-signed certificate and
+// returns options for it without any TLS settings
+func newTLSFakeS3(t *testing.T) (*httptest.Server, S3Options) {
+	t.Helper()
+
+	fake, _ := newFakeS3(t)
+	server := httptest.NewUnstartedServer(fake)
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server, S3Options{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          testBucket,
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+		Upload:          UploadOptions{StateDir: t.TempDir()},
+	}
+}
+
+func roundTrip(t *testing.T, client *S3Client) error {
+	t.Helper()
+
+	ctx := context.Background()
+	data := []byte("backup over tls")
+	if err := client.Upload(ctx, "tls.tar.gz", bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+
+	body, err := client.Download(ctx, "tls.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	got, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %q, want %q", got, data)
+	}
+	return nil
+}
+
+func TestS3ClientCABundle(t *testing.T) {
+	server, opts := newTLSFakeS3(t)
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opts.CABundle = bundle
+
+	client, err := NewS3Client(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(t, client); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestS3ClientInsecureSkipVerify(t *testing.T) {
+	_, opts := newTLSFakeS3(t)
+	opts.InsecureSkipVerify = true
+
+	client, err := NewS3Client(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(t, client); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestS3ClientRejectsUnknownCA(t *testing.T) {
+	_, opts := newTLSFakeS3(t)
+
+	client, err := NewS3Client(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(t, client); err == nil {
+		t.Fatal("upload to an untrusted endpoint succeeded")
+	}
+}
+
+func TestS3ClientBadCABundle(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewS3Client(S3Options{Bucket: testBucket, CABundle: bundle}); err == nil {
+		t.Fatal("expected an error for a bundle without certificates")
+	}
+}
+
+func TestS3ClientPublicURL(t *testing.T) {
+	client, err := NewS3Client(S3Options{
+		Endpoint: "https://minio.internal:9000/",
+		Bucket:   testBucket,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := client.URL("a/b.tar.gz"), "https://minio.internal:9000/backups/a/b.tar.gz"; got != want {
+		t.Fatalf("URL = %q, want %q", got, want)
+	}
+}
+
+func TestListPaginates(t *testing.T) {
+	fake, client := newFakeS3(t)
+	fake.pageSize = 2
+	ctx := context.Background()
+
+	for i := range 5 {
+		key := fmt.Sprintf("backup-%d.tar.gz", i)
+		if err := client.Upload(ctx, key, strings.NewReader(key), int64(len(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Upload(ctx, "other.tar.gz", strings.NewReader("x"), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := client.List(ctx, "backup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 5 {
+		t.Fatalf("Listed %d files, want 5", len(files))
+	}
+	if fake.requests["ListObjects"] != 3 {
+		t.Errorf("Expected 3 pages, got %d requests", fake.requests["ListObjects"])
+	}
+}
+
+func TestObjectsFetchesPagesLazily(t *testing.T) {
+	fake, client := newFakeS3(t)
+	fake.pageSize = 2
+	ctx := context.Background()
+
+	for i := range 6 {
+		key := fmt.Sprintf("backup-%d.tar.gz", i)
+		if err := client.Upload(ctx, key, strings.NewReader(key), int64(len(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var seen []string
+	for file, err := range client.Objects(ctx, "") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen = append(seen, file.Name)
+		if len(seen) == 3 {
+			break
+		}
+	}
+	if len(seen) != 3 || seen[0] != "backup-0.tar.gz" {
+		t.Errorf("Unexpected objects %v", seen)
+	}
+	if fake.requests["ListObjects"] != 2 {
+		t.Errorf("Expected only the pages that were read to be fetched, got %d requests", fake.requests["ListObjects"])
+	}
+}
+
+func TestObjectsStopsWhenCancelled(t *testing.T) {
+	fake, client := newFakeS3(t)
+	fake.pageSize = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := range 3 {
+		key := fmt.Sprintf("backup-%d.tar.gz", i)
+		if err := client.Upload(ctx, key, strings.NewReader(key), int64(len(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var listErr error
+	count := 0
+	for _, err := range client.Objects(ctx, "") {
+		if err != nil {
+			listErr = err
+			break
+		}
+		count++
+		cancel()
+	}
+	if count != 1 || !errors.Is(listErr, context.Canceled) {
+		t.Errorf("Listed %d objects with error %v, want 1 and context.Canceled", count, listErr)
+	}
+}
+
+func TestUploadMetadata(t *testing.T) {
+	_, client := newFakeS3(t)
+	ctx := context.Background()
+	metadata := map[string]string{
+		"host":    "web1",
+		"folders": "/srv/données,/etc",
+	}
+
+	small, _ := writeTestFile(t, 1024)
+	large, _ := writeTestFile(t, 2*minPartSize+1)
+	if err := client.UploadFile(ctx, "small.tar.gz", small, metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UploadFile(ctx, "large.tar.gz", large, metadata); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.UploadStream(ctx, "stream.tar.gz", strings.NewReader(strings.Repeat("x", minPartSize+1)), metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"small.tar.gz", "large.tar.gz", "stream.tar.gz"} {
+		info, err := client.Stat(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Metadata["host"] != "web1" || info.Metadata["folders"] != "/srv/données,/etc" {
+			t.Errorf("%s: unexpected metadata %v", key, info.Metadata)
+		}
+	}
+}
+
+func TestPresignURL(t *testing.T) {
+	_, client := newFakeS3(t)
+	ctx := context.Background()
+	backend := WithPrefix(client, "hosts/web1/")
+	if err := backend.Upload(ctx, "backup.tar.gz", strings.NewReader("private"), 7); err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := PresignURL(ctx, backend, "backup.tar.gz", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if parsed.Path != "/"+testBucket+"/hosts/web1/backup.tar.gz" || query.Get("X-Amz-Expires") != "3600" || query.Get("X-Amz-Signature") == "" {
+		t.Errorf("Unexpected presigned URL %s", link)
+	}
+
+	// The link works without credentials
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(data) != "private" {
+		t.Errorf("Downloading the presigned URL returned %d %q", resp.StatusCode, data)
+	}
+
+	if _, err := client.PresignURL(ctx, "backup.tar.gz", 8*24*time.Hour); err == nil {
+		t.Error("Expected an expiry beyond seven days to be rejected")
+	}
+}
+
+func TestPresignURLUnsupported(t *testing.T) {
+	local, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range []Backend{local, WithPrefix(local, "hosts/web1/")} {
+		if _, err := PresignURL(context.Background(), backend, "backup.tar.gz", time.Hour); !errors.Is(err, ErrPresignUnsupported) {
+			t.Errorf("Expected ErrPresignUnsupported, got %v", err)
+		}
+	}
+}
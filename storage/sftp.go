@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPOptions configures a connection to an SFTP server
+type SFTPOptions struct {
+	// Addr is host or host:port; the port defaults to 22
+	Addr string
+	User string
+	// Password and KeyFile select the authentication methods; either or
+	// both may be given
+	Password      string
+	KeyFile       string
+	KeyPassphrase string
+	// KnownHostsFile lists the accepted host keys. It defaults to
+	// ~/.ssh/known_hosts; unknown or changed host keys are rejected.
+	KnownHostsFile string
+	// Dir is the remote directory backups are stored in
+	Dir     string
+	Timeout time.Duration
+	// Bandwidth limits the transfer rates; nil is unlimited
+	Bandwidth *Bandwidth
+}
+
+// SFTPBackend stores backups in a directory on an SFTP server. Like
+// LocalBackend, objects are written to a temporary file and renamed into
+// place. Every operation opens its own connection, so a connection that
+// dropped between runs of a long running service never gets in the way.
+type SFTPBackend struct {
+	addr      string
+	dir       string
+	config    *ssh.ClientConfig
+	bandwidth *Bandwidth
+}
+
+var _ Backend = (*SFTPBackend)(nil)
+
+func NewSFTPBackend(opts SFTPOptions) (*SFTPBackend, error) {
+	addr := opts.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	var auth []ssh.AuthMethod
+	if opts.KeyFile != "" {
+		signer, err := loadSigner(opts.KeyFile, opts.KeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if opts.Password != "" {
+		auth = append(auth, ssh.Password(opts.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("a password or key file is required")
+	}
+
+	knownHostsFile := opts.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find known_hosts: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts: %w", err)
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	return &SFTPBackend{
+		addr:      addr,
+		dir:       path.Clean("/" + opts.Dir),
+		bandwidth: opts.Bandwidth,
+		config: &ssh.ClientConfig{
+			User:            opts.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         timeout,
+		},
+	}, nil
+}
+
+func loadSigner(keyFile, passphrase string) (ssh.Signer, error) {
+	pemBytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pemBytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file %s: %w", keyFile, err)
+	}
+	return signer, nil
+}
+
+// sftpConn is an SFTP session together with the SSH connection it runs on
+type sftpConn struct {
+	*sftp.Client
+	ssh *ssh.Client
+}
+
+func (c *sftpConn) Close() error {
+	c.Client.Close()
+	return c.ssh.Close()
+}
+
+// connect opens a new session. The handshake is aborted when ctx ends.
+func (s *SFTPBackend) connect(ctx context.Context) (*sftpConn, error) {
+	dialer := net.Dialer{Timeout: s.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", s.addr, err)
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, s.addr, s.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", s.addr, err)
+	}
+	client := ssh.NewClient(sshConn, channels, requests)
+
+	session, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to start SFTP session on %s: %w", s.addr, err)
+	}
+	if !stop() {
+		session.Close()
+		client.Close()
+		return nil, ctx.Err()
+	}
+	return &sftpConn{Client: session, ssh: client}, nil
+}
+
+// path maps a key to a file below the remote directory. Keys cannot
+// escape it.
+func (s *SFTPBackend) path(key string) string {
+	return path.Join(s.dir, path.Clean("/"+key))
+}
+
+func (s *SFTPBackend) Upload(ctx context.Context, key string, body io.Reader, size int64) error {
+	_, err := s.write(ctx, key, body, size)
+	return err
+}
+
+func (s *SFTPBackend) UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = s.write(ctx, key, file, -1)
+	return err
+}
+
+func (s *SFTPBackend) UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	return s.write(ctx, key, body, -1)
+}
+
+// write copies body into a temporary file next to the destination and
+// renames it into place. A size of -1 accepts any length.
+func (s *SFTPBackend) write(ctx context.Context, key string, body io.Reader, size int64) (int64, error) {
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	dest := s.path(key)
+	if err := conn.MkdirAll(path.Dir(dest)); err != nil {
+		return 0, fmt.Errorf("failed to create directory for %s: %w", key, err)
+	}
+
+	tmpPath := path.Join(path.Dir(dest), fmt.Sprintf("%s%d", tempPrefix, time.Now().UnixNano()))
+	tmpFile, err := conn.Create(tmpPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store %s: %w", key, err)
+	}
+
+	written, err := io.Copy(tmpFile, s.bandwidth.upload().Reader(ctx, contextReader{ctx: ctx, r: body}))
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("read %d of %d bytes", written, size)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = rename(conn, tmpPath, dest)
+	}
+	if err != nil {
+		conn.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	return written, nil
+}
+
+// rename replaces dest atomically where the server supports the
+// posix-rename extension, and removes it first where it does not
+func rename(conn *sftpConn, from, to string) error {
+	if _, ok := conn.HasExtension("posix-rename@openssh.com"); ok {
+		return conn.PosixRename(from, to)
+	}
+	if err := conn.Remove(to); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return conn.Rename(from, to)
+}
+
+// sftpReader closes the connection together with the file. The file is
+// not embedded, so its WriteTo cannot bypass the throttled reader.
+type sftpReader struct {
+	file   *sftp.File
+	reader io.Reader
+	conn   *sftpConn
+}
+
+func (r *sftpReader) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
+func (r *sftpReader) Close() error {
+	r.file.Close()
+	return r.conn.Close()
+}
+
+func (s *SFTPBackend) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := conn.Open(s.path(key))
+	if err != nil {
+		conn.Close()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to download %s: %w", key, ErrNotFound)
+		}
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return &sftpReader{file: file, reader: s.bandwidth.download().Reader(ctx, file), conn: conn}, nil
+}
+
+func (s *SFTPBackend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return collect(s.Objects(ctx, prefix))
+}
+
+// Objects walks the remote directory in lexical order over one connection,
+// skipping the temporary files of uploads in progress
+func (s *SFTPBackend) Objects(ctx context.Context, prefix string) iter.Seq2[FileInfo, error] {
+	return func(yield func(FileInfo, error) bool) {
+		conn, err := s.connect(ctx)
+		if err != nil {
+			yield(FileInfo{}, fmt.Errorf("failed to list files: %w", err))
+			return
+		}
+		defer conn.Close()
+
+		walker := conn.Walk(s.dir)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				if walker.Path() == s.dir && errors.Is(err, fs.ErrNotExist) {
+					return
+				}
+				yield(FileInfo{}, fmt.Errorf("failed to list files: %w", err))
+				return
+			}
+			if err := ctx.Err(); err != nil {
+				yield(FileInfo{}, fmt.Errorf("failed to list files: %w", err))
+				return
+			}
+
+			info := walker.Stat()
+			if info.IsDir() || strings.HasPrefix(info.Name(), tempPrefix) {
+				continue
+			}
+			key := strings.TrimPrefix(walker.Path(), s.dir+"/")
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if !yield(FileInfo{Name: key, LastModified: info.ModTime(), Size: info.Size()}, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (s *SFTPBackend) Stat(ctx context.Context, key string) (FileInfo, error) {
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer conn.Close()
+
+	info, err := conn.Stat(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return FileInfo{}, fmt.Errorf("failed to stat %s: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat %s: %w", key, err)
+	}
+	return FileInfo{Name: key, LastModified: info.ModTime(), Size: info.Size()}, nil
+}
+
+func (s *SFTPBackend) Delete(ctx context.Context, key string) error {
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return nil
+}
+
+func (s *SFTPBackend) URL(key string) string {
+	return (&url.URL{
+		Scheme: "sftp",
+		User:   url.User(s.config.User),
+		Host:   s.addr,
+		Path:   s.path(key),
+	}).String()
+}
@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	testSFTPUser     = "backup"
+	testSFTPPassword = "hunter2"
+)
+
+// sftpServer is an in-process SSH server with the SFTP subsystem, serving
+// the local file system
+type sftpServer struct {
+	addr       string
+	knownHosts string
+	// clientKey is a private key file the server accepts
+	clientKey string
+}
+
+func newSFTPServer(t *testing.T) *sftpServer {
+	t.Helper()
+	dir := t.TempDir()
+
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPublic, clientPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey := filepath.Join(dir, "id_ed25519")
+	block, err := ssh.MarshalPrivateKey(clientPrivate, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(clientKey, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authorized, err := ssh.NewPublicKey(clientPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == testSFTPUser && string(password) == testSFTPPassword {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == testSFTPUser && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	addr := listener.Addr().String()
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{addr}, hostSigner.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &sftpServer{addr: addr, knownHosts: knownHosts, clientKey: clientKey}
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				server.Close()
+				return
+			}
+		}()
+	}
+}
+
+func (s *sftpServer) options(dir string) SFTPOptions {
+	return SFTPOptions{
+		Addr:           s.addr,
+		User:           testSFTPUser,
+		Password:       testSFTPPassword,
+		KnownHostsFile: s.knownHosts,
+		Dir:            dir,
+	}
+}
+
+func TestSFTPBackend(t *testing.T) {
+	server := newSFTPServer(t)
+	dir := filepath.Join(t.TempDir(), "backups")
+	backend, err := NewSFTPBackend(server.options(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if files, err := backend.List(ctx, ""); err != nil || len(files) != 0 {
+		t.Fatalf("Listing a missing directory returned %+v, %v", files, err)
+	}
+	if err := backend.Upload(ctx, "db/one.tar.gz", strings.NewReader("one"), 3); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if err := backend.Upload(ctx, "db/short.tar.gz", strings.NewReader("ab"), 3); err == nil {
+		t.Error("Expected a short body to fail the upload")
+	}
+	if size, err := backend.UploadStream(ctx, "db/two.tar.gz", strings.NewReader("second"), nil); err != nil || size != 6 {
+		t.Fatalf("UploadStream returned %d, %v", size, err)
+	}
+	if err := backend.Upload(ctx, "db/one.tar.gz", strings.NewReader("ONE"), 3); err != nil {
+		t.Fatalf("Overwriting failed: %v", err)
+	}
+
+	files, err := backend.List(ctx, "db/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Unexpected listing %+v", files)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "db")); len(entries) != 2 {
+		t.Errorf("Expected no temporary files to be left, got %d entries", len(entries))
+	}
+
+	body, err := backend.Download(ctx, "db/one.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "ONE" {
+		t.Errorf("Downloaded %q", data)
+	}
+
+	if info, err := backend.Stat(ctx, "db/two.tar.gz"); err != nil || info.Size != 6 {
+		t.Errorf("Stat returned %+v, %v", info, err)
+	}
+	if err := backend.Delete(ctx, "db/one.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Stat(ctx, "db/one.tar.gz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after deleting, got %v", err)
+	}
+	if _, err := backend.Download(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing object, got %v", err)
+	}
+	if url := backend.URL("db/two.tar.gz"); url != "sftp://backup@"+server.addr+dir+"/db/two.tar.gz" {
+		t.Errorf("Unexpected URL %s", url)
+	}
+}
+
+func TestSFTPBackendKeyAuth(t *testing.T) {
+	server := newSFTPServer(t)
+	opts := server.options(t.TempDir())
+	opts.Password = ""
+	opts.KeyFile = server.clientKey
+
+	backend, err := NewSFTPBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Upload(context.Background(), "backup.tar.gz", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("Upload with a key failed: %v", err)
+	}
+}
+
+func TestSFTPBackendRejectsUnknownHost(t *testing.T) {
+	server := newSFTPServer(t)
+	other := newSFTPServer(t)
+	opts := server.options(t.TempDir())
+	// The known_hosts file of another server does not list this one
+	opts.KnownHostsFile = other.knownHosts
+
+	backend, err := NewSFTPBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Upload(context.Background(), "backup.tar.gz", strings.NewReader("data"), 4); err == nil {
+		t.Fatal("Expected the unknown host key to be rejected")
+	}
+}
+
+func TestSFTPBackendWrongPassword(t *testing.T) {
+	server := newSFTPServer(t)
+	opts := server.options(t.TempDir())
+	opts.Password = "wrong"
+
+	backend, err := NewSFTPBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.List(context.Background(), ""); err == nil {
+		t.Fatal("Expected authentication to fail")
+	}
+}
+
+func TestSFTPBackendBandwidth(t *testing.T) {
+	server := newSFTPServer(t)
+	upload, uploadClock := newTestThrottle(func(time.Time) int64 { return 10 << 10 })
+	download, downloadClock := newTestThrottle(func(time.Time) int64 { return 10 << 10 })
+	opts := server.options(t.TempDir())
+	opts.Bandwidth = &Bandwidth{Upload: upload, Download: download}
+
+	backend, err := NewSFTPBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	data := strings.Repeat("x", 50<<10)
+	if err := backend.Upload(ctx, "backup.tar.gz", strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	body, err := backend.Download(ctx, "backup.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.Copy(io.Discard, body)
+	body.Close()
+
+	if got != int64(len(data)) || uploadClock.slept != 4*time.Second || downloadClock.slept != 4*time.Second {
+		t.Errorf("Transferred %d bytes, waited %s uploading and %s downloading; expected 4s each",
+			got, uploadClock.slept, downloadClock.slept)
+	}
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// throttleChunk is the most a throttled reader reads at once, so waits
+// stay short and transfers running at the same time share the rate evenly
+const throttleChunk = 32 << 10
+
+// Bandwidth limits the transfers of every backend it is given to, so
+// replicating to several destinations at once stays within one budget.
+// A nil Bandwidth, or a nil Throttle in it, is unlimited.
+type Bandwidth struct {
+	Upload   *Throttle
+	Download *Throttle
+}
+
+func (b *Bandwidth) upload() *Throttle {
+	if b == nil {
+		return nil
+	}
+	return b.Upload
+}
+
+func (b *Bandwidth) download() *Throttle {
+	if b == nil {
+		return nil
+	}
+	return b.Download
+}
+
+// Throttle is a token bucket. It holds up to one second of data, and its
+// rate is looked up on every read so it can change with the time of day.
+type Throttle struct {
+	// rate returns the bytes per second allowed at a time; zero or less is
+	// unlimited
+	rate func(time.Time) int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewThrottle(rate func(time.Time) int64) *Throttle {
+	return &Throttle{rate: rate, now: time.Now, sleep: sleepContext}
+}
+
+// Wait takes n bytes from the bucket, blocking until they are available.
+// Reads that run ahead borrow from the future, and later ones wait for it.
+func (t *Throttle) Wait(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	now := t.now()
+	rate := t.rate(now)
+	if rate <= 0 {
+		t.tokens = 0
+		t.last = now
+		t.mu.Unlock()
+		return nil
+	}
+	t.tokens = min(t.tokens+now.Sub(t.last).Seconds()*float64(rate), float64(rate))
+	t.last = now
+	t.tokens -= float64(n)
+	var delay time.Duration
+	if t.tokens < 0 {
+		delay = time.Duration(-t.tokens / float64(rate) * float64(time.Second))
+	}
+	t.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	return t.sleep(ctx, delay)
+}
+
+// Reader limits how fast r can be read
+func (t *Throttle) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, throttle: t}
+}
+
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	throttle *Throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := r.throttle.Wait(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledHTTPClient limits the request and response bodies of an S3
+// client. Bodies are throttled as they go over the wire, after the SDK
+// has read them for signing and checksums.
+type throttledHTTPClient struct {
+	client    aws.HTTPClient
+	bandwidth *Bandwidth
+}
+
+func (c *throttledHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = readCloser{
+			Reader: c.bandwidth.upload().Reader(req.Context(), req.Body),
+			Closer: req.Body,
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err == nil && resp.Body != nil {
+		resp.Body = readCloser{
+			Reader: c.bandwidth.download().Reader(req.Context(), resp.Body),
+			Closer: resp.Body,
+		}
+	}
+	return resp, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when a throttle sleeps
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func newTestThrottle(rate func(time.Time) int64) (*Throttle, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	throttle := NewThrottle(rate)
+	throttle.now = func() time.Time { return clock.now }
+	throttle.sleep = func(ctx context.Context, d time.Duration) error {
+		clock.now = clock.now.Add(d)
+		clock.slept += d
+		return ctx.Err()
+	}
+	return throttle, clock
+}
+
+func TestThrottleLimitsRate(t *testing.T) {
+	throttle, clock := newTestThrottle(func(time.Time) int64 { return 1000 })
+
+	data := make([]byte, 3000)
+	n, err := io.Copy(io.Discard, throttle.Reader(context.Background(), bytes.NewReader(data)))
+	if err != nil || n != 3000 {
+		t.Fatalf("Copy returned %d, %v", n, err)
+	}
+	// The first second is the burst the bucket starts with
+	if clock.slept != 2*time.Second {
+		t.Errorf("Expected to wait 2s for 3000 bytes at 1000 B/s, waited %s", clock.slept)
+	}
+}
+
+func TestThrottleFollowsRateChanges(t *testing.T) {
+	rate := int64(1000)
+	throttle, clock := newTestThrottle(func(time.Time) int64 { return rate })
+	ctx := context.Background()
+
+	throttle.Wait(ctx, 1000)
+	throttle.Wait(ctx, 1000)
+	if clock.slept != time.Second {
+		t.Fatalf("Expected to wait 1s, waited %s", clock.slept)
+	}
+
+	// An unlimited period never waits
+	rate = 0
+	for i := 0; i < 10; i++ {
+		throttle.Wait(ctx, 1<<20)
+	}
+	if clock.slept != time.Second {
+		t.Errorf("Expected no waiting while unlimited, waited %s in total", clock.slept)
+	}
+}
+
+func TestThrottleStopsWhenCancelled(t *testing.T) {
+	throttle := NewThrottle(func(time.Time) int64 { return 1 })
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := throttle.Wait(ctx, 1000); err != context.Canceled {
+		t.Errorf("Expected the wait to be cancelled, got %v", err)
+	}
+}
+
+func TestS3ClientBandwidth(t *testing.T) {
+	fake, _ := newFakeS3(t)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	upload, uploadClock := newTestThrottle(func(time.Time) int64 { return 10 << 10 })
+	download, downloadClock := newTestThrottle(func(time.Time) int64 { return 20 << 10 })
+	client, err := NewS3Client(S3Options{
+		Endpoint:        server.URL,
+		Bucket:          testBucket,
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+		Upload:          UploadOptions{StateDir: t.TempDir()},
+		Bandwidth:       &Bandwidth{Upload: upload, Download: download},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("x"), 100<<10)
+	if err := client.Upload(ctx, "backup.tar.gz", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if uploadClock.slept != 9*time.Second {
+		t.Errorf("Expected the 100KiB upload to wait 9s at 10KiB/s, waited %s", uploadClock.slept)
+	}
+
+	body, err := client.Download(ctx, "backup.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Download returned %d bytes, %v", len(got), err)
+	}
+	if downloadClock.slept < 4*time.Second {
+		t.Errorf("Expected the 100KiB download to wait about 4s at 20KiB/s, waited %s", downloadClock.slept)
+	}
+}
@@ -0,0 +1,518 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebDAVOptions configures a WebDAV share, such as a Nextcloud or ownCloud
+// folder
+type WebDAVOptions struct {
+	// URL is the collection backups are stored in, e.g.
+	// https://cloud.example.com/remote.php/dav/files/alice/backups
+	URL string
+	// User and Password authenticate with basic auth, BearerToken with a
+	// bearer token. Without either, requests are sent unauthenticated.
+	User        string
+	Password    string
+	BearerToken string
+	// ChunkedUploadURL is the collection Nextcloud style chunked uploads
+	// are assembled in, e.g.
+	// https://cloud.example.com/remote.php/dav/uploads/alice. Without it,
+	// every object is sent with a single PUT.
+	ChunkedUploadURL string
+	// PartSize is the size of the chunks of a chunked upload
+	PartSize int64
+	// CABundle is a PEM file with the certificates that sign the server's
+	// certificate, for servers behind a private CA
+	CABundle           string
+	InsecureSkipVerify bool
+	// Bandwidth limits the transfer rates; nil is unlimited
+	Bandwidth *Bandwidth
+}
+
+// WebDAVBackend stores backups in a collection on a WebDAV server. Like
+// SFTPBackend, objects are written under a temporary name and moved into
+// place, so a failed upload never leaves a partial backup under its final
+// name. Bodies larger than one part are uploaded in chunks where the
+// server supports Nextcloud's chunked uploads.
+type WebDAVBackend struct {
+	client    *http.Client
+	base      *url.URL
+	chunks    *url.URL
+	user      string
+	password  string
+	token     string
+	partSize  int64
+	bandwidth *Bandwidth
+}
+
+var _ Backend = (*WebDAVBackend)(nil)
+
+// WebDAVError is returned, wrapped, when a WebDAV server answers a request
+// with an unexpected status
+type WebDAVError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+}
+
+func (e *WebDAVError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Status)
+}
+
+// HTTPStatusCode makes the status available to IsRetryable
+func (e *WebDAVError) HTTPStatusCode() int {
+	return e.StatusCode
+}
+
+func NewWebDAVBackend(opts WebDAVOptions) (*WebDAVBackend, error) {
+	base, err := parseCollectionURL(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	var chunks *url.URL
+	if opts.ChunkedUploadURL != "" {
+		if chunks, err = parseCollectionURL(opts.ChunkedUploadURL); err != nil {
+			return nil, err
+		}
+	}
+
+	httpClient, err := newHTTPClient(opts.CABundle, opts.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	partSize := opts.PartSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	return &WebDAVBackend{
+		client:    &http.Client{Transport: httpClient.GetTransport()},
+		base:      base,
+		chunks:    chunks,
+		user:      opts.User,
+		password:  opts.Password,
+		token:     opts.BearerToken,
+		partSize:  partSize,
+		bandwidth: opts.Bandwidth,
+	}, nil
+}
+
+// parseCollectionURL parses the URL of a collection, which gets a trailing
+// slash. Credentials in it are dropped.
+func parseCollectionURL(rawURL string) (*url.URL, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid WebDAV URL %q", rawURL)
+	}
+	parsed.User = nil
+	return parsed.JoinPath("/"), nil
+}
+
+// url maps a key to a resource below the collection. Keys cannot escape it.
+func (w *WebDAVBackend) url(key string) *url.URL {
+	return w.base.JoinPath(path.Clean("/" + key))
+}
+
+// request sends a request to target and returns the response if its
+// status is one of expected. Otherwise the response is closed and a
+// WebDAVError returned, wrapping ErrNotFound for a 404.
+func (w *WebDAVBackend) request(ctx context.Context, method string, target *url.URL, body io.Reader, size int64, header http.Header, expected ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil && size >= 0 {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	switch {
+	case w.token != "":
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	case w.user != "":
+		req.SetBasicAuth(w.user, w.password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	statusErr := &WebDAVError{Method: method, Path: target.Path, StatusCode: resp.StatusCode, Status: resp.Status}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %w", ErrNotFound, statusErr)
+	}
+	return nil, statusErr
+}
+
+// send is request for requests whose response body is not needed
+func (w *WebDAVBackend) send(ctx context.Context, method string, target *url.URL, body io.Reader, size int64, header http.Header, expected ...int) error {
+	resp, err := w.request(ctx, method, target, body, size, header, expected...)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// mkdirAll creates the collection dir, a path below the base collection,
+// and every collection above it
+func (w *WebDAVBackend) mkdirAll(ctx context.Context, dir string) error {
+	target := w.base
+	elements := []string{""}
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		elements = append(elements, strings.Split(dir, "/")...)
+	}
+	for _, element := range elements {
+		target = target.JoinPath(element)
+		// 405 Method Not Allowed is the answer for a collection that exists
+		if err := w.send(ctx, "MKCOL", target, nil, 0, nil, http.StatusCreated, http.StatusMethodNotAllowed); err != nil {
+			return fmt.Errorf("failed to create collection %s: %w", target.Path, err)
+		}
+	}
+	return nil
+}
+
+// move renames from to to, replacing it
+func (w *WebDAVBackend) move(ctx context.Context, from, to *url.URL) error {
+	header := http.Header{"Destination": {to.String()}, "Overwrite": {"T"}}
+	return w.send(ctx, "MOVE", from, nil, 0, header, http.StatusCreated, http.StatusNoContent)
+}
+
+func (w *WebDAVBackend) Upload(ctx context.Context, key string, body io.Reader, size int64) error {
+	_, err := w.write(ctx, key, body, size)
+	return err
+}
+
+func (w *WebDAVBackend) UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	_, err = w.write(ctx, key, file, info.Size())
+	return err
+}
+
+func (w *WebDAVBackend) UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	return w.write(ctx, key, body, -1)
+}
+
+// write stores body under key, in chunks when it is larger than one part
+// and the server takes chunked uploads. A size of -1 accepts any length.
+func (w *WebDAVBackend) write(ctx context.Context, key string, body io.Reader, size int64) (int64, error) {
+	if err := w.mkdirAll(ctx, path.Dir(path.Clean("/"+key))); err != nil {
+		return 0, fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	body = w.bandwidth.upload().Reader(ctx, contextReader{ctx: ctx, r: body})
+
+	if w.chunks != nil && (size < 0 || size > w.partSize) {
+		// Only the first part is read ahead, so a small body is still sent
+		// with a single request
+		first := make([]byte, w.partSize)
+		n, err := io.ReadFull(body, first)
+		switch err {
+		case nil:
+			written, err := w.writeChunks(ctx, key, io.MultiReader(bytes.NewReader(first), body))
+			if err == nil && size >= 0 && written != size {
+				err = fmt.Errorf("read %d of %d bytes", written, size)
+			}
+			if err != nil {
+				return 0, fmt.Errorf("failed to store %s: %w", key, err)
+			}
+			return written, nil
+		case io.EOF, io.ErrUnexpectedEOF:
+			body, size = bytes.NewReader(first[:n]), int64(n)
+		default:
+			return 0, fmt.Errorf("failed to store %s: %w", key, err)
+		}
+	}
+
+	written, err := w.put(ctx, key, body, size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store %s: %w", key, err)
+	}
+	return written, nil
+}
+
+// put uploads body with a single request under a temporary name next to
+// key and moves it into place
+func (w *WebDAVBackend) put(ctx context.Context, key string, body io.Reader, size int64) (int64, error) {
+	dest := w.url(key)
+	tmp := dest.JoinPath("..", fmt.Sprintf("%s%d", tempPrefix, time.Now().UnixNano()))
+
+	counter := &countingReader{r: body}
+	err := w.send(ctx, http.MethodPut, tmp, counter, size, nil, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	if err == nil && size >= 0 && counter.n != size {
+		err = fmt.Errorf("read %d of %d bytes", counter.n, size)
+	}
+	if err == nil {
+		err = w.move(ctx, tmp, dest)
+	}
+	if err != nil {
+		w.discard(tmp)
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// writeChunks uploads body as a Nextcloud chunked upload: the chunks are
+// stored in a collection of their own, which the server assembles into
+// key when the special .file member is moved there. It returns the number
+// of bytes uploaded.
+func (w *WebDAVBackend) writeChunks(ctx context.Context, key string, body io.Reader) (int64, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	upload := w.chunks.JoinPath("backuper-" + hex.EncodeToString(id))
+	dest := w.url(key)
+	header := http.Header{"Destination": {dest.String()}}
+
+	if err := w.send(ctx, "MKCOL", upload, nil, 0, header, http.StatusCreated); err != nil {
+		return 0, fmt.Errorf("failed to start chunked upload: %w", err)
+	}
+
+	var written int64
+	buf := make([]byte, w.partSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(body, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			w.discard(upload)
+			return 0, fmt.Errorf("failed to read upload data: %w", err)
+		}
+
+		// Chunks are assembled in the order of their names
+		chunk := upload.JoinPath(fmt.Sprintf("%05d", number))
+		if err := w.send(ctx, http.MethodPut, chunk, bytes.NewReader(buf[:n]), int64(n), header, http.StatusCreated, http.StatusNoContent); err != nil {
+			w.discard(upload)
+			return 0, fmt.Errorf("failed to upload chunk %d: %w", number, err)
+		}
+		written += int64(n)
+	}
+
+	if err := w.move(ctx, upload.JoinPath(".file"), dest); err != nil {
+		w.discard(upload)
+		return 0, fmt.Errorf("failed to assemble chunked upload: %w", err)
+	}
+	return written, nil
+}
+
+// discard deletes what a failed upload left behind. It uses its own
+// context because the upload's context is usually already cancelled.
+func (w *WebDAVBackend) discard(target *url.URL) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	w.send(ctx, http.MethodDelete, target, nil, 0, nil, http.StatusNoContent, http.StatusOK)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// webdavReader closes the response together with the throttled body
+type webdavReader struct {
+	io.Reader
+	body io.Closer
+}
+
+func (r *webdavReader) Close() error {
+	return r.body.Close()
+}
+
+func (w *WebDAVBackend) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := w.request(ctx, http.MethodGet, w.url(key), nil, 0, nil, http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return &webdavReader{Reader: w.bandwidth.download().Reader(ctx, resp.Body), body: resp.Body}, nil
+}
+
+// propfindBody asks for the properties a listing needs
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+// davMultistatus is the answer to a PROPFIND request
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// davResource is one resource of a PROPFIND answer
+type davResource struct {
+	// path is the unescaped path of the resource, without a trailing slash
+	path       string
+	collection bool
+	size       int64
+	modified   time.Time
+}
+
+// propfind describes target, and with depth "1" its members too
+func (w *WebDAVBackend) propfind(ctx context.Context, target *url.URL, depth string) ([]davResource, error) {
+	header := http.Header{"Depth": {depth}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := w.request(ctx, "PROPFIND", target, strings.NewReader(propfindBody), int64(len(propfindBody)), header, http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var multistatus davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return nil, fmt.Errorf("invalid PROPFIND response for %s: %w", target.Path, err)
+	}
+
+	var resources []davResource
+	for _, response := range multistatus.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, fmt.Errorf("invalid href %q in PROPFIND response: %w", response.Href, err)
+		}
+		resource := davResource{path: strings.TrimSuffix(href.Path, "/")}
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			prop := propstat.Prop
+			resource.collection = prop.ResourceType.Collection != nil
+			if prop.ContentLength != "" {
+				resource.size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+			}
+			if prop.LastModified != "" {
+				resource.modified, _ = http.ParseTime(prop.LastModified)
+			}
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+func (w *WebDAVBackend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return collect(w.Objects(ctx, prefix))
+}
+
+// Objects walks the collection one level per PROPFIND request, since many
+// servers refuse Depth: infinity, skipping the temporary files of uploads
+// in progress. Members are visited in lexical order.
+func (w *WebDAVBackend) Objects(ctx context.Context, prefix string) iter.Seq2[FileInfo, error] {
+	return func(yield func(FileInfo, error) bool) {
+		base := strings.TrimSuffix(w.base.Path, "/")
+
+		var walk func(dir *url.URL) bool
+		walk = func(dir *url.URL) bool {
+			resources, err := w.propfind(ctx, dir, "1")
+			if err != nil {
+				if dir == w.base && errors.Is(err, ErrNotFound) {
+					return true
+				}
+				return yield(FileInfo{}, fmt.Errorf("failed to list files: %w", err))
+			}
+			sort.Slice(resources, func(i, j int) bool {
+				return resources[i].path < resources[j].path
+			})
+
+			dirPath := strings.TrimSuffix(dir.Path, "/")
+			for _, resource := range resources {
+				if resource.path == dirPath || !strings.HasPrefix(resource.path, base+"/") {
+					continue
+				}
+				key := strings.TrimPrefix(resource.path, base+"/")
+				if resource.collection {
+					// Collections that cannot hold a key with prefix are skipped
+					if !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+						continue
+					}
+					if !walk(w.url(key)) {
+						return false
+					}
+					continue
+				}
+				if strings.HasPrefix(path.Base(key), tempPrefix) || !strings.HasPrefix(key, prefix) {
+					continue
+				}
+				if !yield(FileInfo{Name: key, LastModified: resource.modified, Size: resource.size}, nil) {
+					return false
+				}
+			}
+			return true
+		}
+		walk(w.base)
+	}
+}
+
+func (w *WebDAVBackend) Stat(ctx context.Context, key string) (FileInfo, error) {
+	resources, err := w.propfind(ctx, w.url(key), "0")
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat %s: %w", key, err)
+	}
+	if len(resources) == 0 || resources[0].collection {
+		return FileInfo{}, fmt.Errorf("failed to stat %s: %w", key, ErrNotFound)
+	}
+	return FileInfo{Name: key, LastModified: resources[0].modified, Size: resources[0].size}, nil
+}
+
+func (w *WebDAVBackend) Delete(ctx context.Context, key string) error {
+	err := w.send(ctx, http.MethodDelete, w.url(key), nil, 0, nil, http.StatusNoContent, http.StatusOK)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	return nil
+}
+
+// URL returns the link to an object on the server, without credentials
+func (w *WebDAVBackend) URL(key string) string {
+	return w.url(key).String()
+}
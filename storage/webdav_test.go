@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	davFiles   = "/remote.php/dav/files/alice"
+	davUploads = "/remote.php/dav/uploads/alice"
+)
+
+// fakeDAV is a WebDAV server in the style of Nextcloud: files are served
+// by golang.org/x/net/webdav, and chunked uploads are assembled by hand
+type fakeDAV struct {
+	fs      webdav.FileSystem
+	files   http.Handler
+	mu      sync.Mutex
+	uploads map[string]map[string][]byte
+	// chunks counts the chunks uploaded
+	chunks int
+	// auth is the Authorization header every request must carry
+	auth string
+}
+
+func newFakeDAV(t *testing.T, auth string) (*fakeDAV, *httptest.Server) {
+	fs := webdav.NewMemFS()
+	fake := &fakeDAV{
+		fs:      fs,
+		files:   &webdav.Handler{Prefix: davFiles, FileSystem: fs, LockSystem: webdav.NewMemLS()},
+		uploads: make(map[string]map[string][]byte),
+		auth:    auth,
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeDAV) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != f.auth {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if rest, ok := strings.CutPrefix(req.URL.Path, davUploads+"/"); ok {
+		upload, name, _ := strings.Cut(rest, "/")
+		f.serveUpload(w, req, upload, name)
+		return
+	}
+	f.files.ServeHTTP(w, req)
+}
+
+// serveUpload implements Nextcloud's chunked uploads: chunks are PUT into
+// an upload collection and assembled by moving its .file member
+func (f *fakeDAV) serveUpload(w http.ResponseWriter, req *http.Request, upload, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	chunks, ok := f.uploads[upload]
+	switch {
+	case req.Method == "MKCOL" && name == "":
+		f.uploads[upload] = make(map[string][]byte)
+		w.WriteHeader(http.StatusCreated)
+	case !ok:
+		w.WriteHeader(http.StatusNotFound)
+	case req.Method == http.MethodPut:
+		data, _ := io.ReadAll(req.Body)
+		chunks[name] = data
+		f.chunks++
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == "MOVE" && name == ".file":
+		names := make([]string, 0, len(chunks))
+		for name := range chunks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var data []byte
+		for _, name := range names {
+			data = append(data, chunks[name]...)
+		}
+
+		destination, _ := url.Parse(req.Header.Get("Destination"))
+		file, err := f.fs.OpenFile(req.Context(), strings.TrimPrefix(destination.Path, davFiles), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		file.Write(data)
+		file.Close()
+		delete(f.uploads, upload)
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodDelete && name == "":
+		delete(f.uploads, upload)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestWebDAVBackend(t *testing.T, opts WebDAVOptions) (*fakeDAV, *WebDAVBackend) {
+	t.Helper()
+	fake, server := newFakeDAV(t, "Basic YWxpY2U6c2VjcmV0")
+	opts.URL = server.URL + davFiles + "/backups"
+	opts.User, opts.Password = "alice", "secret"
+	if opts.ChunkedUploadURL != "" {
+		opts.ChunkedUploadURL = server.URL + davUploads
+	}
+	backend, err := NewWebDAVBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, backend
+}
+
+func TestWebDAVBackend(t *testing.T) {
+	_, backend := newTestWebDAVBackend(t, WebDAVOptions{})
+	ctx := context.Background()
+
+	if files, err := backend.List(ctx, ""); err != nil || len(files) != 0 {
+		t.Fatalf("Expected an empty listing before the first upload, got %+v, %v", files, err)
+	}
+
+	path, data := writeTestFile(t, 4096)
+	if err := backend.UploadFile(ctx, "hosts/web1/job-20240101-000000.tar.gz", path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Upload(ctx, "job-20240102-000000.tar.gz", strings.NewReader("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := backend.UploadStream(ctx, "job 2024 ü.tar.gz", strings.NewReader("streamed"), nil); err != nil || n != 8 {
+		t.Fatalf("UploadStream returned %d, %v", n, err)
+	}
+	if err := backend.Upload(ctx, "short.tar.gz", strings.NewReader("abc"), 4); err == nil {
+		t.Error("Expected a body shorter than its size to fail")
+	}
+
+	files, err := backend.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+		if file.LastModified.IsZero() {
+			t.Errorf("%s: expected a modification time", file.Name)
+		}
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "hosts/web1/job-20240101-000000.tar.gz,job 2024 ü.tar.gz,job-20240102-000000.tar.gz" {
+		t.Errorf("Unexpected listing %v", names)
+	}
+	if files, _ := backend.List(ctx, "hosts/web1/"); len(files) != 1 || files[0].Size != 4096 {
+		t.Errorf("Expected the prefix to select one file, got %+v", files)
+	}
+	if files, _ := backend.List(ctx, "job-"); len(files) != 1 {
+		t.Errorf("Expected the prefix to skip other collections, got %+v", files)
+	}
+
+	info, err := backend.Stat(ctx, "hosts/web1/job-20240101-000000.tar.gz")
+	if err != nil || info.Size != 4096 {
+		t.Errorf("Stat returned %+v, %v", info, err)
+	}
+	body, err := backend.Download(ctx, "hosts/web1/job-20240101-000000.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, _ := io.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(downloaded, data) {
+		t.Error("Downloaded data does not match the upload")
+	}
+
+	if err := backend.Delete(ctx, "job-20240102-000000.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Delete(ctx, "job-20240102-000000.tar.gz"); err != nil {
+		t.Errorf("Expected deleting a missing file to succeed, got %v", err)
+	}
+	for name, err := range map[string]error{
+		"stat":     func() error { _, err := backend.Stat(ctx, "job-20240102-000000.tar.gz"); return err }(),
+		"download": func() error { _, err := backend.Download(ctx, "job-20240102-000000.tar.gz"); return err }(),
+	} {
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected ErrNotFound, got %v", name, err)
+		}
+	}
+
+	if url := backend.URL("job 2024 ü.tar.gz"); !strings.HasSuffix(url, davFiles+"/backups/job%202024%20%C3%BC.tar.gz") || strings.Contains(url, "secret") {
+		t.Errorf("Unexpected URL %s", url)
+	}
+}
+
+func TestWebDAVChunkedUpload(t *testing.T) {
+	fake, backend := newTestWebDAVBackend(t, WebDAVOptions{ChunkedUploadURL: "set", PartSize: 1024})
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	if n, err := backend.UploadStream(ctx, "job-20240101-000000.tar.gz", bytes.NewReader(data), nil); err != nil || n != int64(len(data)) {
+		t.Fatalf("UploadStream returned %d, %v", n, err)
+	}
+	if fake.chunks != 3 || len(fake.uploads) != 0 {
+		t.Errorf("Expected 3 chunks and no upload left, got %d and %d", fake.chunks, len(fake.uploads))
+	}
+	body, err := backend.Download(ctx, "job-20240101-000000.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, _ := io.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(downloaded, data) {
+		t.Error("Assembled object does not match the upload")
+	}
+
+	// A body that fits in one part is sent with a single request
+	if err := backend.Upload(ctx, "small.json.gz", strings.NewReader("small"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if fake.chunks != 3 {
+		t.Errorf("Expected no chunks for a small body, got %d", fake.chunks)
+	}
+}
+
+func TestWebDAVAuth(t *testing.T) {
+	fake, server := newFakeDAV(t, "Bearer token")
+	backend, err := NewWebDAVBackend(WebDAVOptions{URL: server.URL + davFiles, BearerToken: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := backend.Upload(ctx, "backup.tar.gz", strings.NewReader("data"), 4); err != nil {
+		t.Fatalf("Bearer auth failed: %v", err)
+	}
+
+	fake.auth = "Bearer other"
+	_, err = backend.List(ctx, "")
+	var davErr *WebDAVError
+	if !errors.As(err, &davErr) || davErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a 401 WebDAVError, got %v", err)
+	}
+	if IsRetryable(err) {
+		t.Error("Expected rejected credentials not to be retried")
+	}
+	if !IsRetryable(&WebDAVError{StatusCode: http.StatusServiceUnavailable}) {
+		t.Error("Expected a 503 to be retried")
+	}
+}
+
+func TestWebDAVInvalidURL(t *testing.T) {
+	for _, rawURL := range []string{"", "ftp://example.com/dav", "/remote.php/dav"} {
+		if _, err := NewWebDAVBackend(WebDAVOptions{URL: rawURL}); err == nil {
+			t.Errorf("%q: expected an error", rawURL)
+		}
+	}
+}
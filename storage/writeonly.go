@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"time"
+)
+
+// ErrWriteOnly is returned, wrapped, when deleting from a write-only
+// destination
+var ErrWriteOnly = errors.New("destination is write-only")
+
+// writeOnlyBackend refuses to delete anything from the backend it wraps
+type writeOnlyBackend struct {
+	backend Backend
+}
+
+// resumableWriteOnlyBackend keeps resuming uploads, but never aborts them
+type resumableWriteOnlyBackend struct {
+	*writeOnlyBackend
+	resumable ResumableBackend
+}
+
+var (
+	_ Backend          = (*writeOnlyBackend)(nil)
+	_ Presigner        = (*writeOnlyBackend)(nil)
+	_ ResumableBackend = (*resumableWriteOnlyBackend)(nil)
+)
+
+// WithWriteOnly returns a backend that never deletes objects or aborts
+// unfinished uploads, leaving their expiry to the bucket's lifecycle
+// rules. Even a bug or a bad retention limit cannot remove a backup
+// through it.
+func WithWriteOnly(backend Backend) Backend {
+	writeOnly := &writeOnlyBackend{backend: backend}
+	if resumable, ok := backend.(ResumableBackend); ok {
+		return &resumableWriteOnlyBackend{writeOnlyBackend: writeOnly, resumable: resumable}
+	}
+	return writeOnly
+}
+
+func (w *writeOnlyBackend) Upload(ctx context.Context, key string, body io.Reader, size int64) error {
+	return w.backend.Upload(ctx, key, body, size)
+}
+
+func (w *writeOnlyBackend) UploadFile(ctx context.Context, key, filePath string, metadata map[string]string) error {
+	return w.backend.UploadFile(ctx, key, filePath, metadata)
+}
+
+func (w *writeOnlyBackend) UploadStream(ctx context.Context, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	return w.backend.UploadStream(ctx, key, body, metadata)
+}
+
+func (w *writeOnlyBackend) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	return w.backend.Download(ctx, key)
+}
+
+func (w *writeOnlyBackend) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	return w.backend.List(ctx, prefix)
+}
+
+func (w *writeOnlyBackend) Objects(ctx context.Context, prefix string) iter.Seq2[FileInfo, error] {
+	return w.backend.Objects(ctx, prefix)
+}
+
+func (w *writeOnlyBackend) Stat(ctx context.Context, key string) (FileInfo, error) {
+	return w.backend.Stat(ctx, key)
+}
+
+func (w *writeOnlyBackend) Delete(ctx context.Context, key string) error {
+	return fmt.Errorf("%w: not deleting %s", ErrWriteOnly, key)
+}
+
+func (w *writeOnlyBackend) URL(key string) string {
+	return w.backend.URL(key)
+}
+
+func (w *writeOnlyBackend) PresignURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return PresignURL(ctx, w.backend, key, expiry)
+}
+
+func (w *writeOnlyBackend) Retries() int64 {
+	return RetryCount(w.backend)
+}
+
+func (w *resumableWriteOnlyBackend) ResumePendingUploads(ctx context.Context) ([]ResumedUpload, error) {
+	return w.resumable.ResumePendingUploads(ctx)
+}
+
+func (w *resumableWriteOnlyBackend) AbortStaleUploads(ctx context.Context, prefix string, olderThan time.Duration) (int, error) {
+	return 0, fmt.Errorf("%w: not aborting unfinished uploads under %q", ErrWriteOnly, prefix)
+}
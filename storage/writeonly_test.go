@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithWriteOnly(t *testing.T) {
+	ctx := context.Background()
+	local, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := WithWriteOnly(local)
+
+	if err := backend.Upload(ctx, "backup.tar.gz", strings.NewReader("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Delete(ctx, "backup.tar.gz"); !errors.Is(err, ErrWriteOnly) {
+		t.Errorf("Expected ErrWriteOnly, got %v", err)
+	}
+	if files, _ := backend.List(ctx, ""); len(files) != 1 {
+		t.Errorf("Expected the backup to be kept, got %+v", files)
+	}
+	if IsRetryable(err) {
+		t.Error("Expected a refused delete not to be retried")
+	}
+}
+
+func TestWithWriteOnlyKeepsUnfinishedUploads(t *testing.T) {
+	fake, client := newFakeS3(t)
+	ctx := context.Background()
+	if _, err := client.client.CreateMultipartUpload(ctx, client.createMultipartUploadInput("backup.tar.gz", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, ok := WithWriteOnly(client).(ResumableBackend)
+	if !ok {
+		t.Fatal("Expected an S3 client to stay resumable when write-only")
+	}
+	if _, err := backend.AbortStaleUploads(ctx, "", -time.Hour); !errors.Is(err, ErrWriteOnly) {
+		t.Errorf("Expected ErrWriteOnly, got %v", err)
+	}
+	if len(fake.uploads) != 1 || fake.requests["AbortMultipartUpload"] != 0 {
+		t.Errorf("Expected the upload not to be aborted, got %d upload(s)", len(fake.uploads))
+	}
+}
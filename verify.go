@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/IndrajeethY/CloudFlareBackuper/backup"
+	"github.com/IndrajeethY/CloudFlareBackuper/config"
+	"github.com/IndrajeethY/CloudFlareBackuper/notification"
+	"github.com/IndrajeethY/CloudFlareBackuper/repository"
+	"github.com/IndrajeethY/CloudFlareBackuper/storage"
+)
+
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	configPath := flags.String("config", "config.yml", "Path to configuration file")
+	name := flags.String("name", "", "Backup to verify (defaults to the latest backup)")
+	prefix := flags.String("prefix", "", "Name prefix used to pick the latest backup (defaults to backup.name_prefix)")
+	host := flags.String("host", "", "Host whose backups to read when backup.key_template uses {{.Host}} (defaults to this host)")
+	destination := flags.String("destination", "", "Destination to read from (defaults to the first one)")
+	notify := flags.Bool("notify", true, "Send the result through the configured notifiers")
+	allowUnencrypted := flags.Bool("allow-unencrypted", false, "Accept archives without encryption although encryption.enabled is set, such as those taken before it was")
+	flags.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	backend, err := openDestination(cfg, *destination, *host)
+	if err != nil {
+		return err
+	}
+
+	key, err := decryptionKey(cfg)
+	if err != nil {
+		return err
+	}
+
+	var notifier notification.Notifier
+	if *notify {
+		if notifier, err = newNotifier(cfg); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *prefix == "" {
+		*prefix = cfg.Backup.NamePrefix
+	}
+
+	var result *notification.VerifyResult
+	if cfg.Backup.Mode == config.ModeRepository {
+		result, err = verifySnapshot(ctx, repository.New(backend, cfg.Backup.Repository.Path, key), *name, *prefix)
+	} else {
+		requireEncryption := cfg.Encryption.Enabled && !*allowUnencrypted
+		result, err = verifyArchives(ctx, backend, key, requireEncryption, *name, *prefix)
+	}
+	if err != nil {
+		// A backup that cannot be found or read is reported like any other failure
+		if notifier != nil {
+			notifier.SendBackupFailure(fmt.Errorf("verification failed: %w", err))
+		}
+		return err
+	}
+
+	for _, problem := range result.Problems {
+		log.Printf("  %s", problem)
+	}
+	if notifier != nil {
+		if err := notifier.SendVerifyResult(*result); err != nil {
+			log.Printf("Failed to send notification: %v", err)
+		}
+	}
+
+	if !result.OK() {
+		return fmt.Errorf("%s has %d problem(s)", result.FileName, len(result.Problems))
+	}
+	log.Printf("%s is intact: %d entries, %d bytes checked", result.FileName, result.Entries, result.Bytes)
+	return nil
+}
+
+// verifyArchives checks an archive and, for an incremental backup, every
+// archive before it that a restore would need. requireEncryption refuses
+// unencrypted archives whatever their name and metadata say.
+func verifyArchives(ctx context.Context, backend storage.Backend, key *backup.Key, requireEncryption bool, fileName, prefix string) (*notification.VerifyResult, error) {
+	var err error
+	if fileName == "" {
+		if fileName, err = latestBackup(ctx, backend, prefix); err != nil {
+			return nil, fmt.Errorf("failed to find latest backup: %w", err)
+		}
+	}
+
+	chain, err := restoreChain(ctx, backend, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &notification.VerifyResult{FileName: fileName}
+	for _, archive := range chain {
+		log.Printf("Verifying %s...", archive)
+		report, err := verifyArchive(ctx, backend, key, requireEncryption, archive)
+		if err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s: %v", archive, err))
+			continue
+		}
+		if !report.HasManifest {
+			log.Printf("%s has no manifest, only the integrity of the stream was checked", archive)
+		}
+
+		result.Entries += report.Entries
+		result.Bytes += report.Bytes
+		for _, problem := range report.Problems() {
+			if len(chain) > 1 {
+				problem = archive + ": " + problem
+			}
+			result.Problems = append(result.Problems, problem)
+		}
+	}
+	return result, nil
+}
+
+func verifyArchive(ctx context.Context, backend storage.Backend, key *backup.Key, requireEncryption bool, fileName string) (*backup.VerifyReport, error) {
+	// An archive whose name or metadata says it is encrypted must be
+	var metadata map[string]string
+	if info, err := backend.Stat(ctx, fileName); err == nil {
+		metadata = info.Metadata
+	}
+	opts := backup.VerifyOptions{
+		DecryptionKey: key,
+		Encrypted:     requireEncryption || backup.ExpectEncrypted(fileName, metadata),
+	}
+
+	// The sidecar only matters for archives that lost their embedded manifest
+	if body, err := backend.Download(ctx, backup.ManifestFilename(fileName)); err == nil {
+		opts.Manifest, err = backup.ReadManifest(body, key)
+		body.Close()
+		if err != nil {
+			log.Printf("Ignoring unreadable manifest of %s: %v", fileName, err)
+		}
+	}
+
+	body, err := backend.Download(ctx, fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return backup.VerifyArchive(body, opts)
+}
+
+// verifySnapshot checks every chunk a repository snapshot references
+func verifySnapshot(ctx context.Context, repo *repository.Repository, name, prefix string) (*notification.VerifyResult, error) {
+	if name == "" {
+		snapshots, err := repo.Snapshots(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if len(snapshots) == 0 {
+			return nil, fmt.Errorf("no snapshots found with prefix %q", prefix)
+		}
+		name = snapshots[len(snapshots)-1]
+	}
+
+	snapshot, err := repo.LoadSnapshot(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load snapshot %s: %w", name, err)
+	}
+
+	log.Printf("Verifying snapshot %s...", name)
+	problems, err := repo.Verify(ctx, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return &notification.VerifyResult{
+		FileName: name,
+		Entries:  len(snapshot.Files),
+		Bytes:    snapshot.TotalSize(),
+		Problems: problems,
+	}, nil
+}